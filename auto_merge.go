@@ -0,0 +1,116 @@
+package rdb
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// 磁盘空间不足时后台 merge 的等待时间最多是检查间隔的多少倍
+const autoMergeMaxBackoff = 64
+
+// AutoMergeResult 一次后台 merge 的结果
+type AutoMergeResult struct {
+	StartedAt     time.Time
+	Duration      time.Duration
+	ReclaimedSize int64         // merge 开始时可以回收的数据量，Compact 时为回收的文件大小
+	Err           error         // merge 失败的原因，成功时为 nil
+	NextCheck     time.Duration // 距离下一次检查的时间，磁盘空间不足时会逐渐变长
+}
+
+// startAutoMerge 启动后台 merge 的协程
+func (db *DB) startAutoMerge() {
+	db.bgTasks.Add(1)
+	go func() {
+		defer db.bgTasks.Done()
+		interval := db.config.AutoMergeInterval
+		// 磁盘空间不足时的等待时间，为 0 表示没有退避
+		var backoff time.Duration
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-db.closeCh:
+				return
+			case <-timer.C:
+			}
+
+			if db.shouldAutoMerge(time.Now()) {
+				result := db.runAutoMerge()
+				switch {
+				case errors.Is(result.Err, ErrMergeRatioUnreached), errors.Is(result.Err, ErrMergeInProgress):
+					// 没有进行 merge，不作为一次后台 merge
+					timer.Reset(nextAutoMergeDelay(backoff, interval))
+					continue
+				case errors.Is(result.Err, ErrNoEnoughSpaceForMerge):
+					// 磁盘空间不足时退避，避免反复遍历数据文件
+					backoff = nextAutoMergeBackoff(backoff, interval)
+				default:
+					backoff = 0
+				}
+				result.NextCheck = nextAutoMergeDelay(backoff, interval)
+				db.mutex.Lock()
+				db.autoMergeRuns++
+				db.lastAutoMerge = result
+				db.mutex.Unlock()
+				if db.config.OnAutoMerge != nil {
+					db.config.OnAutoMerge(result)
+				}
+			}
+			timer.Reset(nextAutoMergeDelay(backoff, interval))
+		}
+	}()
+}
+
+func nextAutoMergeDelay(backoff, interval time.Duration) time.Duration {
+	if backoff > 0 {
+		return backoff
+	}
+	return interval
+}
+
+// nextAutoMergeBackoff 上一次等待 last 之后仍然空间不足，下一次的等待时间
+func nextAutoMergeBackoff(last, interval time.Duration) time.Duration {
+	if last < interval {
+		return interval * 2
+	}
+	if last*2 > interval*autoMergeMaxBackoff {
+		return interval * autoMergeMaxBackoff
+	}
+	return last * 2
+}
+
+// shouldAutoMerge 检查在 now 时刻是否满足后台 merge 的条件
+func (db *DB) shouldAutoMerge(now time.Time) bool {
+	if !db.config.AutoMergeWindow.Contains(now) {
+		return false
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.activeFile == nil || db.isMerging {
+		return false
+	}
+	return len(db.archivedFiles) >= db.config.AutoMergeMinFiles && db.reclaimSize > 0
+}
+
+// runAutoMerge 进行一次后台 merge，无效数据的占比没有达到 AutoMergeRatio 时不会 merge
+// 设置了 AutoCompactFiles 时只回收无效数据占比最高的几个文件
+func (db *DB) runAutoMerge() AutoMergeResult {
+	db.mutex.RLock()
+	result := AutoMergeResult{StartedAt: time.Now(), ReclaimedSize: db.reclaimSize}
+	db.mutex.RUnlock()
+	if db.config.AutoCompactFiles > 0 {
+		var compactResult *CompactResult
+		compactResult, result.Err = db.Compact(CompactConfigs{
+			MaxFiles:        db.config.AutoCompactFiles,
+			MinGarbageRatio: db.config.AutoMergeRatio,
+		})
+		if compactResult != nil {
+			result.ReclaimedSize = compactResult.ReclaimedSize
+		}
+	} else {
+		result.Err = db.merge(context.Background(), db.config.AutoMergeRatio, MergeOptions{})
+	}
+	result.Duration = time.Since(result.StartedAt)
+	return result
+}
@@ -0,0 +1,116 @@
+package rdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_AutoMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	opts.AutoMergeInterval = 20 * time.Millisecond
+	opts.AutoMergeRatio = 0.3
+	results := make(chan AutoMergeResult, 16)
+	opts.OnAutoMerge = func(result AutoMergeResult) {
+		results <- result
+	}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	for i := 0; i < 900; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+
+	select {
+	case result := <-results:
+		assert.Nil(t, result.Err)
+		assert.True(t, result.ReclaimedSize > 0)
+		assert.Equal(t, opts.AutoMergeInterval, result.NextCheck)
+	case <-time.After(5 * time.Second):
+		t.Fatal("auto merge did not run")
+	}
+	stat := db.Stat()
+	assert.Equal(t, uint(1), stat.AutoMergeRuns)
+	assert.Nil(t, stat.LastAutoMerge.Err)
+
+	// merge 的结果立即生效，没有可以回收的数据之后不会再次 merge
+	assert.True(t, stat.DataFileNum < 3)
+	assert.Equal(t, 100, len(db.ListKeys()))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, uint(1), db.Stat().AutoMergeRuns)
+}
+
+func TestDB_AutoMerge_Conditions(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge-cond")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	opts.AutoMergeInterval = 10 * time.Millisecond
+	opts.AutoMergeMinFiles = 100
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+
+	// 归档文件的数量不够
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, uint(0), db.Stat().AutoMergeRuns)
+
+	assert.Nil(t, db.Close())
+
+	// 不在允许的时间段内
+	opts.AutoMergeInterval = 0
+	opts.AutoMergeMinFiles = 1
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	now := time.Now()
+	offset := now.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()))
+	assert.False(t, TimeWindow{Start: offset + time.Hour, End: offset + 2*time.Hour}.Contains(now))
+	assert.True(t, db.shouldAutoMerge(now))
+	// 活跃文件不算在归档文件的数量中
+	db.config.AutoMergeMinFiles = len(db.archivedFiles) + 1
+	assert.False(t, db.shouldAutoMerge(now))
+	db.config.AutoMergeMinFiles = len(db.archivedFiles)
+	assert.True(t, db.shouldAutoMerge(now))
+	db.config.AutoMergeWindow = TimeWindow{Start: offset + time.Hour, End: offset + 2*time.Hour}
+	assert.False(t, db.shouldAutoMerge(now))
+}
+
+func TestTimeWindow_Contains(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2024, 1, 1, hour, 30, 0, 0, time.Local)
+	}
+	assert.True(t, TimeWindow{}.Contains(at(12)))
+
+	night := TimeWindow{Start: 22 * time.Hour, End: 6 * time.Hour}
+	assert.True(t, night.Contains(at(23)))
+	assert.True(t, night.Contains(at(3)))
+	assert.False(t, night.Contains(at(12)))
+
+	day := TimeWindow{Start: 9 * time.Hour, End: 18 * time.Hour}
+	assert.True(t, day.Contains(at(9)))
+	assert.False(t, day.Contains(at(18)))
+}
+
+func TestNextAutoMergeBackoff(t *testing.T) {
+	interval := time.Second
+	backoff := nextAutoMergeBackoff(0, interval)
+	assert.Equal(t, 2*time.Second, backoff)
+	for i := 0; i < 10; i++ {
+		backoff = nextAutoMergeBackoff(backoff, interval)
+	}
+	assert.Equal(t, autoMergeMaxBackoff*interval, backoff)
+	assert.Equal(t, interval, nextAutoMergeDelay(0, interval))
+}
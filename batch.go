@@ -1,6 +1,7 @@
 package rdb
 
 import (
+	"bytes"
 	"encoding/binary"
 	"github.com/youzeliang/rdb/data"
 	"sync"
@@ -35,6 +36,11 @@ func (db *DB) NewWriteBatch(opts WriteBatchConfigs) *WriteBatch {
 }
 
 func (wb *WriteBatch) Put(key []byte, value []byte) error {
+	return wb.PutCF(wb.db.defaultFamily, key, value)
+}
+
+// PutCF 向指定的列族写入数据，同一个批次可以跨越多个列族
+func (wb *WriteBatch) PutCF(cf *ColumnFamily, key []byte, value []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
@@ -44,16 +50,22 @@ func (wb *WriteBatch) Put(key []byte, value []byte) error {
 
 	// 暂存LogRecord
 	logRecord := &data.LogRecord{
-		Key:   key,
-		Value: value,
+		Key:          key,
+		Value:        value,
+		ColumnFamily: cf.id,
 	}
-	wb.pendingWrites[string(key)] = logRecord
+	wb.pendingWrites[pendingWriteKey(cf.id, key)] = logRecord
 	return nil
 
 }
 
 // Delete 删除数据
 func (wb *WriteBatch) Delete(key []byte) error {
+	return wb.DeleteCF(wb.db.defaultFamily, key)
+}
+
+// DeleteCF 删除指定列族中的数据
+func (wb *WriteBatch) DeleteCF(cf *ColumnFamily, key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
@@ -61,19 +73,23 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
-	logRecordPos := wb.db.index.Get(key)
+	pendingKey := pendingWriteKey(cf.id, key)
+	wb.db.mutex.RLock()
+	logRecordPos := cf.index.Get(key)
+	wb.db.mutex.RUnlock()
 	if logRecordPos == nil {
-		if wb.pendingWrites[string(key)] != nil {
-			delete(wb.pendingWrites, string(key))
+		if wb.pendingWrites[pendingKey] != nil {
+			delete(wb.pendingWrites, pendingKey)
 		}
 		return nil
 	}
 
 	logRecord := &data.LogRecord{
-		Key:  key,
-		Type: data.LogRecordDeleted,
+		Key:          key,
+		Type:         data.LogRecordDeleted,
+		ColumnFamily: cf.id,
 	}
-	wb.pendingWrites[string(key)] = logRecord
+	wb.pendingWrites[pendingKey] = logRecord
 
 	return nil
 
@@ -92,25 +108,80 @@ func (wb *WriteBatch) Commit() error {
 		return ErrExceedMaxBatchNum
 	}
 
-	// 加锁保证事务
-	wb.db.mutex.Lock()
-	defer wb.db.mutex.Unlock()
+	blobs, err := wb.db.separatePendingWrites(wb.pendingWrites)
+	if err != nil {
+		return err
+	}
+	// 加锁保证事务，持久化在释放锁之后和其他写入合并进行
+	err = wb.db.write(wb.configs.SyncWrites || wb.db.config.SyncWrites, func() error {
+		return wb.db.commitPendingWrites(wb.pendingWrites, blobs)
+	})
+	if err != nil {
+		return err
+	}
+
+	// 清空暂存数据
+	wb.pendingWrites = make(map[string]*data.LogRecord)
+
+	return nil
+
+}
+
+// separatePendingWrites 将暂存数据中需要分离存储的 value 写到 blob 文件中，返回每个 key 对应的指针
+// 在获取互斥锁之前调用，事务提交失败时写入的 value 成为无效数据，由 BlobGC 回收
+func (db *DB) separatePendingWrites(pendingWrites map[string]*data.LogRecord) (map[string]*data.BlobPointer, error) {
+	var blobs map[string]*data.BlobPointer
+	for key, record := range pendingWrites {
+		if record.Type != data.LogRecordNormal || !db.shouldSeparate(record.Value) {
+			continue
+		}
+		if db.config.ReadOnly {
+			return nil, ErrReadOnly
+		}
+		pointer, err := db.writeBlob(record.Key, record.ColumnFamily, bytes.NewReader(record.Value), int64(len(record.Value)))
+		if err != nil {
+			return nil, err
+		}
+		if blobs == nil {
+			blobs = make(map[string]*data.BlobPointer)
+		}
+		blobs[key] = pointer
+	}
+	return blobs, nil
+}
+
+// commitPendingWrites 以事务的方式将暂存的数据写到数据文件，并更新内存索引
+// blobs 是 separatePendingWrites 提前写到 blob 文件中的 value，调用前必须持有互斥锁
+func (db *DB) commitPendingWrites(pendingWrites map[string]*data.LogRecord, blobs map[string]*data.BlobPointer) error {
+	if db.config.ReadOnly {
+		return ErrReadOnly
+	}
 
 	// 获取当前最新的事务序列号
-	seqNo := atomic.AddUint64(&wb.db.transactionID, 1)
+	seqNo := atomic.AddUint64(&db.transactionID, 1)
 
 	// 开始写数据到数据文件当中
 	positions := make(map[string]*data.Position)
-	for _, record := range wb.pendingWrites {
-		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
-			Key:   logRecordKeyWithSeq(record.Key, seqNo),
-			Value: record.Value,
-			Type:  record.Type,
-		})
+	records := make([]*data.LogRecord, 0, len(pendingWrites))
+	for key, record := range pendingWrites {
+		db.seq++
+		record.Seq = db.seq
+		logRecord := &data.LogRecord{
+			Key:          logRecordKeyWithSeq(record.Key, seqNo),
+			Value:        record.Value,
+			Type:         record.Type,
+			ColumnFamily: record.ColumnFamily,
+			Seq:          record.Seq,
+		}
+		if pointer := blobs[key]; pointer != nil {
+			logRecord.Value, logRecord.Blob = data.EncodeBlobPointer(pointer), true
+		}
+		logRecordPos, err := db.appendLogRecord(logRecord)
 		if err != nil {
 			return err
 		}
-		positions[string(record.Key)] = logRecordPos
+		positions[key] = logRecordPos
+		records = append(records, record)
 	}
 
 	// 写一条标识事务完成的数据
@@ -119,37 +190,39 @@ func (wb *WriteBatch) Commit() error {
 		Key:  logRecordKeyWithSeq(txnFinKey, seqNo),
 		Type: data.LogRecordTxnFinished,
 	}
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
+	if _, err := db.appendLogRecord(finishedRecord); err != nil {
 		return err
 	}
 
-	// 根据配置决定是否持久化
-	if wb.configs.SyncWrites && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
-			return err
-		}
-	}
-
 	// 更新内存索引
-	for _, record := range wb.pendingWrites {
-		pos := positions[string(record.Key)]
+	for key, record := range pendingWrites {
+		pos := positions[key]
+		idx := db.indexFor(record.ColumnFamily)
 		var oldPos *data.Position
 		if record.Type == data.LogRecordNormal {
-			oldPos = wb.db.index.Put(record.Key, pos)
+			oldPos = db.indexPut(idx, record.Key, pos)
 		}
 		if record.Type == data.LogRecordDeleted {
-			oldPos, _ = wb.db.index.Delete(record.Key)
+			oldPos, _ = db.indexDelete(idx, record.Key)
+			db.addReclaimSize(pos.Fid, int64(pos.Size))
 		}
 		if oldPos != nil {
-			wb.db.reclaimSize += int64(oldPos.Size)
+			db.addReclaimSize(oldPos.Fid, int64(oldPos.Size))
 		}
+		db.trackBlob(pos, oldPos)
 	}
 
-	// 清空暂存数据
-	wb.pendingWrites = make(map[string]*data.LogRecord)
-
+	// 整个批次的修改作为一组事件发送
+	db.publish(records)
 	return nil
+}
 
+// pendingWriteKey 暂存数据使用的 key，不同列族中相同的 key 不会互相覆盖
+func pendingWriteKey(family uint32, key []byte) string {
+	buf := make([]byte, binary.MaxVarintLen32+len(key))
+	n := binary.PutUvarint(buf, uint64(family))
+	copy(buf[n:], key)
+	return string(buf[:n+len(key)])
 }
 
 func logRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
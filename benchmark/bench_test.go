@@ -7,6 +7,9 @@ import (
 	"github.com/youzeliang/rdb"
 	"github.com/youzeliang/rdb/utils"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -58,3 +61,81 @@ func Benchmark_Delete(b *testing.B) {
 		assert.Nil(b, err)
 	}
 }
+
+func Benchmark_PutSyncParallel(b *testing.B) {
+	configs := rdb.DefaultOptions
+	configs.DirPath = "/tmp/bitcask-go-bench-sync"
+	configs.SyncWrites = true
+	syncDB, err := rdb.Open(configs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = syncDB.Close()
+		_ = os.RemoveAll(configs.DirPath)
+	}()
+
+	// utils.RandomValue 不是并发安全的，所有的写入使用同一个 value
+	value := utils.RandomValue(1024)
+	var counter int64
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&counter, 1)
+			if err := syncDB.Put(utils.GetTestKey(int(i)), value); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+// Benchmark_Open 对比不同的 IndexLoadWorkers 下打开数据库重建索引的耗时
+func Benchmark_Open(b *testing.B) {
+	configs := rdb.DefaultOptions
+	configs.DirPath = "/tmp/bitcask-go-bench-open"
+	configs.FileSize = 4 * 1024 * 1024
+	_ = os.RemoveAll(configs.DirPath)
+	defer func() {
+		_ = os.RemoveAll(configs.DirPath)
+	}()
+
+	openDB, err := rdb.Open(configs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	value := utils.RandomValue(256)
+	for i := 0; i < 200000; i++ {
+		if err := openDB.Put(utils.GetTestKey(i), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := openDB.Close(); err != nil {
+		b.Fatal(err)
+	}
+	// 删除 hint 文件，打开时需要解析所有的数据文件
+	hintFiles, err := filepath.Glob(filepath.Join(configs.DirPath, "*.hint"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, hintFile := range hintFiles {
+		_ = os.Remove(hintFile)
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			configs.IndexLoadWorkers = workers
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				db, err := rdb.Open(configs)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				_ = db.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
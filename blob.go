@@ -0,0 +1,544 @@
+package rdb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/youzeliang/rdb/data"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PutReader 从 r 中流式读取 size 个字节作为 key 的 value 写入数据库
+// value 按块写入单独的 blob 文件，数据文件中只记录指向它的指针，所以 value 可以超过 FileSize
+func (db *DB) PutReader(key []byte, r io.Reader, size int64) error {
+	return db.putReader(db.defaultFamily, key, r, size)
+}
+
+// GetReader 返回流式读取 key 对应 value 的 reader，读到末尾时校验 crc
+// 使用完成后需要调用 Close
+func (db *DB) GetReader(key []byte) (io.ReadCloser, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	logRecordPos := db.index.Get(key)
+	if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	logRecord, err := db.readLogRecordByPosition(logRecordPos)
+	if err != nil {
+		return nil, err
+	}
+	if logRecord.Type == data.LogRecordDeleted {
+		return nil, ErrKeyNotFound
+	}
+	if !logRecord.Blob {
+		return io.NopCloser(bytes.NewReader(logRecord.Value)), nil
+	}
+
+	return db.openBlobReader(data.DecodeBlobPointer(logRecord.Value))
+}
+
+// openBlobReader 打开读取 blob 的 Reader，调用前必须持有互斥锁
+func (db *DB) openBlobReader(pointer *data.BlobPointer) (io.ReadCloser, error) {
+	blobFile, err := db.getBlobFile(pointer.Fid)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := blobFile.NewBlobReader(pointer)
+	if err != nil {
+		return nil, err
+	}
+	// 引用 blob 文件，防止读取期间被 BlobGC 删除
+	db.pinBlobFiles([]*data.BlobFile{blobFile})
+	return &blobReadCloser{BlobReader: reader, db: db, file: blobFile}, nil
+}
+
+// blobReadCloser 关闭时解除对 blob 文件的引用
+type blobReadCloser struct {
+	*data.BlobReader
+	db   *DB
+	file *data.BlobFile
+	once sync.Once
+}
+
+func (r *blobReadCloser) Close() error {
+	r.once.Do(func() {
+		r.db.unpinBlobFiles([]*data.BlobFile{r.file})
+	})
+	return nil
+}
+
+func (db *DB) putReader(cf *ColumnFamily, key []byte, r io.Reader, size int64) error {
+	if db.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if size < 0 {
+		return ErrInvalidValueSize
+	}
+
+	// 先写 blob 文件，写入期间不持有互斥锁，不会阻塞其他的读写
+	pointer, err := db.writeBlob(key, cf.id, r, size)
+	if err != nil {
+		return err
+	}
+	return db.write(db.config.SyncWrites, func() error {
+		return db.putRecordLocked(cf, key, &data.LogRecord{Value: data.EncodeBlobPointer(pointer), Blob: true})
+	})
+}
+
+// writeBlob 将 value 写入当前活跃的 blob 文件，写满之后切换新的文件
+func (db *DB) writeBlob(key []byte, family uint32, r io.Reader, size int64) (*data.BlobPointer, error) {
+	db.blobWriteLock.Lock()
+	defer db.blobWriteLock.Unlock()
+
+	// 空文件中可以写入任意大小的 value，所以超过 FileSize 的 value 会独占一个 blob 文件
+	entrySize := int64(len(key)) + size
+	if db.activeBlobFile == nil ||
+		(db.activeBlobFile.WriteOff > 0 && db.activeBlobFile.WriteOff+entrySize > db.config.FileSize) {
+		if err := db.setActiveBlobFile(); err != nil {
+			return nil, fmt.Errorf("failed to set active blob file: %v", err)
+		}
+	}
+
+	// 开启 SyncWrites 时由写入者和数据文件一起持久化
+	return db.activeBlobFile.WriteBlob(key, family, r, size)
+}
+
+// shouldSeparate 判断 value 是否需要写入单独的 blob 文件
+func (db *DB) shouldSeparate(value []byte) bool {
+	return db.config.BlobThreshold > 0 && int64(len(value)) > db.config.BlobThreshold
+}
+
+// separateValue 构造写入数据文件的记录，需要分离存储的 value 先写到 blob 文件中，记录中保存指针
+// PutReader 读取数据期间一直持有 blobWriteLock，所以调用时不能持有互斥锁
+func (db *DB) separateValue(cf *ColumnFamily, key []byte, value []byte) (*data.LogRecord, error) {
+	if db.config.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if !db.shouldSeparate(value) {
+		return &data.LogRecord{Value: value}, nil
+	}
+	pointer, err := db.writeBlob(key, cf.id, bytes.NewReader(value), int64(len(value)))
+	if err != nil {
+		return nil, err
+	}
+	return &data.LogRecord{Value: data.EncodeBlobPointer(pointer), Blob: true}, nil
+}
+
+// setActiveBlobFile 打开新的活跃 blob 文件，调用前必须持有 blobWriteLock
+func (db *DB) setActiveBlobFile() error {
+	var fileId uint32 = 0
+	if db.activeBlobFile != nil {
+		if err := db.activeBlobFile.Sync(); err != nil {
+			return err
+		}
+		fileId = db.activeBlobFile.FileId + 1
+	}
+
+	blobFile, err := db.encryptBlobFile(data.OpenBlobFile(db.config.DirPath, fileId))
+	if err != nil {
+		return err
+	}
+	db.blobLock.Lock()
+	db.blobFiles[fileId] = blobFile
+	db.activeBlobFile = blobFile
+	db.blobLock.Unlock()
+	return nil
+}
+
+// syncActiveBlobFile 持久化当前活跃的 blob 文件，切换文件时旧的文件已经持久化过
+func (db *DB) syncActiveBlobFile() error {
+	db.blobLock.RLock()
+	blobFile := db.activeBlobFile
+	db.blobLock.RUnlock()
+	if blobFile == nil {
+		return nil
+	}
+	return blobFile.Sync()
+}
+
+// getBlobFile 获取指定 id 的 blob 文件，从库中可能是主库新创建的文件，此时打开它
+func (db *DB) getBlobFile(fileId uint32) (*data.BlobFile, error) {
+	db.blobLock.RLock()
+	blobFile, ok := db.blobFiles[fileId]
+	db.blobLock.RUnlock()
+	if ok {
+		return blobFile, nil
+	}
+
+	db.blobLock.Lock()
+	defer db.blobLock.Unlock()
+	if blobFile, ok := db.blobFiles[fileId]; ok {
+		return blobFile, nil
+	}
+	// 已经被回收但仍然被引用的文件
+	if blobFile, ok := db.retiredBlobs[fileId]; ok {
+		return blobFile, nil
+	}
+	if _, err := os.Stat(data.GetBlobFileName(db.config.DirPath, fileId)); err != nil {
+		return nil, ErrDataFileNotFound
+	}
+	blobFile, err := db.encryptBlobFile(data.OpenBlobFile(db.config.DirPath, fileId))
+	if err != nil {
+		return nil, err
+	}
+	db.blobFiles[fileId] = blobFile
+	return blobFile, nil
+}
+
+// readBlob 读取 blob 指针指向的完整 value
+func (db *DB) readBlob(encPointer []byte) ([]byte, error) {
+	pointer := data.DecodeBlobPointer(encPointer)
+	blobFile, err := db.getBlobFile(pointer.Fid)
+	if err != nil {
+		return nil, err
+	}
+	return blobFile.ReadBlob(pointer)
+}
+
+// loadBlobFiles 打开目录中所有的 blob 文件，最大的文件作为活跃文件
+func (db *DB) loadBlobFiles() error {
+	files, err := os.ReadDir(db.config.DirPath)
+	if err != nil {
+		return err
+	}
+
+	var fileIds []int
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), data.BlobFileNameSuffix) {
+			fileId, err := strconv.Atoi(strings.TrimSuffix(file.Name(), data.BlobFileNameSuffix))
+			if err != nil {
+				return ErrDataDirectoryCorrupted
+			}
+			fileIds = append(fileIds, fileId)
+		}
+	}
+	sort.Ints(fileIds)
+
+	for _, fid := range fileIds {
+		blobFile, err := db.encryptBlobFile(data.OpenBlobFile(db.config.DirPath, uint32(fid)))
+		if err != nil {
+			return fmt.Errorf("failed to open blob file %d: %v", fid, err)
+		}
+		db.blobFiles[uint32(fid)] = blobFile
+		db.activeBlobFile = blobFile
+	}
+	return nil
+}
+
+// closeBlobFiles 关闭所有的 blob 文件
+func (db *DB) closeBlobFiles() error {
+	db.blobWriteLock.Lock()
+	defer db.blobWriteLock.Unlock()
+	db.blobLock.Lock()
+	defer db.blobLock.Unlock()
+
+	for fid, blobFile := range db.blobFiles {
+		if blobFile == db.activeBlobFile && !db.config.ReadOnly {
+			if err := blobFile.Sync(); err != nil {
+				return err
+			}
+		}
+		if err := blobFile.Close(); err != nil {
+			return err
+		}
+		delete(db.blobFiles, fid)
+	}
+	for fid, blobFile := range db.retiredBlobs {
+		_ = blobFile.Close()
+		delete(db.retiredBlobs, fid)
+	}
+	db.activeBlobFile = nil
+	return nil
+}
+
+// BlobGC 回收 blob 文件中的无效数据
+// 无效数据的占比达到 BlobGCRatio 或者使用轮换之前的密钥加密的文件中仍然有效的 value 会被重写到活跃的 blob 文件，然后删除原来的文件
+// 只有索引引用的 value 会被保留，开启 ChangeRetention 时保留的历史修改可能读不到被回收的 value
+func (db *DB) BlobGC() error {
+	if db.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	db.mutex.Lock()
+	if db.isBlobGC {
+		db.mutex.Unlock()
+		return ErrBlobGCInProgress
+	}
+	db.isBlobGC = true
+	defer func() {
+		db.mutex.Lock()
+		db.isBlobGC = false
+		db.mutex.Unlock()
+	}()
+	db.mutex.Unlock()
+
+	// 轮换密钥之后，使用旧密钥的活跃 blob 文件不再写入，和其他旧文件一起重写
+	if err := db.sealStaleActiveBlobFile(); err != nil {
+		return err
+	}
+
+	// 取出需要回收的文件，活跃的 blob 文件还在写入，不参与回收
+	var gcFiles []*data.BlobFile
+	db.mutex.Lock()
+	db.blobLock.RLock()
+	for fid, blobFile := range db.blobFiles {
+		if blobFile == db.activeBlobFile || blobFile.WriteOff == 0 {
+			continue
+		}
+		stale, err := db.staleBlobKey(blobFile)
+		if err != nil {
+			db.blobLock.RUnlock()
+			db.mutex.Unlock()
+			return err
+		}
+		garbage := blobFile.WriteOff - db.blobLive[fid]
+		if stale || float32(garbage)/float32(blobFile.WriteOff) >= db.config.BlobGCRatio {
+			gcFiles = append(gcFiles, blobFile)
+		}
+	}
+	db.blobLock.RUnlock()
+	db.mutex.Unlock()
+
+	sort.Slice(gcFiles, func(i, j int) bool {
+		return gcFiles[i].FileId < gcFiles[j].FileId
+	})
+	for _, blobFile := range gcFiles {
+		if err := db.rewriteBlobFile(blobFile); err != nil {
+			return err
+		}
+		// 新的 value 和指向它的记录持久化之后才能删除原来的文件
+		if err := db.Sync(); err != nil {
+			return err
+		}
+		db.retireBlobFile(blobFile)
+	}
+	return nil
+}
+
+// staleBlobKey 判断 blob 文件是否使用轮换之前的密钥加密
+func (db *DB) staleBlobKey(blobFile *data.BlobFile) (bool, error) {
+	if db.keyProvider == nil {
+		return false, nil
+	}
+	keyID, ok, err := blobFile.KeyID()
+	if err != nil || !ok {
+		return false, err
+	}
+	current, _, err := db.keyProvider.CurrentKey()
+	if err != nil {
+		return false, err
+	}
+	return keyID != current, nil
+}
+
+// sealStaleActiveBlobFile 活跃的 blob 文件使用旧的密钥时切换新的活跃文件
+func (db *DB) sealStaleActiveBlobFile() error {
+	db.blobWriteLock.Lock()
+	defer db.blobWriteLock.Unlock()
+	if db.activeBlobFile == nil {
+		return nil
+	}
+	stale, err := db.staleBlobKey(db.activeBlobFile)
+	if err != nil || !stale {
+		return err
+	}
+	if err := db.setActiveBlobFile(); err != nil {
+		return fmt.Errorf("failed to set active blob file: %v", err)
+	}
+	return nil
+}
+
+// rewriteBlobFile 将 blob 文件中仍然被索引引用的 value 重写到活跃的 blob 文件，并写入指向新位置的记录
+func (db *DB) rewriteBlobFile(blobFile *data.BlobFile) error {
+	var offset int64 = 0
+	for offset < blobFile.WriteOff {
+		header, err := blobFile.ReadBlobHeader(offset)
+		if err != nil {
+			// 崩溃时写了一半的 value 没有被引用
+			if isTornTail(err) {
+				return nil
+			}
+			return err
+		}
+		pointer := &data.BlobPointer{Fid: blobFile.FileId, Offset: offset, Size: header.ValueSize}
+		offset += blobFile.EntrySize(header)
+
+		db.mutex.RLock()
+		live := db.blobPosition(header.Family, header.Key, pointer) != nil
+		db.mutex.RUnlock()
+		if !live {
+			continue
+		}
+
+		reader, err := blobFile.NewBlobReader(pointer)
+		if err != nil {
+			return err
+		}
+		newPointer, err := db.writeBlob(header.Key, header.Family, reader, pointer.Size)
+		if err != nil {
+			return err
+		}
+		// 读到末尾才会校验 crc，损坏的 value 不能被重写成校验正确的数据
+		if _, err := reader.Read(nil); err != io.EOF {
+			return err
+		}
+
+		err = db.write(false, func() error {
+			oldPos := db.blobPosition(header.Family, header.Key, pointer)
+			// 重写期间 key 已经被修改
+			if oldPos == nil {
+				return nil
+			}
+			// 和 merge 一样沿用原记录的序列号，重写不是用户的修改，事务也不会因此冲突
+			oldRecord, err := db.readLogRecordByPosition(oldPos)
+			if err != nil {
+				return err
+			}
+			pos, err := db.appendLogRecord(&data.LogRecord{
+				Key:          logRecordKeyWithSeq(header.Key, nonTransactionSeqNo),
+				Value:        data.EncodeBlobPointer(newPointer),
+				Type:         data.LogRecordNormal,
+				Expire:       oldPos.Expire,
+				ColumnFamily: header.Family,
+				Seq:          oldRecord.Seq,
+				Blob:         true,
+			})
+			if err != nil {
+				return err
+			}
+			db.indexPut(db.indexFor(header.Family), header.Key, pos)
+			db.addReclaimSize(oldPos.Fid, int64(oldPos.Size))
+			db.trackBlob(pos, oldPos)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobPosition 如果索引中 key 的 value 就是 pointer 指向的 value，则返回它的位置，调用前必须持有互斥锁
+func (db *DB) blobPosition(family uint32, key []byte, pointer *data.BlobPointer) *data.Position {
+	idx := db.indexFor(family)
+	if idx == nil {
+		return nil
+	}
+	pos := db.lookupIndex(idx, key)
+	if pos == nil || pos.Blob == nil || pos.Blob.Fid != pointer.Fid || pos.Blob.Offset != pointer.Offset {
+		return nil
+	}
+	return pos
+}
+
+// trackBlob 根据索引的变化更新 blob 文件中有效的数据量，调用前必须持有互斥锁
+func (db *DB) trackBlob(pos, oldPos *data.Position) {
+	if pos != nil && pos.Blob != nil {
+		db.blobLive[pos.Blob.Fid] += pos.Blob.Size
+	}
+	if oldPos != nil && oldPos.Blob != nil {
+		db.blobLive[oldPos.Blob.Fid] -= oldPos.Blob.Size
+	}
+}
+
+// loadBlobLive 遍历所有列族的索引，统计 blob 文件中有效的数据量
+func (db *DB) loadBlobLive() {
+	for _, cf := range db.familyByID {
+		iterator := cf.index.Iterator(false)
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			db.trackBlob(iterator.Value(), nil)
+			if iterator.Value().Expire > 0 {
+				db.hasExpiringKeys = true
+			}
+		}
+		iterator.Close()
+	}
+}
+
+// blobStat 返回 blob 文件的数量及其中无效的数据量，调用前必须持有互斥锁
+func (db *DB) blobStat() (uint, int64) {
+	db.blobLock.RLock()
+	defer db.blobLock.RUnlock()
+	var reclaimable int64
+	for fid, blobFile := range db.blobFiles {
+		reclaimable += db.blobFileSize(blobFile) - db.blobLive[fid]
+	}
+	return uint(len(db.blobFiles)), reclaimable
+}
+
+// blobFilesSize 返回所有 blob 文件的大小
+func (db *DB) blobFilesSize() int64 {
+	db.blobLock.RLock()
+	defer db.blobLock.RUnlock()
+	var size int64
+	for _, blobFile := range db.blobFiles {
+		size += db.blobFileSize(blobFile)
+	}
+	return size
+}
+
+// blobFileSize 返回 blob 文件的大小，活跃文件可能正在写入，从文件系统中获取，调用前必须持有 blobLock
+func (db *DB) blobFileSize(blobFile *data.BlobFile) int64 {
+	if blobFile != db.activeBlobFile {
+		return blobFile.WriteOff
+	}
+	size, _ := blobFile.Size()
+	return size
+}
+
+// pinBlobFiles 引用 blob 文件，防止被 BlobGC 删除
+func (db *DB) pinBlobFiles(files []*data.BlobFile) {
+	db.blobLock.Lock()
+	defer db.blobLock.Unlock()
+	for _, blobFile := range files {
+		db.pinnedBlobs[blobFile]++
+	}
+}
+
+// unpinBlobFiles 解除对 blob 文件的引用，已经被回收的文件在引用全部释放后删除
+func (db *DB) unpinBlobFiles(files []*data.BlobFile) {
+	db.blobLock.Lock()
+	defer db.blobLock.Unlock()
+	for _, blobFile := range files {
+		db.pinnedBlobs[blobFile]--
+		if db.pinnedBlobs[blobFile] > 0 {
+			continue
+		}
+		delete(db.pinnedBlobs, blobFile)
+		if db.retiredBlobs[blobFile.FileId] == blobFile {
+			delete(db.retiredBlobs, blobFile.FileId)
+			db.removeBlobFile(blobFile)
+		}
+	}
+}
+
+// retireBlobFile 删除已经回收的 blob 文件，如果仍被引用，则延迟到引用释放时删除
+func (db *DB) retireBlobFile(blobFile *data.BlobFile) {
+	db.blobLock.Lock()
+	defer db.blobLock.Unlock()
+	delete(db.blobFiles, blobFile.FileId)
+	if db.pinnedBlobs[blobFile] > 0 {
+		db.retiredBlobs[blobFile.FileId] = blobFile
+		return
+	}
+	db.removeBlobFile(blobFile)
+}
+
+// removeBlobFile 关闭并删除 blob 文件，调用前必须持有 blobLock
+func (db *DB) removeBlobFile(blobFile *data.BlobFile) {
+	_ = blobFile.Close()
+	_ = os.Remove(data.GetBlobFileName(db.config.DirPath, blobFile.FileId))
+}
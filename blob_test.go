@@ -0,0 +1,287 @@
+package rdb
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/utils"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDB_PutReader(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-put-reader")
+	opts.DirPath = dir
+	opts.FileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// value 超过了单个数据文件的大小
+	large := bytes.Repeat([]byte("rdb-large-value"), 20000)
+	assert.Nil(t, db.PutReader(utils.GetTestKey(1), bytes.NewReader(large), int64(len(large))))
+	assert.Nil(t, db.PutReader(utils.GetTestKey(2), bytes.NewReader([]byte("small")), 5))
+	assert.Nil(t, db.Put(utils.GetTestKey(3), []byte("normal")))
+
+	reader, err := db.GetReader(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	value, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, large, value)
+
+	// Get 同样可以读取 blob 文件中的 value
+	value, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("small"), value)
+
+	// 普通的 value 也可以通过 reader 读取
+	reader, err = db.GetReader(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	value, err = io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("normal"), value)
+
+	_, err = db.GetReader(utils.GetTestKey(4))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, ErrInvalidValueSize, db.PutReader(utils.GetTestKey(4), bytes.NewReader(nil), -1))
+	// reader 中的数据不足时不会写入
+	assert.Equal(t, data.ErrBlobSizeMismatch, db.PutReader(utils.GetTestKey(4), bytes.NewReader([]byte("abc")), 10))
+	_, err = db.Get(utils.GetTestKey(4))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// merge 和重启之后仍然可以读取
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	value, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, large, value)
+
+	// 大 value 独占一个 blob 文件，小的 value 写在同一个文件中
+	assert.Nil(t, db.PutReader(utils.GetTestKey(5), bytes.NewReader(large), int64(len(large))))
+	value, err = db.Get(utils.GetTestKey(5))
+	assert.Nil(t, err)
+	assert.Equal(t, large, value)
+	assert.Equal(t, 3, len(db.blobFiles))
+}
+
+func TestDB_GetReader_Corrupted(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-get-reader")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("v"), 300000)
+	assert.Nil(t, db.PutReader(utils.GetTestKey(1), bytes.NewReader(value), int64(len(value))))
+
+	file, err := os.OpenFile(data.GetBlobFileName(dir, 0), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("x"), 200000)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	reader, err := db.GetReader(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = io.ReadAll(reader)
+	assert.Equal(t, data.ErrInvalidCRC, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, data.ErrInvalidCRC, err)
+}
+
+func TestDB_BlobThreshold(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-blob-threshold")
+	opts.DirPath = dir
+	opts.BlobThreshold = 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	large := bytes.Repeat([]byte("v"), 4096)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), large))
+	}
+	assert.Nil(t, db.Put(utils.GetTestKey(10), []byte("small")))
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put(utils.GetTestKey(11), large))
+	assert.Nil(t, wb.Commit())
+
+	// 数据文件中只保存了指针
+	assert.True(t, db.activeFile.WriteOff < 1024)
+	stat := db.Stat()
+	assert.Equal(t, uint(1), stat.BlobFileNum)
+	assert.Equal(t, int64(11*4096), int64(db.blobLive[0]))
+
+	value, err := db.Get(utils.GetTestKey(11))
+	assert.Nil(t, err)
+	assert.Equal(t, large, value)
+	value, err = db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("small"), value)
+
+	// 覆盖和删除之后，旧的 value 变为无效数据
+	assert.Nil(t, db.Put(utils.GetTestKey(0), []byte("small")))
+	assert.Nil(t, db.Delete(utils.GetTestKey(1)))
+	assert.Equal(t, int64(9*4096), db.blobLive[0])
+	assert.True(t, db.Stat().BlobReclaimableSize >= 2*4096)
+
+	// merge 和重启之后 blob 的统计信息保持一致
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9*4096), db.blobLive[0])
+	value, err = db.Get(utils.GetTestKey(5))
+	assert.Nil(t, err)
+	assert.Equal(t, large, value)
+}
+
+// blockingReader 第一次读取时通知调用者，之后一直阻塞到 release 被关闭
+type blockingReader struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	r.once.Do(func() { close(r.started) })
+	<-r.release
+	return 0, io.EOF
+}
+
+func TestDB_BlobThreshold_SlowPutReader(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-blob-slow-reader")
+	opts.DirPath = dir
+	opts.BlobThreshold = 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("small")))
+
+	// PutReader 读取数据期间持有 blobWriteLock
+	reader := &blockingReader{started: make(chan struct{}), release: make(chan struct{})}
+	readerDone := make(chan error, 1)
+	go func() {
+		readerDone <- db.PutReader(utils.GetTestKey(2), reader, 4096)
+	}()
+	<-reader.started
+
+	// 大的 value 等待 blobWriteLock 时不持有互斥锁
+	large := bytes.Repeat([]byte("v"), 4096)
+	putDone := make(chan error, 1)
+	go func() {
+		putDone <- db.Put(utils.GetTestKey(3), large)
+	}()
+	batchDone := make(chan error, 1)
+	go func() {
+		wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+		_ = wb.Put(utils.GetTestKey(4), large)
+		batchDone <- wb.Commit()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.Nil(t, db.Put(utils.GetTestKey(5), []byte("small")))
+		value, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("small"), value)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("small writes are blocked by a slow PutReader")
+	}
+
+	close(reader.release)
+	assert.Equal(t, data.ErrBlobSizeMismatch, <-readerDone)
+	assert.Nil(t, <-putDone)
+	assert.Nil(t, <-batchDone)
+	value, err := db.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, large, value)
+	value, err = db.Get(utils.GetTestKey(4))
+	assert.Nil(t, err)
+	assert.Equal(t, large, value)
+}
+
+func TestDB_BlobGC(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-blob-gc")
+	opts.DirPath = dir
+	opts.FileSize = 64 * 1024
+	opts.BlobThreshold = 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	old := bytes.Repeat([]byte("o"), 8192)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), old))
+	}
+	// 覆盖大部分的 key，第一个 blob 文件中只剩下少量有效的 value
+	latest := bytes.Repeat([]byte("n"), 8192)
+	for i := 0; i < 16; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), latest))
+	}
+	blobFiles := db.Stat().BlobFileNum
+	assert.True(t, blobFiles > 2)
+
+	snapshot := db.NewSnapshot()
+	reader, err := db.GetReader(utils.GetTestKey(18))
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.BlobGC())
+	assert.True(t, db.Stat().BlobFileNum < blobFiles)
+	for i := 0; i < 20; i++ {
+		value, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		if i < 16 {
+			assert.Equal(t, latest, value)
+		} else {
+			assert.Equal(t, old, value)
+		}
+	}
+
+	// 快照和 reader 引用的文件在释放之前不会被删除
+	_, err = os.Stat(data.GetBlobFileName(dir, 0))
+	assert.Nil(t, err)
+	value, err := snapshot.Get(utils.GetTestKey(16))
+	assert.Nil(t, err)
+	assert.Equal(t, old, value)
+	value, err = io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, old, value)
+	assert.Nil(t, reader.Close())
+	snapshot.Release()
+	_, err = os.Stat(data.GetBlobFileName(dir, 0))
+	assert.True(t, os.IsNotExist(err))
+
+	// 回收之后的数据在重启之后仍然可以读取，且不会出现在修改记录中
+	seq := db.LatestSeq()
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, seq, db.LatestSeq())
+	value, err = db.Get(utils.GetTestKey(17))
+	assert.Nil(t, err)
+	assert.Equal(t, old, value)
+	assert.Equal(t, int64(20*8192), func() int64 {
+		var live int64
+		for _, size := range db.blobLive {
+			live += size
+		}
+		return live
+	}())
+}
@@ -0,0 +1,326 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"github.com/youzeliang/rdb/data"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// LatestSeq 返回最近一次修改的全局序列号
+func (db *DB) LatestSeq() uint64 {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.seq
+}
+
+// seqRange 一个数据文件中修改序列号的范围
+type seqRange struct {
+	min uint64
+	max uint64
+}
+
+// beginFileSeq 从头开始记录数据文件中修改序列号的范围，只有完整读取过或者新建的文件才有范围
+// 调用前必须持有互斥锁
+func (db *DB) beginFileSeq(fid uint32) {
+	db.fileSeqRanges[fid] = seqRange{min: math.MaxUint64}
+}
+
+// trackFileSeq 将一条记录的序列号计入数据文件的范围，调用前必须持有互斥锁
+func (db *DB) trackFileSeq(fid uint32, seq uint64) {
+	r, ok := db.fileSeqRanges[fid]
+	if !ok || seq == 0 {
+		return
+	}
+	if seq < r.min {
+		r.min = seq
+	}
+	if seq > r.max {
+		r.max = seq
+	}
+	db.fileSeqRanges[fid] = r
+}
+
+// ReadChangesSince 按提交顺序返回所有列族中序列号大于 seq 的修改，limit 为 0 时不限制返回的数量
+// 参与过 merge 的修改只有在开启 ChangeRetention 且序列号大于最小的游标时才会被保留下来
+func (db *DB) ReadChangesSince(seq uint64, limit int) ([]*Event, error) {
+	// 引用当前所有的数据文件，扫描期间不阻塞写入
+	db.mutex.Lock()
+	dataFiles := make([]*data.DataFile, 0, len(db.archivedFiles)+1)
+	for _, file := range db.archivedFiles {
+		dataFiles = append(dataFiles, file)
+	}
+	if db.activeFile != nil {
+		dataFiles = append(dataFiles, db.activeFile)
+	}
+	ranges := make(map[uint32]seqRange, len(dataFiles))
+	for _, file := range dataFiles {
+		db.pinnedFiles[file]++
+		if r, ok := db.fileSeqRanges[file.FileId]; ok {
+			ranges[file.FileId] = r
+		}
+	}
+	db.mutex.Unlock()
+
+	defer func() {
+		db.mutex.Lock()
+		defer db.mutex.Unlock()
+		for _, file := range dataFiles {
+			db.unpinDataFile(file)
+		}
+	}()
+
+	sort.Slice(dataFiles, func(i, j int) bool {
+		return dataFiles[i].FileId < dataFiles[j].FileId
+	})
+
+	var records []*data.LogRecord
+	transactionRecords := make(map[uint64][]*data.LogRecord)
+	for i, dataFile := range dataFiles {
+		// 没有等待完成标记的事务时，跳过所有修改都不晚于 seq 的文件，活跃文件在扫描期间可能还有写入
+		if r, ok := ranges[dataFile.FileId]; ok && r.max <= seq && len(transactionRecords) == 0 && i < len(dataFiles)-1 {
+			continue
+		}
+
+		var offset int64 = 0
+		for {
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				if next, ok := db.skipCorruptRange(dataFile.FileId, offset); ok {
+					offset = next
+					continue
+				}
+				if err == io.EOF {
+					break
+				}
+				// 活跃文件的末尾可能有正在写入的记录
+				if i == len(dataFiles)-1 && isTornTail(err) {
+					break
+				}
+				return nil, err
+			}
+			offset += size
+
+			realKey, seqNo := parseLogRecordKey(logRecord.Key)
+			logRecord.Key = realKey
+			if seqNo == nonTransactionSeqNo {
+				if logRecord.Seq > seq {
+					records = append(records, logRecord)
+				}
+				continue
+			}
+			// 事务中的修改读到完成标记之后才算提交
+			if logRecord.Type == data.LogRecordTxnFinished {
+				records = append(records, transactionRecords[seqNo]...)
+				delete(transactionRecords, seqNo)
+			} else if logRecord.Seq > seq {
+				transactionRecords[seqNo] = append(transactionRecords[seqNo], logRecord)
+			}
+		}
+
+		// 已经收集到的比剩下的文件中所有修改都早的记录足够 limit 条时，不再继续扫描
+		if limit > 0 && len(records) >= limit && len(transactionRecords) == 0 {
+			floor := seqFloor(dataFiles[i+1:], ranges, seq)
+			if floor == 0 {
+				continue
+			}
+			records = sortRecordsBySeq(records)
+			if sort.Search(len(records), func(j int) bool { return records[j].Seq >= floor }) >= limit {
+				break
+			}
+		}
+	}
+
+	// Compact 重写的记录在旧文件删除之前可能被读到两次
+	records = sortRecordsBySeq(records)
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	events := make([]*Event, len(records))
+	for i, record := range records {
+		events[i] = db.newEvent(record, 0)
+	}
+	return events, nil
+}
+
+// seqFloor 返回剩下的文件中大于 seq 的修改可能出现的最小序列号，有文件没有记录范围时返回 0
+func seqFloor(dataFiles []*data.DataFile, ranges map[uint32]seqRange, seq uint64) uint64 {
+	var floor uint64 = math.MaxUint64
+	for _, dataFile := range dataFiles {
+		r, ok := ranges[dataFile.FileId]
+		if !ok {
+			return 0
+		}
+		if r.max > seq && r.min < floor {
+			floor = r.min
+		}
+	}
+	return floor
+}
+
+// sortRecordsBySeq 按序列号排序并去掉重复的记录
+func sortRecordsBySeq(records []*data.LogRecord) []*data.LogRecord {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+	return dedupRecordsBySeq(records)
+}
+
+// dedupRecordsBySeq 去掉按序列号排序的记录中序列号重复的记录
+func dedupRecordsBySeq(records []*data.LogRecord) []*data.LogRecord {
+	deduped := records[:0]
+	for i, record := range records {
+		if i > 0 && record.Seq > 0 && record.Seq == records[i-1].Seq {
+			continue
+		}
+		deduped = append(deduped, record)
+	}
+	return deduped
+}
+
+// SetCursor 持久化消费者读取修改记录的位置，开启 ChangeRetention 时 merge 会保留位置之后的修改
+func (db *DB) SetCursor(name string, seq uint64) error {
+	if db.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if name == "" {
+		return ErrCursorNameEmpty
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	old, exists := db.cursors[name]
+	db.cursors[name] = seq
+	if err := db.saveCursors(); err != nil {
+		if exists {
+			db.cursors[name] = old
+		} else {
+			delete(db.cursors, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Cursor 获取消费者持久化的位置
+func (db *DB) Cursor(name string) (uint64, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	seq, ok := db.cursors[name]
+	if !ok {
+		return 0, ErrCursorNotFound
+	}
+	return seq, nil
+}
+
+// RemoveCursor 删除消费者的位置，不存在时不做处理
+func (db *DB) RemoveCursor(name string) error {
+	if db.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	seq, ok := db.cursors[name]
+	if !ok {
+		return nil
+	}
+	delete(db.cursors, name)
+	if err := db.saveCursors(); err != nil {
+		db.cursors[name] = seq
+		return err
+	}
+	return nil
+}
+
+// changeRetainSeq 返回 merge 时需要保留的修改历史的起点，序列号大于它的修改需要保留
+// 调用前必须持有互斥锁
+func (db *DB) changeRetainSeq() uint64 {
+	if !db.config.ChangeRetention || len(db.cursors) == 0 {
+		return math.MaxUint64
+	}
+	var retainSeq uint64 = math.MaxUint64
+	for _, seq := range db.cursors {
+		if seq < retainSeq {
+			retainSeq = seq
+		}
+	}
+	return retainSeq
+}
+
+// saveCursors 将所有的游标写到临时文件中，再替换原来的文件，调用前必须持有互斥锁
+func (db *DB) saveCursors() error {
+	var records [][]byte
+	for name, seq := range db.cursors {
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+			Key:   []byte(name),
+			Value: binary.AppendUvarint(nil, seq),
+		})
+		records = append(records, encRecord)
+	}
+	return db.replaceRecordFile(filepath.Join(db.config.DirPath, data.CursorFileName), records)
+}
+
+// replaceRecordFile 将记录写到临时文件中，再替换 fileName 对应的文件
+func (db *DB) replaceRecordFile(fileName string, records [][]byte) error {
+	tmpFileName := fileName + ".tmp"
+	if err := os.Remove(tmpFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	file, err := db.encryptDataFile(data.OpenTmpFile(tmpFileName))
+	if err != nil {
+		return err
+	}
+	// 加密时每次写入的数据作为一条记录，所以逐条写入
+	for _, encRecord := range records {
+		if err := file.Write(encRecord); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+// loadCursors 从文件中加载所有的游标
+func (db *DB) loadCursors() error {
+	fileName := filepath.Join(db.config.DirPath, data.CursorFileName)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+
+	cursorFile, err := db.encryptDataFile(data.OpenCursorFile(db.config.DirPath))
+	if err != nil {
+		return err
+	}
+	defer cursorFile.Close()
+
+	var offset int64 = 0
+	for {
+		logRecord, size, err := cursorFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		seq, _ := binary.Uvarint(logRecord.Value)
+		db.cursors[string(logRecord.Key)] = seq
+		offset += size
+	}
+	return nil
+}
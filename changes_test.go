@@ -0,0 +1,242 @@
+package rdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_ReadChangesSince(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-changes")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), db.LatestSeq())
+
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("a")))
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("b")))
+	assert.Nil(t, db.Delete(utils.GetTestKey(1)))
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put(utils.GetTestKey(3), []byte("c")))
+	assert.Nil(t, wb.Put(utils.GetTestKey(4), []byte("d")))
+	assert.Nil(t, wb.Commit())
+	cf, err := db.CreateColumnFamily("users", DefaultColumnFamilyConfigs)
+	assert.Nil(t, err)
+	assert.Nil(t, cf.Put(utils.GetTestKey(1), []byte("e")))
+	assert.Equal(t, uint64(6), db.LatestSeq())
+
+	events, err := db.ReadChangesSince(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(events))
+	for i, event := range events {
+		assert.Equal(t, uint64(i+1), event.Seq)
+	}
+	assert.Equal(t, EventPut, events[0].Op)
+	assert.Equal(t, utils.GetTestKey(1), events[0].Key)
+	assert.Equal(t, []byte("a"), events[0].Value)
+	assert.Equal(t, DefaultColumnFamily, events[0].ColumnFamily)
+	assert.Equal(t, EventDelete, events[2].Op)
+	assert.Equal(t, "users", events[5].ColumnFamily)
+
+	events, err = db.ReadChangesSince(2, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, uint64(3), events[0].Seq)
+	assert.Equal(t, uint64(4), events[1].Seq)
+
+	// 订阅收到的事件和修改记录使用相同的序列号
+	watcher := db.Watch(nil, DefaultWatchConfigs)
+	defer watcher.Close()
+	assert.Nil(t, db.Put(utils.GetTestKey(5), []byte("f")))
+	group := <-watcher.Events()
+	assert.Equal(t, uint64(7), group[0].Seq)
+
+	// 重启之后序列号继续递增
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), db.LatestSeq())
+	events, err = db.ReadChangesSince(5, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+	assert.Nil(t, db.Put(utils.GetTestKey(6), []byte("g")))
+	assert.Equal(t, uint64(8), db.LatestSeq())
+}
+
+func TestDB_ReadChangesSince_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-changes-merge")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("old")))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(9)))
+
+	// 没有开启保留时，merge 之后只剩下有效的数据，但序列号不会被重复使用
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(11), db.LatestSeq())
+	events, err := db.ReadChangesSince(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 9, len(events))
+	assert.Nil(t, db.Put(utils.GetTestKey(9), []byte("new")))
+	assert.Equal(t, uint64(12), db.LatestSeq())
+}
+
+func TestDB_ChangeRetention(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-changes-retention")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	opts.ChangeRetention = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("v1")))
+	}
+	assert.Nil(t, db.SetCursor("search", 5))
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("v2")))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Delete(utils.GetTestKey(0)))
+	assert.Nil(t, wb.Delete(utils.GetTestKey(1)))
+	assert.Nil(t, wb.Commit())
+
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+
+	seq, err := db.Cursor("search")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), seq)
+
+	// 游标之后的修改都被保留了下来，包括被覆盖的值和删除操作
+	events, err := db.ReadChangesSince(seq, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 17, len(events))
+	for i, event := range events {
+		assert.Equal(t, seq+uint64(i)+1, event.Seq)
+	}
+	assert.Equal(t, []byte("v1"), events[0].Value)
+	assert.Equal(t, EventDelete, events[16].Op)
+
+	// 游标之前的历史被清理
+	events, err = db.ReadChangesSince(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 17, len(events))
+	assert.Equal(t, 8, len(db.ListKeys()))
+
+	assert.Nil(t, db.RemoveCursor("search"))
+	_, err = db.Cursor("search")
+	assert.Equal(t, ErrCursorNotFound, err)
+	assert.Equal(t, ErrCursorNameEmpty, db.SetCursor("", 1))
+}
+
+func TestDB_ReadChangesSince_SkipFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-changes-skip")
+	opts.DirPath = dir
+	opts.FileSize = 4 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+		// 事务的数据和完成标记可能写在不同的文件中
+		if i%50 == 0 {
+			wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+			for j := 0; j < 20; j++ {
+				assert.Nil(t, wb.Put(utils.GetTestKey(1000+j), utils.RandomValue(64)))
+			}
+			assert.Nil(t, wb.Commit())
+		}
+	}
+	latest := db.LatestSeq()
+	assert.True(t, len(db.archivedFiles) > 10)
+
+	check := func(db *DB) {
+		// 每个文件都有序列号范围，可以跳过
+		for fid := range db.archivedFiles {
+			_, ok := db.fileSeqRanges[fid]
+			assert.True(t, ok)
+		}
+		for _, seq := range []uint64{0, 7, latest / 2, latest - 30, latest - 1} {
+			events, err := db.ReadChangesSince(seq, 0)
+			assert.Nil(t, err)
+			assert.Equal(t, int(latest-seq), len(events))
+			for i, event := range events {
+				assert.Equal(t, seq+uint64(i)+1, event.Seq)
+			}
+
+			events, err = db.ReadChangesSince(seq, 25)
+			assert.Nil(t, err)
+			if latest-seq < 25 {
+				assert.Equal(t, int(latest-seq), len(events))
+			} else {
+				assert.Equal(t, 25, len(events))
+			}
+			for i, event := range events {
+				assert.Equal(t, seq+uint64(i)+1, event.Seq)
+			}
+		}
+		events, err := db.ReadChangesSince(latest, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(events))
+	}
+	check(db)
+
+	// 重启之后从数据文件或者 hint 文件中重新得到序列号范围
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestDB_ReadChangesSince_BPlusTreeCrash(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-changes-bptree-crash")
+	opts.DirPath = dir
+	opts.FileSize = 4 * 1024
+	opts.IndexType = BPlusTree
+	opts.MMapAtStartup = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Sync())
+	assert.True(t, len(db.archivedFiles) > 1)
+
+	// 没有正常关闭时不存在 seq 文件
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.Remove(filepath.Join(dir, data.SeqNoFileName)))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), db.LatestSeq())
+
+	assert.Nil(t, db.Put(utils.GetTestKey(100), []byte("new")))
+	events, err := db.ReadChangesSince(100, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, uint64(101), events[0].Seq)
+	assert.Equal(t, utils.GetTestKey(100), events[0].Key)
+}
@@ -0,0 +1,309 @@
+package rdb
+
+import (
+	"github.com/youzeliang/rdb/data"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+// 每次持有互斥锁时最多重写多少条记录，避免长时间阻塞写入
+const compactBatchSize = 256
+
+// DataFileStat 单个数据文件的统计信息
+type DataFileStat struct {
+	Fid             uint32
+	Size            int64 // 文件中数据的大小，不包括文件头
+	ReclaimableSize int64 // 文件中无效的数据量
+	Active          bool  // 是否是当前的活跃文件
+}
+
+// GarbageRatio 文件中无效数据的占比
+func (s DataFileStat) GarbageRatio() float32 {
+	if s.Size == 0 {
+		return 0
+	}
+	return float32(s.ReclaimableSize) / float32(s.Size)
+}
+
+// CompactResult 一次 Compact 的结果
+type CompactResult struct {
+	Compacted     []uint32 // 已经回收的数据文件
+	Skipped       []uint32 // 仍然需要保留的数据文件
+	RewrittenSize int64    // 重写到活跃文件中的数据量
+	ReclaimedSize int64    // 回收的数据文件的大小
+}
+
+// addReclaimSize 记录 fid 对应的数据文件中有 size 大小的数据已经无效，调用前必须持有互斥锁
+func (db *DB) addReclaimSize(fid uint32, size int64) {
+	db.reclaimSize += size
+	db.fileReclaimSize[fid] += size
+}
+
+// pruneReclaimSize 去掉已经被 Compact 删除的数据文件的无效数据量
+// hint 文件中可能还有指向这些文件的位置，加载之后会被重放的数据覆盖，调用前必须持有互斥锁
+func (db *DB) pruneReclaimSize() {
+	for fid, size := range db.fileReclaimSize {
+		if db.dataFileByID(fid) == nil {
+			db.reclaimSize -= size
+			delete(db.fileReclaimSize, fid)
+		}
+	}
+}
+
+// DataFileStats 返回每个数据文件的大小以及其中无效的数据量，按文件 id 排序
+func (db *DB) DataFileStats() ([]DataFileStat, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.dataFileStats()
+}
+
+func (db *DB) dataFileStats() ([]DataFileStat, error) {
+	stats := make([]DataFileStat, 0, len(db.archivedFiles)+1)
+	for fid, file := range db.archivedFiles {
+		size, err := file.Size()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, DataFileStat{Fid: fid, Size: size, ReclaimableSize: db.fileReclaimSize[fid]})
+	}
+	if db.activeFile != nil {
+		fid := db.activeFile.FileId
+		stats = append(stats, DataFileStat{Fid: fid, Size: db.activeFile.WriteOff, ReclaimableSize: db.fileReclaimSize[fid], Active: true})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Fid < stats[j].Fid
+	})
+	return stats, nil
+}
+
+// Compact 增量回收无效数据：选出无效数据占比最高的几个归档文件，将其中仍然有效的记录重写到活跃文件中，
+// 直接更新内存索引，然后删除这些文件，不需要重新打开数据库
+// 每次只处理少量的文件，可以频繁地调用，和 Merge 不能同时进行
+func (db *DB) Compact(configs CompactConfigs) (*CompactResult, error) {
+	if db.config.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if configs.MaxFiles <= 0 {
+		return nil, ErrInvalidCompactConfigs
+	}
+
+	db.mutex.Lock()
+	if db.isMerging {
+		db.mutex.Unlock()
+		return nil, ErrMergeInProgress
+	}
+	stats, err := db.dataFileStats()
+	if err != nil {
+		db.mutex.Unlock()
+		return nil, err
+	}
+	var candidates []*data.DataFile
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].GarbageRatio() > stats[j].GarbageRatio()
+	})
+	for _, stat := range stats {
+		if len(candidates) == configs.MaxFiles {
+			break
+		}
+		if stat.Active || stat.ReclaimableSize == 0 || stat.GarbageRatio() < configs.MinGarbageRatio {
+			continue
+		}
+		candidates = append(candidates, db.archivedFiles[stat.Fid])
+	}
+	if len(candidates) == 0 {
+		db.mutex.Unlock()
+		return nil, ErrMergeRatioUnreached
+	}
+	db.isMerging = true
+	db.mutex.Unlock()
+	defer func() {
+		db.mutex.Lock()
+		db.isMerging = false
+		db.mutex.Unlock()
+	}()
+
+	// 从旧到新处理，保证删除记录能够判断是否还有更旧的文件
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].FileId < candidates[j].FileId
+	})
+	result := &CompactResult{}
+	for _, dataFile := range candidates {
+		compacted, err := db.compactDataFile(dataFile, result)
+		if err != nil {
+			return result, err
+		}
+		if !compacted {
+			result.Skipped = append(result.Skipped, dataFile.FileId)
+		}
+	}
+	return result, nil
+}
+
+// compactEntry 等待重写的一条记录
+type compactEntry struct {
+	record  *data.LogRecord
+	realKey []byte
+	offset  int64
+	size    int64
+}
+
+// compactDataFile 将数据文件中的有效记录重写到活跃文件中，然后删除这个文件
+// 文件中还有需要保留的数据时只重写有效记录，不删除文件，返回 false
+func (db *DB) compactDataFile(dataFile *data.DataFile, result *CompactResult) (bool, error) {
+	fid := dataFile.FileId
+	// 没有更旧的数据文件和 hint 文件时，删除记录不会再覆盖任何数据，可以直接丢弃
+	db.mutex.RLock()
+	keepTombstones := false
+	for archivedFid := range db.archivedFiles {
+		if archivedFid < fid {
+			keepTombstones = true
+			break
+		}
+	}
+	db.mutex.RUnlock()
+	if _, err := os.Stat(filepath.Join(db.config.DirPath, data.HintFileName)); err == nil {
+		keepTombstones = true
+	}
+
+	var (
+		batch      []*compactEntry
+		txns       = make(map[uint64]bool)
+		keepFile   bool   // 文件中有其他文件中的事务的完成标记，删除之后事务会丢失
+		maxDeadSeq uint64 // 不再重写的记录中最大的序列号，修改历史需要保留时不能删除文件
+		offset     int64
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := db.write(false, func() error {
+			for _, entry := range batch {
+				rewritten, err := db.rewriteCompactEntry(fid, entry, keepTombstones)
+				if err != nil {
+					return err
+				}
+				if rewritten > 0 {
+					result.RewrittenSize += rewritten
+				} else if entry.record.Seq > maxDeadSeq {
+					maxDeadSeq = entry.record.Seq
+				}
+			}
+			return nil
+		})
+		batch = batch[:0]
+		return err
+	}
+
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			// 跳过打开时已经发现的损坏数据
+			if next, ok := db.skipCorruptRange(fid, offset); ok {
+				offset = next
+				continue
+			}
+			if err == io.EOF {
+				break
+			}
+			return false, err
+		}
+		realKey, seqNo := parseLogRecordKey(logRecord.Key)
+		if logRecord.Type == data.LogRecordTxnFinished {
+			if !txns[seqNo] {
+				keepFile = true
+			}
+		} else {
+			if seqNo != nonTransactionSeqNo {
+				txns[seqNo] = true
+			}
+			batch = append(batch, &compactEntry{record: logRecord, realKey: realKey, offset: offset, size: size})
+			if len(batch) == compactBatchSize {
+				if err := flush(); err != nil {
+					return false, err
+				}
+			}
+		}
+		offset += size
+	}
+	if err := flush(); err != nil {
+		return false, err
+	}
+	if keepFile {
+		return false, nil
+	}
+
+	// 重写的记录持久化之后才能删除旧的文件
+	if err := db.Sync(); err != nil {
+		return false, err
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if maxDeadSeq > db.changeRetainSeq() {
+		return false, nil
+	}
+	delete(db.archivedFiles, fid)
+	db.reclaimSize -= db.fileReclaimSize[fid]
+	delete(db.fileReclaimSize, fid)
+	delete(db.fileSeqRanges, fid)
+	size, err := dataFile.Size()
+	if err != nil {
+		return false, err
+	}
+	// 快照仍然可以通过打开的文件读取已经删除的文件
+	if err := db.retireDataFile(dataFile); err != nil {
+		return false, err
+	}
+	if err := removeFileHint(db.config.DirPath, fid); err != nil {
+		return false, err
+	}
+	if err := os.Remove(data.GetDataFileName(db.config.DirPath, fid)); err != nil {
+		return false, err
+	}
+	atomic.AddUint64(&db.fileGeneration, 1)
+	result.Compacted = append(result.Compacted, fid)
+	result.ReclaimedSize += size
+	return true, nil
+}
+
+// rewriteCompactEntry 记录仍然有效时重写到活跃文件中并更新索引，返回重写的数据量，调用前必须持有互斥锁
+// 删除记录在 key 仍然不存在并且需要保留时也会重写
+func (db *DB) rewriteCompactEntry(fid uint32, entry *compactEntry, keepTombstones bool) (int64, error) {
+	idx := db.indexFor(entry.record.ColumnFamily)
+	if idx == nil {
+		return 0, nil
+	}
+	logRecord := entry.record
+	switch logRecord.Type {
+	case data.LogRecordNormal:
+		oldPos := db.lookupIndex(idx, entry.realKey)
+		if oldPos == nil || oldPos.Fid != fid || oldPos.Offset != entry.offset {
+			return 0, nil
+		}
+		// 清除事务标记，能被索引引用的事务数据已经提交
+		logRecord.Key = logRecordKeyWithSeq(entry.realKey, nonTransactionSeqNo)
+		pos, err := db.appendLogRecord(logRecord)
+		if err != nil {
+			return 0, err
+		}
+		idx.Put(entry.realKey, pos)
+		db.addReclaimSize(oldPos.Fid, int64(oldPos.Size))
+		db.trackBlob(pos, oldPos)
+		return int64(pos.Size), nil
+	case data.LogRecordDeleted:
+		if !keepTombstones || db.lookupIndex(idx, entry.realKey) != nil {
+			return 0, nil
+		}
+		logRecord.Key = logRecordKeyWithSeq(entry.realKey, nonTransactionSeqNo)
+		pos, err := db.appendLogRecord(logRecord)
+		if err != nil {
+			return 0, err
+		}
+		// 重写的删除记录仍然需要用来覆盖旧的数据，不计入无效数据，否则会被反复重写
+		db.addReclaimSize(fid, entry.size)
+		return int64(pos.Size), nil
+	}
+	return 0, nil
+}
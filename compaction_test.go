@@ -0,0 +1,166 @@
+package rdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_Compact(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-compact")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	// 前面的文件中大部分数据被覆盖
+	for i := 0; i < 900; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("new")))
+	}
+
+	stats, err := db.DataFileStats()
+	assert.Nil(t, err)
+	var reclaimable int64
+	for _, stat := range stats {
+		reclaimable += stat.ReclaimableSize
+	}
+	assert.Equal(t, db.Stat().ReclaimableSize, reclaimable)
+	assert.True(t, stats[0].GarbageRatio() > 0.5)
+	assert.Equal(t, float32(0), stats[len(stats)-1].GarbageRatio())
+
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+	iterator := db.NewIterator(DefaultIteratorConfigs)
+	defer iterator.Close()
+
+	result, err := db.Compact(CompactConfigs{MaxFiles: 2, MinGarbageRatio: 0.5})
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{stats[0].Fid, stats[1].Fid}, result.Compacted)
+	assert.True(t, result.ReclaimedSize > result.RewrittenSize)
+	for _, fid := range result.Compacted {
+		_, err := os.Stat(data.GetDataFileName(dir, fid))
+		assert.True(t, os.IsNotExist(err))
+	}
+	assert.True(t, db.Stat().ReclaimableSize < reclaimable)
+
+	// 之前创建的快照和迭代器仍然可以读取
+	value, err := snapshot.Get(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1000), value)
+	var count int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		_, err := iterator.Value()
+		assert.Nil(t, err)
+		count++
+	}
+	assert.Equal(t, 2000, count)
+
+	check := func() {
+		for i := 0; i < 2000; i++ {
+			value, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			if i < 900 {
+				assert.Equal(t, []byte("new"), value)
+			} else {
+				assert.Equal(t, utils.GetTestKey(i), value)
+			}
+		}
+	}
+	check()
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check()
+}
+
+func TestDB_Compact_Tombstones(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-compact-tombstone")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 旧的文件中一半的数据被删除，删除记录都在后面的文件中
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+		assert.Nil(t, db.Put(utils.GetTestKey(i+1000), utils.RandomValue(24)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	for i := 2000; i < 3000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+
+	// 只回收删除记录所在的文件，旧的数据不能因此恢复
+	result, err := db.Compact(CompactConfigs{MaxFiles: 100, MinGarbageRatio: 0.6})
+	assert.Nil(t, err)
+	assert.True(t, len(result.Compacted) > 0)
+	assert.Equal(t, 0, len(result.Skipped))
+	stats, err := db.DataFileStats()
+	assert.Nil(t, err)
+	assert.True(t, stats[0].GarbageRatio() < 0.6)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, len(db.ListKeys()))
+
+	// 反复回收直到没有可以回收的文件
+	for {
+		_, err := db.Compact(CompactConfigs{MaxFiles: 1, MinGarbageRatio: 0.5})
+		if err == ErrMergeRatioUnreached {
+			break
+		}
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, len(db.ListKeys()))
+	_, err = db.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_AutoCompact(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-compact")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	opts.AutoMergeInterval = 20 * time.Millisecond
+	opts.AutoCompactFiles = 1
+	results := make(chan AutoMergeResult, 16)
+	opts.OnAutoMerge = func(result AutoMergeResult) {
+		results <- result
+	}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+
+	select {
+	case result := <-results:
+		assert.Nil(t, result.Err)
+		assert.True(t, result.ReclaimedSize > 0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("auto compaction did not run")
+	}
+	value, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, value)
+}
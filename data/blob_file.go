@@ -0,0 +1,480 @@
+package data
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/youzeliang/rdb/fio"
+	"hash"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+)
+
+const (
+	BlobFileNameSuffix = ".blob"
+
+	// 流式读写时每次读写的数据量
+	blobChunkSize = 64 * 1024
+
+	maxBlobHeaderSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64
+
+	// 加密时每一块的校验信息的大小
+	blobChunkOverhead = 16
+)
+
+// BlobFile 存储大 value 的文件，数据文件中的记录只保存指向 blob 文件的指针
+//
+//	+--------------+--------------+--------------+-------------+--------------+-------------+
+//	|   key size   |  value size  |  family 列族  |      key    |     value    |  crc 校验值  |
+//	+--------------+--------------+--------------+-------------+--------------+-------------+
+//	  变长（最大5）    变长（最大10）   变长（最大5）       变长           变长           4字节
+//
+// crc 放在最后，这样写入和读取 value 的时候都可以边读写边计算
+//
+// 加密的文件中，每条记录从头开始按 blobChunkSize 分块，每一块使用 AES-GCM 单独加密，格式和加密的数据文件中的记录相同：
+// 长度(4字节)|密文，nonce 是块在文件中的位置，流式读取时每一块在解密时完成校验
+type BlobFile struct {
+	FileId    uint32        // 文件id
+	WriteOff  int64         // 文件写到哪个位置
+	IoManager fio.IOManager // io 读写管理
+
+	encryption *fileEncryption // 开启加密时不为 nil
+}
+
+// BlobPointer 指向 blob 文件中的一个 value
+type BlobPointer struct {
+	Fid    uint32 // blob 文件 id
+	Offset int64  // 记录在 blob 文件中的起始位置
+	Size   int64  // value 的大小
+}
+
+// BlobHeader blob 文件中记录的头部信息
+type BlobHeader struct {
+	Key        []byte
+	Family     uint32
+	ValueSize  int64
+	HeaderSize int64 // 头部及 key 的长度
+}
+
+// EntrySize 记录在没有加密的 blob 文件中占用的总大小
+func (h *BlobHeader) EntrySize() int64 {
+	return h.HeaderSize + h.ValueSize + crc32.Size
+}
+
+func OpenBlobFile(dirPath string, fileId uint32) (*BlobFile, error) {
+	ioManager, err := fio.NewIOManager(GetBlobFileName(dirPath, fileId), fio.StandardFIO)
+	if err != nil {
+		return nil, err
+	}
+	size, err := ioManager.Size()
+	if err != nil {
+		return nil, err
+	}
+	return &BlobFile{FileId: fileId, WriteOff: size, IoManager: ioManager}, nil
+}
+
+// SetEncryption 设置读写文件使用的密钥，provider 为 nil 时表示不加密
+func (bf *BlobFile) SetEncryption(provider KeyProvider) error {
+	encryption, err := setupEncryption(bf.IoManager, provider, 0)
+	if err != nil {
+		return err
+	}
+	bf.encryption = encryption
+	bf.WriteOff, err = bf.Size()
+	return err
+}
+
+// KeyID 返回文件使用的密钥的 id，没有加密或者还没有写入文件头时 ok 为 false
+func (bf *BlobFile) KeyID() (id uint32, ok bool, err error) {
+	if bf.encryption == nil {
+		return 0, false, nil
+	}
+	c, err := bf.encryption.getCipher(bf.IoManager, false)
+	if err != nil || c == nil {
+		return 0, false, err
+	}
+	return c.keyID, true, nil
+}
+
+// Size 文件中数据部分的大小，不包括加密文件的文件头
+func (bf *BlobFile) Size() (int64, error) {
+	return logicalSize(bf.IoManager, 0, bf.encryption)
+}
+
+// EntrySize 记录在文件中占用的总大小，加密时包括每一块的长度和校验信息
+func (bf *BlobFile) EntrySize(header *BlobHeader) int64 {
+	size := header.EntrySize()
+	if bf.encryption == nil {
+		return size
+	}
+	chunks := (size + blobChunkSize - 1) / blobChunkSize
+	return size + chunks*(4+blobChunkOverhead)
+}
+
+func GetBlobFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+BlobFileNameSuffix)
+}
+
+// WriteBlob 从 r 中读取 size 个字节作为 key 的 value 写入 blob 文件
+// r 中的数据不足 size 时，剩余部分用 0 填充并写入错误的校验值，保证文件仍然可以被顺序解析
+func (bf *BlobFile) WriteBlob(key []byte, family uint32, r io.Reader, size int64) (*BlobPointer, error) {
+	header := make([]byte, maxBlobHeaderSize+len(key))
+	var index = 0
+	index += binary.PutUvarint(header[index:], uint64(len(key)))
+	index += binary.PutUvarint(header[index:], uint64(size))
+	index += binary.PutUvarint(header[index:], uint64(family))
+	index += copy(header[index:], key)
+
+	pointer := &BlobPointer{Fid: bf.FileId, Offset: bf.WriteOff, Size: size}
+	w := &blobEntryWriter{file: bf}
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(header[:index])
+	if err := w.write(header[:index]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, blobChunkSize)
+	var written int64
+	var readErr error
+	for written < size {
+		chunk := buf
+		if size-written < int64(len(chunk)) {
+			chunk = chunk[:size-written]
+		}
+		n, err := io.ReadFull(r, chunk)
+		if err != nil {
+			readErr = err
+			// 填充剩余的部分
+			for i := n; i < len(chunk); i++ {
+				chunk[i] = 0
+			}
+		}
+		_, _ = crc.Write(chunk)
+		if err := w.write(chunk); err != nil {
+			return nil, err
+		}
+		written += int64(len(chunk))
+		if readErr != nil {
+			for i := range buf {
+				buf[i] = 0
+			}
+		}
+	}
+
+	sum := crc.Sum32()
+	if readErr != nil {
+		sum = ^sum
+	}
+	trailer := make([]byte, crc32.Size)
+	binary.LittleEndian.PutUint32(trailer, sum)
+	if err := w.write(trailer); err != nil {
+		return nil, err
+	}
+	if err := w.flush(); err != nil {
+		return nil, err
+	}
+
+	if readErr != nil {
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return nil, ErrBlobSizeMismatch
+		}
+		return nil, readErr
+	}
+	return pointer, nil
+}
+
+// ReadBlobHeader 读取指定位置的记录头部
+func (bf *BlobFile) ReadBlobHeader(offset int64) (*BlobHeader, error) {
+	header, _, err := bf.readBlobHeader(offset)
+	return header, err
+}
+
+// readBlobHeader 读取记录头部，返回的 reader 停在 value 开始的位置
+func (bf *BlobFile) readBlobHeader(offset int64) (*BlobHeader, *blobEntryReader, error) {
+	fileSize, err := bf.Size()
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset >= fileSize {
+		return nil, nil, io.EOF
+	}
+
+	r := &blobEntryReader{file: bf, offset: offset, fileSize: fileSize}
+	buf := make([]byte, maxBlobHeaderSize)
+	n, err := r.Read(buf)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	buf = buf[:n]
+
+	var index = 0
+	keySize, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil, nil, ErrInvalidSize
+	}
+	index += n
+	valueSize, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil, nil, ErrInvalidSize
+	}
+	index += n
+	family, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil, nil, ErrInvalidSize
+	}
+	index += n
+
+	header := &BlobHeader{
+		Family:     uint32(family),
+		ValueSize:  int64(valueSize),
+		HeaderSize: int64(index) + int64(keySize),
+	}
+	if offset+bf.EntrySize(header) > fileSize {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	// 多读出的部分属于 key 和 value
+	r.unread(buf[index:])
+	header.Key = make([]byte, keySize)
+	if _, err := io.ReadFull(r, header.Key); err != nil {
+		return nil, nil, err
+	}
+	return header, r, nil
+}
+
+// NewBlobReader 创建读取 value 的 reader，读取完成时校验 crc
+func (bf *BlobFile) NewBlobReader(pointer *BlobPointer) (*BlobReader, error) {
+	header, r, err := bf.readBlobHeader(pointer.Offset)
+	if err != nil {
+		return nil, err
+	}
+	if header.ValueSize != pointer.Size {
+		return nil, ErrInvalidSize
+	}
+
+	// crc 从头部开始计算
+	headerBuf := make([]byte, maxBlobHeaderSize+len(header.Key))
+	var index = 0
+	index += binary.PutUvarint(headerBuf[index:], uint64(len(header.Key)))
+	index += binary.PutUvarint(headerBuf[index:], uint64(header.ValueSize))
+	index += binary.PutUvarint(headerBuf[index:], uint64(header.Family))
+	index += copy(headerBuf[index:], header.Key)
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(headerBuf[:index])
+
+	return &BlobReader{
+		entry:     r,
+		remaining: header.ValueSize,
+		crc:       crc,
+	}, nil
+}
+
+// ReadBlob 读取完整的 value
+func (bf *BlobFile) ReadBlob(pointer *BlobPointer) ([]byte, error) {
+	reader, err := bf.NewBlobReader(pointer)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, pointer.Size)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return nil, err
+	}
+	// 读取到末尾时才会校验 crc
+	if _, err := reader.Read(nil); err != io.EOF {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (bf *BlobFile) Sync() error {
+	return bf.IoManager.Sync()
+}
+
+func (bf *BlobFile) Close() error {
+	return bf.IoManager.Close()
+}
+
+// blobEntryWriter 写入一条记录，加密时缓存不足一块的数据，写满一块或者记录结束时加密写入
+type blobEntryWriter struct {
+	file *BlobFile
+	buf  []byte
+}
+
+func (w *blobEntryWriter) write(p []byte) error {
+	if w.file.encryption == nil {
+		return w.file.writeRaw(p)
+	}
+	for len(p) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, blobChunkSize)
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		if len(w.buf) == blobChunkSize {
+			if err := w.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flush 加密并写入缓存的数据
+func (w *blobEntryWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	c, err := w.file.encryption.getCipher(w.file.IoManager, true)
+	if err != nil {
+		return err
+	}
+	// 使用文件实际的大小计算 nonce，保证同一个文件中的 nonce 不会重复
+	offset, err := w.file.Size()
+	if err != nil {
+		return err
+	}
+	err = w.file.writeRaw(c.seal(offset, w.buf))
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (bf *BlobFile) writeRaw(buf []byte) error {
+	n, err := bf.IoManager.Write(buf)
+	bf.WriteOff += int64(n)
+	return err
+}
+
+// blobEntryReader 从一条记录中的某个位置开始顺序读取，加密时每次解密并校验一块数据
+type blobEntryReader struct {
+	file     *BlobFile
+	offset   int64  // 下一次从文件中读取的位置，不包括加密文件的文件头
+	fileSize int64  // 加密时用来检查块的长度
+	buf      []byte // 已经读出还没有返回的数据
+}
+
+func (r *blobEntryReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.file.encryption == nil {
+			n, err := r.file.IoManager.Read(p, r.offset)
+			r.offset += int64(n)
+			return n, err
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// unread 将多读出的数据放回，下一次读取时先返回
+func (r *blobEntryReader) unread(p []byte) {
+	r.buf = append(append([]byte(nil), p...), r.buf...)
+}
+
+// readChunk 读取并解密下一块数据，校验失败时按照 crc 错误处理
+func (r *blobEntryReader) readChunk() error {
+	c, err := r.file.encryption.getCipher(r.file.IoManager, false)
+	if err != nil {
+		return err
+	}
+	if c == nil || r.offset >= r.fileSize {
+		return io.EOF
+	}
+	if r.offset+4 > r.fileSize {
+		return io.ErrUnexpectedEOF
+	}
+	physical := r.offset + r.file.encryption.dataOffset()
+	lenBuf := make([]byte, 4)
+	if _, err := r.file.IoManager.Read(lenBuf, physical); err != nil {
+		return err
+	}
+	frameSize := int64(binary.LittleEndian.Uint32(lenBuf))
+	if frameSize > blobChunkSize+blobChunkOverhead {
+		return ErrInvalidCRC
+	}
+	if r.offset+4+frameSize > r.fileSize {
+		return io.ErrUnexpectedEOF
+	}
+	ciphertext := make([]byte, frameSize)
+	if _, err := r.file.IoManager.Read(ciphertext, physical+4); err != nil && err != io.EOF {
+		return err
+	}
+	plaintext, err := c.open(r.offset, lenBuf, ciphertext)
+	if err != nil {
+		return ErrInvalidCRC
+	}
+	r.offset += 4 + frameSize
+	r.buf = plaintext
+	return nil
+}
+
+// BlobReader 流式读取 blob 文件中的 value，读到末尾时校验 crc，不一致时返回 ErrInvalidCRC
+type BlobReader struct {
+	entry     *blobEntryReader
+	remaining int64
+	crc       hash.Hash32
+	verified  bool
+}
+
+func (br *BlobReader) Read(p []byte) (int, error) {
+	if br.remaining == 0 {
+		if err := br.verify(); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > br.remaining {
+		p = p[:br.remaining]
+	}
+	if len(p) > blobChunkSize {
+		p = p[:blobChunkSize]
+	}
+	n, err := io.ReadFull(br.entry, p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	_, _ = br.crc.Write(p[:n])
+	br.remaining -= int64(n)
+	return n, err
+}
+
+func (br *BlobReader) verify() error {
+	if br.verified {
+		return nil
+	}
+	trailer := make([]byte, crc32.Size)
+	if _, err := io.ReadFull(br.entry, trailer); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if binary.LittleEndian.Uint32(trailer) != br.crc.Sum32() {
+		return ErrInvalidCRC
+	}
+	br.verified = true
+	return nil
+}
+
+// EncodeBlobPointer 对 blob 指针进行编码，作为数据文件中记录的 value
+func EncodeBlobPointer(pointer *BlobPointer) []byte {
+	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64*2)
+	var index = 0
+	index += binary.PutUvarint(buf[index:], uint64(pointer.Fid))
+	index += binary.PutVarint(buf[index:], pointer.Offset)
+	index += binary.PutVarint(buf[index:], pointer.Size)
+	return buf[:index]
+}
+
+func DecodeBlobPointer(buf []byte) *BlobPointer {
+	var index = 0
+	fileId, n := binary.Uvarint(buf[index:])
+	index += n
+	offset, n := binary.Varint(buf[index:])
+	index += n
+	size, _ := binary.Varint(buf[index:])
+	return &BlobPointer{Fid: uint32(fileId), Offset: offset, Size: size}
+}
@@ -0,0 +1,74 @@
+package data
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestBlobFile_WriteBlob(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-blob-file")
+	defer os.RemoveAll(dir)
+	blobFile, err := OpenBlobFile(dir, 0)
+	assert.Nil(t, err)
+	defer blobFile.Close()
+
+	value := bytes.Repeat([]byte("rdb"), 100000)
+	pointer1, err := blobFile.WriteBlob([]byte("name"), 0, bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), pointer1.Offset)
+	pointer2, err := blobFile.WriteBlob([]byte("empty"), 3, bytes.NewReader(nil), 0)
+	assert.Nil(t, err)
+
+	read, err := blobFile.ReadBlob(pointer1)
+	assert.Nil(t, err)
+	assert.Equal(t, value, read)
+	read, err = blobFile.ReadBlob(pointer2)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(read))
+
+	header, err := blobFile.ReadBlobHeader(pointer2.Offset)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("empty"), header.Key)
+	assert.Equal(t, uint32(3), header.Family)
+	assert.Equal(t, blobFile.WriteOff, pointer2.Offset+header.EntrySize())
+
+	// 指针编码之后可以还原
+	assert.Equal(t, pointer1, DecodeBlobPointer(EncodeBlobPointer(pointer1)))
+
+	// reader 中的数据不够时返回错误，写入的记录校验失败
+	pointer3 := &BlobPointer{Fid: 0, Offset: blobFile.WriteOff, Size: 100}
+	_, err = blobFile.WriteBlob([]byte("short"), 0, bytes.NewReader([]byte("abc")), 100)
+	assert.Equal(t, ErrBlobSizeMismatch, err)
+	_, err = blobFile.ReadBlob(pointer3)
+	assert.Equal(t, ErrInvalidCRC, err)
+}
+
+func TestBlobReader_CorruptedValue(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-blob-reader")
+	defer os.RemoveAll(dir)
+	blobFile, err := OpenBlobFile(dir, 1)
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("a"), 200000)
+	pointer, err := blobFile.WriteBlob([]byte("key"), 0, bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	assert.Nil(t, blobFile.Close())
+
+	// 修改 value 中间的一个字节
+	file, err := os.OpenFile(GetBlobFileName(dir, 1), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("b"), 100000)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	blobFile, err = OpenBlobFile(dir, 1)
+	assert.Nil(t, err)
+	defer blobFile.Close()
+	reader, err := blobFile.NewBlobReader(pointer)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(reader)
+	assert.Equal(t, ErrInvalidCRC, err)
+}
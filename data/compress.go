@@ -0,0 +1,240 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+var ErrInvalidCompressedData = errors.New("invalid compressed value in log record")
+
+type CompressionType = byte
+
+const (
+	CompressionNone  CompressionType = iota // 不压缩
+	CompressionFlate                        // 标准库的 flate 算法，压缩率高
+	CompressionLZ                           // LZ77 风格的算法，压缩率低一些，但是速度很快
+)
+
+// 太小的 value 压缩之后基本不会变小
+const minCompressSize = 64
+
+var (
+	flateWriterPool = sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	flateReaderPool = sync.Pool{New: func() any {
+		return flate.NewReader(nil)
+	}}
+)
+
+// CompressValue 使用指定的算法压缩 value，压缩之后没有变小时返回原始数据及 CompressionNone
+func CompressValue(codec CompressionType, value []byte) (CompressionType, []byte) {
+	if codec == CompressionNone || len(value) < minCompressSize {
+		return CompressionNone, value
+	}
+
+	var compressed []byte
+	switch codec {
+	case CompressionFlate:
+		compressed = flateCompress(value)
+	case CompressionLZ:
+		compressed = lzCompress(value)
+	default:
+		return CompressionNone, value
+	}
+	if len(compressed) >= len(value) {
+		return CompressionNone, value
+	}
+	return codec, compressed
+}
+
+// DecompressValue 解压 value
+func DecompressValue(codec CompressionType, value []byte) ([]byte, error) {
+	switch codec {
+	case CompressionNone:
+		return value, nil
+	case CompressionFlate:
+		return flateDecompress(value)
+	case CompressionLZ:
+		return lzDecompress(value)
+	default:
+		return nil, ErrInvalidCompressedData
+	}
+}
+
+func flateCompress(value []byte) []byte {
+	var buf bytes.Buffer
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+	w.Reset(&buf)
+	_, _ = w.Write(value)
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+func flateDecompress(value []byte) ([]byte, error) {
+	r := flateReaderPool.Get().(io.ReadCloser)
+	defer flateReaderPool.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(value), nil); err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, ErrInvalidCompressedData
+	}
+	return out, nil
+}
+
+// LZ 格式：原始长度（变长）之后是若干个序列
+// 每个序列以一个字节开头，高 4 位是字面量长度，低 4 位是匹配长度减 4，值为 15 时后面跟着扩展长度
+// 然后依次是字面量、2 字节的匹配距离、匹配长度的扩展部分，最后一个序列只有字面量
+const (
+	lzMinMatch  = 4
+	lzHashBits  = 14
+	lzMaxOffset = 1<<16 - 1
+)
+
+func lzCompress(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+	var table [1 << lzHashBits]int32
+
+	anchor, pos := 0, 0
+	for pos+lzMinMatch <= len(src) {
+		seq := binary.LittleEndian.Uint32(src[pos:])
+		h := (seq * 2654435761) >> (32 - lzHashBits)
+		candidate := int(table[h]) - 1
+		table[h] = int32(pos + 1)
+
+		if candidate < 0 || pos-candidate > lzMaxOffset ||
+			binary.LittleEndian.Uint32(src[candidate:]) != seq {
+			pos++
+			continue
+		}
+
+		matchLen := lzMinMatch
+		for pos+matchLen < len(src) && src[candidate+matchLen] == src[pos+matchLen] {
+			matchLen++
+		}
+		dst = lzAppendSequence(dst, src[anchor:pos], pos-candidate, matchLen)
+		pos += matchLen
+		anchor = pos
+	}
+
+	// 剩余的字面量
+	return lzAppendSequence(dst, src[anchor:], 0, 0)
+}
+
+func lzAppendSequence(dst []byte, literals []byte, offset int, matchLen int) []byte {
+	litLen := len(literals)
+	var token byte
+	if litLen >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(litLen) << 4
+	}
+	if matchLen > 0 {
+		if matchLen-lzMinMatch >= 15 {
+			token |= 15
+		} else {
+			token |= byte(matchLen - lzMinMatch)
+		}
+	}
+	dst = append(dst, token)
+	if litLen >= 15 {
+		dst = lzAppendLength(dst, litLen-15)
+	}
+	dst = append(dst, literals...)
+	if matchLen == 0 {
+		return dst
+	}
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(offset))
+	if matchLen-lzMinMatch >= 15 {
+		dst = lzAppendLength(dst, matchLen-lzMinMatch-15)
+	}
+	return dst
+}
+
+func lzAppendLength(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
+	}
+	return append(dst, byte(n))
+}
+
+func lzDecompress(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 || size > uint64(len(src))*255 {
+		return nil, ErrInvalidCompressedData
+	}
+	dst := make([]byte, 0, size)
+	pos := n
+
+	for pos < len(src) {
+		token := src[pos]
+		pos++
+
+		litLen := int(token >> 4)
+		if litLen == 15 {
+			ext, n, ok := lzReadLength(src[pos:])
+			if !ok {
+				return nil, ErrInvalidCompressedData
+			}
+			litLen += ext
+			pos += n
+		}
+		if litLen > len(src)-pos || len(dst)+litLen > int(size) {
+			return nil, ErrInvalidCompressedData
+		}
+		dst = append(dst, src[pos:pos+litLen]...)
+		pos += litLen
+
+		// 最后一个序列没有匹配部分
+		if pos == len(src) {
+			break
+		}
+		if pos+2 > len(src) {
+			return nil, ErrInvalidCompressedData
+		}
+		offset := int(binary.LittleEndian.Uint16(src[pos:]))
+		pos += 2
+		matchLen := int(token&0x0f) + lzMinMatch
+		if token&0x0f == 15 {
+			ext, n, ok := lzReadLength(src[pos:])
+			if !ok {
+				return nil, ErrInvalidCompressedData
+			}
+			matchLen += ext
+			pos += n
+		}
+		if offset == 0 || offset > len(dst) || len(dst)+matchLen > int(size) {
+			return nil, ErrInvalidCompressedData
+		}
+		// 匹配的部分可能和正在写入的部分重叠，只能逐个字节复制
+		start := len(dst) - offset
+		for i := 0; i < matchLen; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if len(dst) != int(size) {
+		return nil, ErrInvalidCompressedData
+	}
+	return dst, nil
+}
+
+func lzReadLength(src []byte) (int, int, bool) {
+	var length int
+	for i, b := range src {
+		length += int(b)
+		if b != 255 {
+			return length, i + 1, true
+		}
+	}
+	return 0, 0, false
+}
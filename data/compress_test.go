@@ -0,0 +1,64 @@
+package data
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressValue(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	values := [][]byte{
+		[]byte(`{"id":1,"name":"bitcask","tags":["kv","go"],"name2":"bitcask","tags2":["kv","go"]}`),
+		bytes.Repeat([]byte(`{"user":"rdb","age":18}`), 1000),
+		bytes.Repeat([]byte("a"), 100000),
+		random,
+		[]byte("short"),
+	}
+
+	for _, codec := range []CompressionType{CompressionFlate, CompressionLZ} {
+		for _, value := range values {
+			actual, compressed := CompressValue(codec, value)
+			if actual == CompressionNone {
+				// 压缩之后没有变小的数据保持原样
+				assert.Equal(t, value, compressed)
+				continue
+			}
+			assert.Equal(t, codec, actual)
+			assert.True(t, len(compressed) < len(value))
+			decompressed, err := DecompressValue(actual, compressed)
+			assert.Nil(t, err)
+			assert.Equal(t, value, decompressed)
+		}
+
+		// 重复的数据可以被压缩
+		actual, compressed := CompressValue(codec, values[1])
+		assert.Equal(t, codec, actual)
+		assert.True(t, len(compressed)*5 < len(values[1]))
+		actual, _ = CompressValue(codec, random)
+		assert.Equal(t, CompressionNone, actual)
+	}
+
+	_, compressed := CompressValue(CompressionLZ, values[1])
+	_, err := DecompressValue(CompressionLZ, compressed[:len(compressed)/2])
+	assert.Equal(t, ErrInvalidCompressedData, err)
+}
+
+func TestEncodeLogRecord_Compression(t *testing.T) {
+	value := bytes.Repeat([]byte("bitcask-kv-go"), 100)
+	codec, compressed := CompressValue(CompressionLZ, value)
+	record := &LogRecord{
+		Key:         []byte("name"),
+		Value:       compressed,
+		Type:        LogRecordNormal,
+		Expire:      1700000000000000000,
+		Compression: codec,
+	}
+	res, _ := EncodeLogRecord(record)
+	h, _ := decodeLogRecordHeader(res)
+	assert.Equal(t, LogRecordNormal, h.recordType)
+	assert.Equal(t, CompressionLZ, h.codec)
+	assert.Equal(t, int64(1700000000000000000), h.expire)
+}
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/youzeliang/rdb/fio"
@@ -10,9 +11,10 @@ import (
 )
 
 var (
-	ErrInvalidCRC    = errors.New("invalid crc value, log record maybe corrupted")
-	ErrInvalidSize   = errors.New("invalid size value in log record")
-	ErrReadLogRecord = errors.New("failed to read log record")
+	ErrInvalidCRC       = errors.New("invalid crc value, log record maybe corrupted")
+	ErrInvalidSize      = errors.New("invalid size value in log record")
+	ErrReadLogRecord    = errors.New("failed to read log record")
+	ErrBlobSizeMismatch = errors.New("the blob reader returned fewer bytes than the declared size")
 )
 
 const (
@@ -21,6 +23,8 @@ const (
 
 	MergeFinishedFileName = "merge-finished"
 	SeqNoFileName         = "seq-no"
+	ColumnFamilyFileName  = "column-families"
+	CursorFileName        = "cursors"
 )
 
 // DataFile 数据文件
@@ -28,11 +32,27 @@ type DataFile struct {
 	FileId    uint32        // 文件id
 	WriteOff  int64         // 文件写到哪个位置
 	IoManager fio.IOManager // io 读写管理
+
+	encryption *fileEncryption // 开启加密时不为 nil
+
+	header        *FileHeader // 文件头，旧版本的数据文件以及 hint 等文件为 nil
+	headerWritten bool        // 文件头是否已经写入
 }
 
+// OpenDataFile 打开数据文件，新创建的数据文件带有文件头，在第一次写入时写到文件中
+// 旧版本没有文件头的数据文件仍然按照原来的格式读写
 func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
 	fileName := GetDataFileName(dirPath, fileId)
-	return newDataFile(fileName, fileId, ioType)
+	dataFile, err := newDataFile(fileName, fileId, ioType)
+	if err != nil {
+		return nil, err
+	}
+	dataFile.header, dataFile.headerWritten, err = readFileHeader(dataFile.IoManager)
+	if err != nil {
+		_ = dataFile.Close()
+		return nil, err
+	}
+	return dataFile, nil
 }
 
 func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
@@ -48,15 +68,139 @@ func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFi
 	}, nil
 }
 
+// SetEncryption 设置读写文件使用的密钥，provider 为 nil 时表示不加密
+// 文件已经存在时校验文件是否加密以及密钥是否正确
+func (df *DataFile) SetEncryption(provider KeyProvider) error {
+	encryption, err := setupEncryption(df.IoManager, provider, df.headerSize())
+	if err != nil {
+		return err
+	}
+	df.encryption = encryption
+	return nil
+}
+
+// Size 文件中数据部分的大小，不包括文件头
+func (df *DataFile) Size() (int64, error) {
+	return logicalSize(df.IoManager, df.headerSize(), df.encryption)
+}
+
+// Header 数据文件的文件头，旧版本的数据文件返回 nil
+func (df *DataFile) Header() *FileHeader {
+	return df.header
+}
+
+// FormatVersion 数据文件的格式版本
+func (df *DataFile) FormatVersion() uint16 {
+	if df.header == nil {
+		return LegacyFormatVersion
+	}
+	return df.header.Version
+}
+
+// Truncate 将文件截断到 size 的位置，size 不包括文件头，用于丢弃末尾写了一半的记录
+func (df *DataFile) Truncate(size int64) error {
+	physical := size + df.headerSize()
+	if df.encryption != nil {
+		physical = size + df.encryption.dataOffset()
+	}
+	fileSize, err := df.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	if physical < fileSize {
+		if err := df.IoManager.Truncate(physical); err != nil {
+			return err
+		}
+	}
+	df.WriteOff = size
+	return nil
+}
+
+func (df *DataFile) headerSize() int64 {
+	if df.header == nil {
+		return 0
+	}
+	return FileHeaderSize
+}
+
 // ReadLogRecord 根据 offset 从数据文件中读取 LogRecord
 func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
+	if df.encryption != nil {
+		return df.readEncryptedLogRecord(offset)
+	}
 
-	fileSize, err := df.IoManager.Size()
+	fileSize, err := df.Size()
 	if err != nil {
 		return nil, 0, fmt.Errorf("get file size error: %w", err)
 	}
+	headerSize := df.headerSize()
+	readNBytes := func(n int64, offset int64) ([]byte, error) {
+		return df.readNBytes(n, offset+headerSize)
+	}
+	return decodeLogRecordAt(readNBytes, fileSize, offset)
+}
+
+// 加密的文件中每条记录是 长度(4字节)|密文，offset 不包括文件头，解密失败时按照 crc 错误处理
+func (df *DataFile) readEncryptedLogRecord(offset int64) (*LogRecord, int64, error) {
+	c, err := df.encryption.getCipher(df.IoManager, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	fileSize, err := df.Size()
+	if err != nil {
+		return nil, 0, fmt.Errorf("get file size error: %w", err)
+	}
+	if c == nil || offset == fileSize {
+		return nil, 0, io.EOF
+	}
+	if offset < 0 || offset > fileSize {
+		return nil, 0, fmt.Errorf("invalid offset %d, fileSize %d", offset, fileSize)
+	}
+	if offset+4 > fileSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	physical := offset + df.encryption.dataOffset()
+	lenBuf, err := df.readNBytes(4, physical)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read header error: %w", err)
+	}
+	frameSize := int64(binary.LittleEndian.Uint32(lenBuf))
+	if offset+4+frameSize > fileSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	ciphertext, err := df.readNBytes(frameSize, physical+4)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read kv error: %w", err)
+	}
+	plaintext, err := c.open(offset, lenBuf, ciphertext)
+	if err != nil {
+		return nil, 0, ErrInvalidCRC
+	}
+
+	readNBytes := func(n int64, off int64) ([]byte, error) {
+		if off+n > int64(len(plaintext)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return plaintext[off : off+n], nil
+	}
+	logRecord, recordSize, err := decodeLogRecordAt(readNBytes, int64(len(plaintext)), 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if recordSize != int64(len(plaintext)) {
+		return nil, 0, ErrInvalidSize
+	}
+	return logRecord, 4 + frameSize, nil
+}
 
-	if offset < 0 || offset >= fileSize {
+// decodeLogRecordAt 使用 readNBytes 读取并解析 offset 位置的 LogRecord
+func decodeLogRecordAt(readNBytes func(n int64, offset int64) ([]byte, error), fileSize int64, offset int64) (*LogRecord, int64, error) {
+	// 刚好读到文件末尾
+	if offset == fileSize {
+		return nil, 0, io.EOF
+	}
+	if offset < 0 || offset > fileSize {
 		return nil, 0, fmt.Errorf("invalid offset %d, fileSize %d", offset, fileSize)
 	}
 
@@ -66,7 +210,7 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 		headerBytes = fileSize - offset
 	}
 
-	headerBuf, err := df.readNBytes(headerBytes, offset)
+	headerBuf, err := readNBytes(headerBytes, offset)
 	if err != nil {
 		return nil, 0, fmt.Errorf("read header error: %w", err)
 	}
@@ -89,11 +233,11 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	var recordSize = headerSize + keySize + valueSize
 
 	// 构造 LogRecord 对象
-	logRecord := &LogRecord{Type: header.recordType}
+	logRecord := &LogRecord{Type: header.recordType, Expire: header.expire, ColumnFamily: header.family, Seq: header.seq, Blob: header.blob}
 
 	// 读取实际的 key/value 数据
 	if keySize > 0 || valueSize > 0 {
-		kvBuf, err := df.readNBytes(keySize+valueSize, offset+headerSize)
+		kvBuf, err := readNBytes(keySize+valueSize, offset+headerSize)
 		if err != nil {
 			return nil, 0, fmt.Errorf("read kv error: %w", err)
 		}
@@ -109,14 +253,92 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 		return nil, 0, ErrInvalidCRC
 	}
 
+	// crc 校验的是磁盘上的数据，校验通过之后再解压
+	if header.codec != CompressionNone {
+		value, err := DecompressValue(header.codec, logRecord.Value)
+		if err != nil {
+			return nil, 0, err
+		}
+		logRecord.Value = value
+		logRecord.Compression = header.codec
+		logRecord.StoredValueSize = valueSize
+	}
+
 	return logRecord, recordSize, nil
 }
 
+// recoveryScanWindow 查找下一条有效记录时每次批量读取的数据大小
+const recoveryScanWindow = 64 * 1024
+
+// NextValidRecord 从 offset 之后逐个字节查找下一条可以正确解析的记录，没有找到时返回 fileSize
+// 数据按照 recoveryScanWindow 批量读取，只有记录头合法并且没有超出文件末尾的位置才完整读取并校验
+func (df *DataFile) NextValidRecord(offset int64, fileSize int64) (int64, error) {
+	base := df.headerSize()
+	if df.encryption != nil {
+		base = df.encryption.dataOffset()
+	}
+	buf := make([]byte, recoveryScanWindow)
+	var window []byte
+	var windowStart int64
+	for offset++; offset < fileSize; offset++ {
+		// 窗口中剩余的数据不足一个记录头时，从 offset 开始重新读取
+		if windowEnd := windowStart + int64(len(window)); offset+maxLogRecordHeaderSize > windowEnd && windowEnd < fileSize {
+			window = buf[:min(int64(len(buf)), fileSize-offset)]
+			if _, err := df.IoManager.Read(window, base+offset); err != nil && err != io.EOF {
+				return 0, err
+			}
+			windowStart = offset
+		}
+		if !df.recordFits(window[offset-windowStart:], offset, fileSize) {
+			continue
+		}
+		if _, _, err := df.ReadLogRecord(offset); err == nil {
+			return offset, nil
+		}
+	}
+	return fileSize, nil
+}
+
+// recordFits 根据 buf 开头的记录头判断 offset 位置是否可能是一条完整的记录，不读取 key/value
+func (df *DataFile) recordFits(buf []byte, offset int64, fileSize int64) bool {
+	if df.encryption != nil {
+		if len(buf) < 4 {
+			return false
+		}
+		frameSize := int64(binary.LittleEndian.Uint32(buf))
+		return frameSize > 0 && offset+4+frameSize <= fileSize
+	}
+	header, headerSize := decodeLogRecordHeader(buf)
+	if header == nil || header.recordType > LogRecordTxnFinished {
+		return false
+	}
+	if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
+		return false
+	}
+	return offset+headerSize+int64(header.keySize)+int64(header.valueSize) <= fileSize
+}
+
 func (df *DataFile) Sync() error {
 	return df.IoManager.Sync()
 }
 
+// Write 追加写入一条编码之后的记录，开启加密时 buf 作为一个整体加密，所以每次只能写入一条记录
 func (df *DataFile) Write(buf []byte) error {
+	if err := df.writeHeader(); err != nil {
+		return err
+	}
+	if df.encryption != nil {
+		c, err := df.encryption.getCipher(df.IoManager, true)
+		if err != nil {
+			return err
+		}
+		// 使用文件实际的大小计算 nonce，保证同一个文件中的 nonce 不会重复
+		offset, err := df.Size()
+		if err != nil {
+			return err
+		}
+		buf = c.seal(offset, buf)
+	}
 	n, err := df.IoManager.Write(buf)
 	if err != nil {
 		return err
@@ -125,6 +347,18 @@ func (df *DataFile) Write(buf []byte) error {
 	return nil
 }
 
+// writeHeader 第一次写入时写入文件头
+func (df *DataFile) writeHeader() error {
+	if df.header == nil || df.headerWritten {
+		return nil
+	}
+	if _, err := df.IoManager.Write(EncodeFileHeader(df.header)); err != nil {
+		return err
+	}
+	df.headerWritten = true
+	return nil
+}
+
 func (df *DataFile) Close() error {
 	return df.IoManager.Close()
 }
@@ -147,11 +381,29 @@ func OpenSeqNoFile(dirPath string) (*DataFile, error) {
 	return newDataFile(fileName, 0, fio.StandardFIO)
 }
 
+// OpenColumnFamilyFile 存储列族信息的文件
+func OpenColumnFamilyFile(dirPath string) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, ColumnFamilyFileName)
+	return newDataFile(fileName, 0, fio.StandardFIO)
+}
+
+// OpenCursorFile 打开存储修改记录消费位置的文件
+func OpenCursorFile(dirPath string) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, CursorFileName)
+	return newDataFile(fileName, 0, fio.StandardFIO)
+}
+
+// OpenTmpFile 打开指定路径的临时文件，写完之后用于替换正式的文件
+func OpenTmpFile(fileName string) (*DataFile, error) {
+	return newDataFile(fileName, 0, fio.StandardFIO)
+}
+
 // WriteHintRecord 写入索引到hint文件
-func (df *DataFile) WriteHintRecord(key []byte, pos *Position) error {
+func (df *DataFile) WriteHintRecord(key []byte, family uint32, pos *Position) error {
 	hintRecord := &LogRecord{
-		Key:   key,
-		Value: EncodeLogRecordPos(pos),
+		Key:          key,
+		Value:        EncodeLogRecordPos(pos),
+		ColumnFamily: family,
 	}
 	encRecord, _ := EncodeLogRecord(hintRecord)
 	return df.Write(encRecord)
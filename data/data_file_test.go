@@ -1,6 +1,7 @@
 package data
 
 import (
+	"crypto/rand"
 	"github.com/stretchr/testify/assert"
 	"github.com/youzeliang/rdb/fio"
 	"os"
@@ -109,3 +110,31 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, rec3, readRec3)
 	assert.Equal(t, size3, readSize3)
 }
+
+func TestDataFile_NextValidRecord(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-next-record")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	rec1, size1 := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("bitcask kv go")})
+	assert.Nil(t, dataFile.Write(rec1))
+	// 中间是跨越多个读取窗口的损坏数据
+	garbage := make([]byte, 3*recoveryScanWindow+7)
+	_, _ = rand.Read(garbage)
+	assert.Nil(t, dataFile.Write(garbage))
+	rec2, _ := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("a new value")})
+	assert.Nil(t, dataFile.Write(rec2))
+
+	fileSize, err := dataFile.Size()
+	assert.Nil(t, err)
+	next, err := dataFile.NextValidRecord(size1, fileSize)
+	assert.Nil(t, err)
+	assert.Equal(t, size1+int64(len(garbage)), next)
+
+	// 后面没有有效的记录
+	next, err = dataFile.NextValidRecord(next, fileSize)
+	assert.Nil(t, err)
+	assert.Equal(t, fileSize, next)
+}
@@ -0,0 +1,236 @@
+package data
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/youzeliang/rdb/fio"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrEncryptionKeyRequired = errors.New("the file is encrypted but no encryption key is configured")
+	ErrWrongEncryptionKey    = errors.New("the encryption key does not match the one the file was written with")
+	ErrFileNotEncrypted      = errors.New("encryption is configured but the file is not encrypted")
+)
+
+// KeyProvider 提供加密文件使用的密钥，密钥的长度必须是 16、24 或者 32 字节
+type KeyProvider interface {
+	// CurrentKey 返回新创建的文件使用的密钥及其 id
+	CurrentKey() (uint32, []byte, error)
+
+	// Key 根据 id 返回密钥，用于读取旧的文件
+	Key(id uint32) ([]byte, error)
+}
+
+// 加密文件的文件头
+//
+//	+-------------+-------------+-------------+-------------+
+//	|    magic    |   key id    |     salt    |  key check  |
+//	+-------------+-------------+-------------+-------------+
+//	    4字节          4字节         16字节         16字节
+//
+// 每个文件使用主密钥和随机 salt 派生出的密钥，key check 用于在打开文件时校验密钥是否正确
+const (
+	encryptionHeaderSize = 4 + 4 + 16 + 16
+	encryptionSaltSize   = 16
+)
+
+var encryptionMagic = []byte("RDBE")
+
+// fileCipher 单个文件使用的密钥
+type fileCipher struct {
+	keyID uint32
+	aead  cipher.AEAD
+}
+
+func newFileCipher(masterKey []byte, keyID uint32, salt []byte) (*fileCipher, error) {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write(salt)
+	fileKey := mac.Sum(nil)[:len(masterKey)]
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &fileCipher{keyID: keyID, aead: aead}, nil
+}
+
+// nonce 数据在文件中的位置不会重复，所以用位置作为 nonce，前 4 个字节为 0
+func (c *fileCipher) nonce(offset int64) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(offset))
+	return nonce
+}
+
+// checkNonce 校验密钥使用的 nonce，全部为 0xff，不会和数据使用的 nonce 重复
+func (c *fileCipher) checkNonce() []byte {
+	return bytes.Repeat([]byte{0xff}, c.aead.NonceSize())
+}
+
+// seal 加密 offset 位置的一条记录，返回 长度(4字节)|密文 格式的数据，长度作为附加数据参与校验
+func (c *fileCipher) seal(offset int64, plaintext []byte) []byte {
+	frame := make([]byte, 4, 4+len(plaintext)+c.aead.Overhead())
+	binary.LittleEndian.PutUint32(frame, uint32(len(plaintext)+c.aead.Overhead()))
+	return c.aead.Seal(frame, c.nonce(offset), plaintext, frame[:4])
+}
+
+func (c *fileCipher) open(offset int64, lenBuf, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.nonce(offset), ciphertext, lenBuf)
+}
+
+// fileEncryption 管理加密文件的文件头，文件头在第一次写入时创建
+// 只读打开的文件可能还没有写入文件头，此时在第一次读取到文件头时再加载密钥
+type fileEncryption struct {
+	provider KeyProvider
+	base     int64 // 加密文件头在文件中的位置，前面是明文的文件头
+	cipher   atomic.Pointer[fileCipher]
+	mu       sync.Mutex
+}
+
+// setupEncryption 检查文件从 base 开始的部分是否加密，已经存在文件头时校验密钥
+// provider 为 nil 时表示没有开启加密，返回 nil
+func setupEncryption(ioManager fio.IOManager, provider KeyProvider, base int64) (*fileEncryption, error) {
+	size, err := ioManager.Size()
+	if err != nil {
+		return nil, err
+	}
+	var encrypted bool
+	if size > base {
+		magic := make([]byte, len(encryptionMagic))
+		n, err := ioManager.Read(magic, base)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		encrypted = n == len(encryptionMagic) && bytes.Equal(magic, encryptionMagic)
+		// 写了一半的加密文件头
+		if size < base+encryptionHeaderSize && (encrypted || provider != nil && bytes.HasPrefix(encryptionMagic, magic[:n])) {
+			return nil, ErrPartialFileHeader
+		}
+	}
+
+	if provider == nil {
+		if encrypted {
+			return nil, ErrEncryptionKeyRequired
+		}
+		return nil, nil
+	}
+	if size > base && !encrypted {
+		return nil, ErrFileNotEncrypted
+	}
+
+	encryption := &fileEncryption{provider: provider, base: base}
+	if _, err := encryption.getCipher(ioManager, false); err != nil {
+		return nil, err
+	}
+	return encryption, nil
+}
+
+// getCipher 获取文件使用的密钥，文件头还不存在时，create 为 true 则写入新的文件头，否则返回 nil
+func (e *fileEncryption) getCipher(ioManager fio.IOManager, create bool) (*fileCipher, error) {
+	if c := e.cipher.Load(); c != nil {
+		return c, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if c := e.cipher.Load(); c != nil {
+		return c, nil
+	}
+
+	size, err := ioManager.Size()
+	if err != nil {
+		return nil, err
+	}
+	var c *fileCipher
+	switch {
+	case size >= e.base+encryptionHeaderSize:
+		c, err = e.loadHeader(ioManager)
+	case size == e.base && create:
+		c, err = e.writeHeader(ioManager)
+	case size <= e.base:
+		return nil, nil
+	default:
+		// 写了一半的文件头
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.cipher.Store(c)
+	return c, nil
+}
+
+func (e *fileEncryption) loadHeader(ioManager fio.IOManager) (*fileCipher, error) {
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := ioManager.Read(header, e.base); err != nil && err != io.EOF {
+		return nil, err
+	}
+	keyID := binary.LittleEndian.Uint32(header[4:8])
+	masterKey, err := e.provider.Key(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption key %d: %w", keyID, err)
+	}
+	c, err := newFileCipher(masterKey, keyID, header[8:8+encryptionSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	check := header[8+encryptionSaltSize:]
+	if _, err := c.aead.Open(nil, c.checkNonce(), check, header[:8+encryptionSaltSize]); err != nil {
+		return nil, ErrWrongEncryptionKey
+	}
+	return c, nil
+}
+
+func (e *fileEncryption) writeHeader(ioManager fio.IOManager) (*fileCipher, error) {
+	keyID, masterKey, err := e.provider.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current encryption key: %w", err)
+	}
+	header := make([]byte, 8+encryptionSaltSize, encryptionHeaderSize)
+	copy(header, encryptionMagic)
+	binary.LittleEndian.PutUint32(header[4:8], keyID)
+	if _, err := rand.Read(header[8:]); err != nil {
+		return nil, err
+	}
+	c, err := newFileCipher(masterKey, keyID, header[8:])
+	if err != nil {
+		return nil, err
+	}
+	header = c.aead.Seal(header, c.checkNonce(), nil, header)
+	if _, err := ioManager.Write(header); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// dataOffset 数据部分在文件中的起始位置
+func (e *fileEncryption) dataOffset() int64 {
+	return e.base + encryptionHeaderSize
+}
+
+// logicalSize 去掉 headerSize 大小的明文文件头以及加密文件头之后的文件大小
+func logicalSize(ioManager fio.IOManager, headerSize int64, encryption *fileEncryption) (int64, error) {
+	size, err := ioManager.Size()
+	if err != nil {
+		return 0, err
+	}
+	if encryption != nil {
+		headerSize = encryption.dataOffset()
+	}
+	if size < headerSize {
+		return 0, nil
+	}
+	return size - headerSize, nil
+}
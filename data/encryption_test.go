@@ -0,0 +1,164 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/fio"
+	"io"
+	"os"
+	"testing"
+)
+
+type testKeyProvider map[uint32][]byte
+
+func (p testKeyProvider) CurrentKey() (uint32, []byte, error) {
+	var current uint32
+	for id := range p {
+		if id > current {
+			current = id
+		}
+	}
+	return current, p[current], nil
+}
+
+func (p testKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := p[id]
+	if !ok {
+		return nil, fmt.Errorf("key %d not found", id)
+	}
+	return key, nil
+}
+
+func TestDataFile_Encryption(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+	defer os.RemoveAll(dir)
+	provider := testKeyProvider{1: bytes.Repeat([]byte("k"), 32)}
+
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	assert.Nil(t, dataFile.SetEncryption(provider))
+
+	var offsets []int64
+	for i := 0; i < 3; i++ {
+		offsets = append(offsets, dataFile.WriteOff)
+		encRecord, _ := EncodeLogRecord(&LogRecord{Key: []byte(fmt.Sprintf("key-%d", i)), Value: []byte("secret-value")})
+		assert.Nil(t, dataFile.Write(encRecord))
+	}
+	size, err := dataFile.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, dataFile.WriteOff, size)
+	assert.Nil(t, dataFile.Close())
+
+	// 磁盘上看不到明文
+	raw, err := os.ReadFile(GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("secret-value")))
+
+	dataFile, err = OpenDataFile(dir, 0, fio.MemoryMap)
+	assert.Nil(t, err)
+	assert.Nil(t, dataFile.SetEncryption(provider))
+	var offset int64
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, offsets[i], offset)
+		logRecord, n, err := dataFile.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("key-%d", i)), logRecord.Key)
+		assert.Equal(t, []byte("secret-value"), logRecord.Value)
+		offset += n
+	}
+	_, _, err = dataFile.ReadLogRecord(offset)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, dataFile.Close())
+
+	// 密钥不正确或者没有密钥
+	dataFile, _ = OpenDataFile(dir, 0, fio.StandardFIO)
+	err = dataFile.SetEncryption(testKeyProvider{1: bytes.Repeat([]byte("x"), 32)})
+	assert.Equal(t, ErrWrongEncryptionKey, err)
+	assert.Equal(t, ErrEncryptionKeyRequired, dataFile.SetEncryption(nil))
+	_ = dataFile.Close()
+
+	// 篡改的数据无法通过校验
+	raw[len(raw)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 0), raw, 0644))
+	dataFile, _ = OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, dataFile.SetEncryption(provider))
+	_, _, err = dataFile.ReadLogRecord(offsets[2])
+	assert.Equal(t, ErrInvalidCRC, err)
+	_ = dataFile.Close()
+}
+
+func TestBlobFile_Encryption(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption-blob")
+	defer os.RemoveAll(dir)
+	provider := testKeyProvider{1: bytes.Repeat([]byte("k"), 16)}
+	value := bytes.Repeat([]byte("secret-blob-"), blobChunkSize/6)
+
+	blobFile, err := OpenBlobFile(dir, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, blobFile.SetEncryption(provider))
+	pointer, err := blobFile.WriteBlob([]byte("key"), 0, bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	assert.Nil(t, blobFile.Close())
+
+	raw, err := os.ReadFile(GetBlobFileName(dir, 0))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("secret-blob-")))
+
+	blobFile, err = OpenBlobFile(dir, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, blobFile.SetEncryption(provider))
+	got, err := blobFile.ReadBlob(pointer)
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+
+	// 第二条记录从第一条记录加密之后的结尾开始
+	pointer2, err := blobFile.WriteBlob([]byte("key2"), 1, bytes.NewReader([]byte("small")), 5)
+	assert.Nil(t, err)
+	header, err := blobFile.ReadBlobHeader(pointer.Offset)
+	assert.Nil(t, err)
+	assert.Equal(t, pointer2.Offset, pointer.Offset+blobFile.EntrySize(header))
+	header, err = blobFile.ReadBlobHeader(pointer2.Offset)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key2"), header.Key)
+	assert.Equal(t, uint32(1), header.Family)
+	assert.Equal(t, blobFile.WriteOff, pointer2.Offset+blobFile.EntrySize(header))
+	got, err = blobFile.ReadBlob(pointer2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("small"), got)
+	assert.Nil(t, blobFile.Close())
+}
+
+func TestBlobFile_Encryption_Tampered(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption-blob-tampered")
+	defer os.RemoveAll(dir)
+	provider := testKeyProvider{1: bytes.Repeat([]byte("k"), 16)}
+	value := bytes.Repeat([]byte("secret-blob-"), blobChunkSize/4)
+
+	blobFile, err := OpenBlobFile(dir, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, blobFile.SetEncryption(provider))
+	pointer, err := blobFile.WriteBlob([]byte("key"), 0, bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	assert.Nil(t, blobFile.Close())
+
+	// 修改第二块中的一个字节
+	file, err := os.OpenFile(GetBlobFileName(dir, 0), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte{0}, encryptionHeaderSize+blobChunkSize+100)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	blobFile, err = OpenBlobFile(dir, 0)
+	assert.Nil(t, err)
+	defer blobFile.Close()
+	assert.Nil(t, blobFile.SetEncryption(provider))
+	reader, err := blobFile.NewBlobReader(pointer)
+	assert.Nil(t, err)
+	// 第一块仍然可以读出，被修改的块在返回数据之前就校验失败
+	buf := make([]byte, blobChunkSize)
+	_, err = io.ReadFull(reader, buf[:blobChunkSize/2])
+	assert.Nil(t, err)
+	_, err = io.ReadFull(reader, buf)
+	assert.Equal(t, ErrInvalidCRC, err)
+}
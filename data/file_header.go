@@ -0,0 +1,126 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/youzeliang/rdb/fio"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+var (
+	ErrInvalidFileHeader        = errors.New("invalid data file header, the file maybe corrupted")
+	ErrPartialFileHeader        = errors.New("the file header is partially written")
+	ErrUnsupportedFormatVersion = errors.New("the data file was written by a newer format version")
+	ErrUnsupportedChecksum      = errors.New("the data file uses an unsupported checksum algorithm")
+)
+
+type ChecksumType = byte
+
+const (
+	ChecksumCRC32 ChecksumType = iota + 1 // crc32 IEEE
+)
+
+const (
+	// LegacyFormatVersion 没有文件头的旧版本数据文件
+	LegacyFormatVersion uint16 = 0
+
+	// CurrentFormatVersion 当前写入的数据文件格式版本，修改 EncodeLogRecord 的格式时需要递增
+	CurrentFormatVersion uint16 = 1
+)
+
+// 数据文件的文件头
+//
+//	+-------------+-------------+-------------+-------------+-------------+-------------+
+//	|    magic    |   version   |   checksum  |   reserved  |  created at |  crc 校验值  |
+//	+-------------+-------------+-------------+-------------+-------------+-------------+
+//	    4字节          2字节          1字节         1字节          8字节          4字节
+const FileHeaderSize = 4 + 2 + 1 + 1 + 8 + 4
+
+var fileHeaderMagic = []byte("RDBF")
+
+// FileHeader 数据文件的文件头，旧版本的数据文件没有文件头
+type FileHeader struct {
+	Version   uint16
+	Checksum  ChecksumType
+	CreatedAt time.Time
+}
+
+// NewFileHeader 当前格式的文件头
+func NewFileHeader(createdAt time.Time) *FileHeader {
+	return &FileHeader{Version: CurrentFormatVersion, Checksum: ChecksumCRC32, CreatedAt: createdAt}
+}
+
+// EncodeFileHeader 对文件头进行编码
+func EncodeFileHeader(header *FileHeader) []byte {
+	buf := make([]byte, FileHeaderSize)
+	copy(buf, fileHeaderMagic)
+	binary.LittleEndian.PutUint16(buf[4:6], header.Version)
+	buf[6] = header.Checksum
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(header.CreatedAt.UnixNano()))
+	binary.LittleEndian.PutUint32(buf[16:], crc32.ChecksumIEEE(buf[:16]))
+	return buf
+}
+
+// HasFileHeader 判断文件开头是否是文件头
+func HasFileHeader(buf []byte) bool {
+	return bytes.HasPrefix(buf, fileHeaderMagic)
+}
+
+// DecodeFileHeader 解析文件头，同时检查当前版本是否能够读取这个文件
+func DecodeFileHeader(buf []byte) (*FileHeader, error) {
+	if len(buf) < FileHeaderSize || !HasFileHeader(buf) {
+		return nil, ErrInvalidFileHeader
+	}
+	if binary.LittleEndian.Uint32(buf[16:]) != crc32.ChecksumIEEE(buf[:16]) {
+		return nil, ErrInvalidFileHeader
+	}
+	header := &FileHeader{
+		Version:   binary.LittleEndian.Uint16(buf[4:6]),
+		Checksum:  buf[6],
+		CreatedAt: time.Unix(0, int64(binary.LittleEndian.Uint64(buf[8:16]))),
+	}
+	if header.Version > CurrentFormatVersion {
+		return nil, ErrUnsupportedFormatVersion
+	}
+	if header.Checksum != ChecksumCRC32 {
+		return nil, ErrUnsupportedChecksum
+	}
+	return header, nil
+}
+
+// readFileHeader 读取数据文件的文件头，空文件返回一个新的文件头，在第一次写入时写到文件中
+// 旧版本的数据文件返回 nil
+func readFileHeader(ioManager fio.IOManager) (*FileHeader, bool, error) {
+	size, err := ioManager.Size()
+	if err != nil {
+		return nil, false, err
+	}
+	if size == 0 {
+		return NewFileHeader(time.Now()), false, nil
+	}
+
+	buf := make([]byte, FileHeaderSize)
+	n, err := ioManager.Read(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	buf = buf[:n]
+	if !HasFileHeader(buf) {
+		// 写了一半的文件头
+		if len(buf) < len(fileHeaderMagic) && bytes.HasPrefix(fileHeaderMagic, buf) {
+			return nil, false, ErrPartialFileHeader
+		}
+		return nil, false, nil
+	}
+	if len(buf) < FileHeaderSize {
+		return nil, false, ErrPartialFileHeader
+	}
+	header, err := DecodeFileHeader(buf)
+	if err != nil {
+		return nil, false, err
+	}
+	return header, true, nil
+}
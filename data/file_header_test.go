@@ -0,0 +1,59 @@
+package data
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/fio"
+	"hash/crc32"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileHeader(t *testing.T) {
+	now := time.Now()
+	buf := EncodeFileHeader(NewFileHeader(now))
+	assert.Equal(t, FileHeaderSize, len(buf))
+	assert.True(t, HasFileHeader(buf))
+
+	header, err := DecodeFileHeader(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, CurrentFormatVersion, header.Version)
+	assert.Equal(t, ChecksumCRC32, header.Checksum)
+	assert.Equal(t, now.UnixNano(), header.CreatedAt.UnixNano())
+
+	// 更新的版本无法读取
+	binary.LittleEndian.PutUint16(buf[4:6], CurrentFormatVersion+1)
+	binary.LittleEndian.PutUint32(buf[16:], crc32.ChecksumIEEE(buf[:16]))
+	_, err = DecodeFileHeader(buf)
+	assert.Equal(t, ErrUnsupportedFormatVersion, err)
+
+	buf[0] ^= 0xff
+	_, err = DecodeFileHeader(buf)
+	assert.Equal(t, ErrInvalidFileHeader, err)
+}
+
+func TestDataFile_Header(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-header")
+	defer os.RemoveAll(dir)
+
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	assert.Equal(t, CurrentFormatVersion, dataFile.FormatVersion())
+	encRecord, size := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("rdb")})
+	assert.Nil(t, dataFile.Write(encRecord))
+	assert.Equal(t, size, dataFile.WriteOff)
+	assert.Nil(t, dataFile.Close())
+
+	info, err := os.Stat(GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, FileHeaderSize+size, info.Size())
+
+	// 记录的位置不包括文件头
+	dataFile, err = OpenDataFile(dir, 0, fio.MemoryMap)
+	assert.Nil(t, err)
+	logRecord, _, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("rdb"), logRecord.Value)
+	assert.Nil(t, dataFile.Close())
+}
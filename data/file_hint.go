@@ -0,0 +1,75 @@
+package data
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/youzeliang/rdb/fio"
+	"path/filepath"
+)
+
+// FileHintSuffix 数据文件对应的 hint 文件的后缀，数据文件不再写入之后生成
+const FileHintSuffix = ".hint"
+
+// FileHint 数据文件中一条记录的 hint，启动时代替数据文件中的记录重建索引，不需要读取 value
+type FileHint struct {
+	Record          *LogRecord // 和数据文件中的记录相同，但是 value 为空
+	Pos             *Position  // 记录在数据文件中的位置
+	RawValueSize    int64      // value 解压之后的大小
+	StoredValueSize int64      // value 在磁盘上的大小
+}
+
+// EncodeFileHint 对 hint 进行编码，hint 作为一条 LogRecord 写入，key、类型、过期时间、列族和序列号与原记录相同
+//
+//	+---------------------+-------------------------+-------------+
+//	| raw value size 大小  |  stored value size 大小  |  position   |
+//	+---------------------+-------------------------+-------------+
+//	       变长                      变长                  变长
+func EncodeFileHint(hint *FileHint) []byte {
+	value := binary.AppendUvarint(nil, uint64(hint.RawValueSize))
+	value = binary.AppendUvarint(value, uint64(hint.StoredValueSize))
+	value = append(value, EncodeLogRecordPos(hint.Pos)...)
+	encRecord, _ := EncodeLogRecord(&LogRecord{
+		Key:          hint.Record.Key,
+		Value:        value,
+		Type:         hint.Record.Type,
+		Expire:       hint.Record.Expire,
+		ColumnFamily: hint.Record.ColumnFamily,
+		Seq:          hint.Record.Seq,
+		Blob:         hint.Record.Blob,
+	})
+	return encRecord
+}
+
+// DecodeFileHint 从 hint 文件中读出的记录解析 hint
+func DecodeFileHint(logRecord *LogRecord) (*FileHint, error) {
+	rawValueSize, n := binary.Uvarint(logRecord.Value)
+	if n <= 0 {
+		return nil, ErrInvalidSize
+	}
+	storedValueSize, m := binary.Uvarint(logRecord.Value[n:])
+	if m <= 0 || n+m >= len(logRecord.Value) {
+		return nil, ErrInvalidSize
+	}
+	return &FileHint{
+		Record: &LogRecord{
+			Key:          logRecord.Key,
+			Type:         logRecord.Type,
+			Expire:       logRecord.Expire,
+			ColumnFamily: logRecord.ColumnFamily,
+			Seq:          logRecord.Seq,
+			Blob:         logRecord.Blob,
+		},
+		Pos:             DecodeLogRecordPos(logRecord.Value[n+m:]),
+		RawValueSize:    int64(rawValueSize),
+		StoredValueSize: int64(storedValueSize),
+	}, nil
+}
+
+func GetFileHintName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+FileHintSuffix)
+}
+
+// OpenFileHint 打开数据文件对应的 hint 文件
+func OpenFileHint(dirPath string, fileId uint32) (*DataFile, error) {
+	return newDataFile(GetFileHintName(dirPath, fileId), fileId, fio.StandardFIO)
+}
@@ -0,0 +1,51 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestEncodeFileHint(t *testing.T) {
+	hints := []*FileHint{
+		{
+			Record:          &LogRecord{Key: []byte("name"), Type: LogRecordNormal, Seq: 10},
+			Pos:             &Position{Fid: 3, Offset: 100, Size: 30},
+			RawValueSize:    1024,
+			StoredValueSize: 300,
+		},
+		{
+			Record: &LogRecord{Key: []byte("name"), Type: LogRecordDeleted, ColumnFamily: 2, Seq: 11},
+			Pos:    &Position{Fid: 3, Offset: 130, Size: 12},
+		},
+		{
+			Record: &LogRecord{Key: []byte("blob"), Type: LogRecordNormal, Expire: 12345, Blob: true, Seq: 12},
+			Pos:    &Position{Fid: 3, Offset: 142, Size: 40, Expire: 12345, Blob: &BlobPointer{Fid: 1, Offset: 10, Size: 4096}},
+		},
+	}
+
+	dataFile, err := OpenFileHint(os.TempDir(), 4000)
+	assert.Nil(t, err)
+	defer os.Remove(GetFileHintName(os.TempDir(), 4000))
+	defer dataFile.Close()
+	for _, hint := range hints {
+		assert.Nil(t, dataFile.Write(EncodeFileHint(hint)))
+	}
+
+	var offset int64
+	for _, hint := range hints {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		decoded, err := DecodeFileHint(logRecord)
+		assert.Nil(t, err)
+		assert.Equal(t, hint, decoded)
+		offset += size
+	}
+}
+
+func TestDecodeFileHint_Invalid(t *testing.T) {
+	_, err := DecodeFileHint(&LogRecord{Key: []byte("name")})
+	assert.Equal(t, ErrInvalidSize, err)
+	_, err = DecodeFileHint(&LogRecord{Key: []byte("name"), Value: []byte{1, 2}})
+	assert.Equal(t, ErrInvalidSize, err)
+}
@@ -13,22 +13,44 @@ const (
 	LogRecordTxnFinished
 )
 
+// type 字节的低位存储 LogRecord 的类型，高位作为标志位，标识记录头部是否带有扩展字段
+// 旧版本写入的记录标志位都是 0，所以仍然可以正常解析
+const (
+	logRecordTypeMask   byte = 0x03
+	logRecordBlobFlag   byte = 0x04 // value 是指向 blob 文件的指针
+	logRecordFamilyFlag byte = 0x08 // 头部带有列族 id
+	logRecordSeqFlag    byte = 0x10 // 头部带有全局序列号
+	logRecordCodecMask  byte = 0x60 // value 使用的压缩算法
+	logRecordExpireFlag byte = 0x80 // 头部带有过期时间
+
+	logRecordCodecShift = 5
+)
+
 // 这里为什么是5个字节
 // 因为我们使用了变长编码，所以 key 和 value 的长度是变长的
 // 但是我们可以预估一个最大值，假设 key 和 value 的长度都不超过 2^32，那么 key 和 value 的长度最大就是 2^32
 // 所以 key 和 value 的长度最大就是 2^32，所以 key 和 value 的长度最大就是 5 个字节
 
-// crc          type   keySize valueSize
-// 4(uint32)  +  1  +  5   +   5 = 15
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+// crc          type   keySize valueSize expire family seq
+// 4(uint32)  +  1  +  5   +   5    +    10  +  5  +  10  = 40
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*3 + binary.MaxVarintLen64*2 + 5
 
 // LogRecord 写入到数据文件的记录
 
 // LogRecord 之所以叫日志，是因为数据文件中的数据是追加写入的，类似日志的格式
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType
+	Key    []byte
+	Value  []byte
+	Type   LogRecordType
+	Expire int64 // 过期时间，UnixNano，0 表示永不过期
+
+	ColumnFamily uint32 // 所属列族的 id，0 表示默认列族
+	Seq          uint64 // 全局递增的修改序列号，0 表示没有序列号
+	Blob         bool   // Value 是否是指向 blob 文件的指针
+
+	// 写入时 Value 已经使用该算法压缩过，读取时 Value 已经解压，表示磁盘上使用的算法
+	Compression     CompressionType
+	StoredValueSize int64 // 读取时压缩过的 value 在磁盘上的大小，没有压缩时为 0
 }
 
 type TransactionRecord struct {
@@ -42,6 +64,11 @@ type logRecordHeader struct {
 	recordType LogRecordType // 标识 LogRecord 的类型
 	keySize    uint32        // key 的长度
 	valueSize  uint32        // value 的长度
+	expire     int64         // 过期时间
+	family     uint32        // 列族 id
+	seq        uint64        // 全局序列号
+	blob       bool          // value 是否是 blob 指针
+	codec      byte          // value 使用的压缩算法
 }
 
 // Position 数据内存索引，主要是描述数据在磁盘上的位置
@@ -49,27 +76,56 @@ type Position struct {
 	Fid    uint32 // 文件id, 将文件存储的到了哪个文件夹
 	Offset int64  // 偏移，数据存储到了数据文件中的哪个位置
 	Size   uint32 // 标识数据在磁盘上的大小
+	Expire int64  // 过期时间，UnixNano，0 表示永不过期
+
+	Blob *BlobPointer // value 存储在 blob 文件中时指向它的位置，否则为 nil
+}
 
+// IsExpired 数据在 now 时刻是否已经过期
+func (pos *Position) IsExpired(now int64) bool {
+	return pos.Expire > 0 && pos.Expire <= now
 }
 
 // EncodeLogRecord 对 LogRecord 进行编码，返回字节数组及长度
 //
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	| crc 校验值  |  type 类型   |    key size |   value size |      key    |      value   |
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	    4字节          1字节        变长（最大5）   变长（最大5）     变长           变长
+//	+-------------+-------------+-------------+--------------+--------------+--------------+--------------+-------------+--------------+
+//	| crc 校验值  |  type 类型   |    key size |   value size |  expire 过期  |  family 列族  |  seq 序列号   |      key    |      value   |
+//	+-------------+-------------+-------------+--------------+--------------+--------------+--------------+-------------+--------------+
+//	    4字节          1字节        变长（最大5）   变长（最大5）  变长（可选）    变长（可选）    变长（可选）       变长           变长
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	// initializing a header with a fixed size
 	header := make([]byte, maxLogRecordHeaderSize)
 
-	// 第五个字节存储 Type
+	// 第五个字节存储 Type 及标志位
 	header[4] = logRecord.Type
+	if logRecord.Expire > 0 {
+		header[4] |= logRecordExpireFlag
+	}
+	if logRecord.ColumnFamily > 0 {
+		header[4] |= logRecordFamilyFlag
+	}
+	if logRecord.Seq > 0 {
+		header[4] |= logRecordSeqFlag
+	}
+	if logRecord.Blob {
+		header[4] |= logRecordBlobFlag
+	}
+	header[4] |= logRecord.Compression << logRecordCodecShift & logRecordCodecMask
 	var index = 5
 	// 5 字节之后，存储的是 key 和 value 的长度信息
 	// 使用变长类型，节省空间
 	// 这里递增，下一次就可以从新的位置开始存储了
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
+	if logRecord.Expire > 0 {
+		index += binary.PutVarint(header[index:], logRecord.Expire)
+	}
+	if logRecord.ColumnFamily > 0 {
+		index += binary.PutUvarint(header[index:], uint64(logRecord.ColumnFamily))
+	}
+	if logRecord.Seq > 0 {
+		index += binary.PutUvarint(header[index:], logRecord.Seq)
+	}
 
 	// the size of the entire LogRecord is the length of the header plus the length of the key and value
 	var size = index + len(logRecord.Key) + len(logRecord.Value)
@@ -98,21 +154,60 @@ func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 
 	header := &logRecordHeader{
 		crc:        binary.LittleEndian.Uint32(buf[:4]),
-		recordType: buf[4],
+		recordType: buf[4] & logRecordTypeMask,
+		blob:       buf[4]&logRecordBlobFlag != 0,
+		codec:      buf[4] & logRecordCodecMask >> logRecordCodecShift,
 	}
 
+	// 变长编码的字段不完整或者溢出时 n <= 0，说明数据已经损坏
 	var index = 5
 
 	// get the actual key size
 	keySize, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
 	header.keySize = uint32(keySize)
 	index += n
 
 	// get the actual value size
 	valueSize, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
 	header.valueSize = uint32(valueSize)
 	index += n
 
+	// get the expire time if it exists
+	if buf[4]&logRecordExpireFlag != 0 {
+		expire, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			return nil, 0
+		}
+		header.expire = expire
+		index += n
+	}
+
+	// get the column family if it exists
+	if buf[4]&logRecordFamilyFlag != 0 {
+		family, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			return nil, 0
+		}
+		header.family = uint32(family)
+		index += n
+	}
+
+	// get the sequence number if it exists
+	if buf[4]&logRecordSeqFlag != 0 {
+		seq, n := binary.Uvarint(buf[index:])
+		if n <= 0 {
+			return nil, 0
+		}
+		header.seq = seq
+		index += n
+	}
+
 	return header, int64(index)
 
 }
@@ -130,12 +225,20 @@ func getLogRecordCRC(logRecord *LogRecord, header []byte) uint32 {
 	return crc
 }
 
+// EncodeLogRecordPos 对位置信息进行编码，过期时间只在设置了的时候才写入
+// 带有 blob 指针时过期时间总是写入，blob 指针紧跟在后面
 func EncodeLogRecordPos(pos *Position) []byte {
-	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
+	buf := make([]byte, binary.MaxVarintLen32*3+binary.MaxVarintLen64*4)
 	var index = 0
 	index += binary.PutVarint(buf[index:], int64(pos.Fid))
 	index += binary.PutVarint(buf[index:], pos.Offset)
 	index += binary.PutVarint(buf[index:], int64(pos.Size))
+	if pos.Expire > 0 || pos.Blob != nil {
+		index += binary.PutVarint(buf[index:], pos.Expire)
+	}
+	if pos.Blob != nil {
+		index += copy(buf[index:], EncodeBlobPointer(pos.Blob))
+	}
 	return buf[:index]
 }
 
@@ -145,6 +248,15 @@ func DecodeLogRecordPos(buf []byte) *Position {
 	index += n
 	offset, n := binary.Varint(buf[index:])
 	index += n
-	size, _ := binary.Varint(buf[index:])
-	return &Position{Fid: uint32(fileId), Offset: offset, Size: uint32(size)}
+	size, n := binary.Varint(buf[index:])
+	index += n
+	pos := &Position{Fid: uint32(fileId), Offset: offset, Size: uint32(size)}
+	if index < len(buf) {
+		pos.Expire, n = binary.Varint(buf[index:])
+		index += n
+	}
+	if index < len(buf) {
+		pos.Blob = DecodeBlobPointer(buf[index:])
+	}
+	return pos
 }
@@ -150,3 +150,47 @@ func TestThreeNums(t *testing.T) {
 	res := getThreeSum(nums)
 	fmt.Println(res)
 }
+
+func TestEncodeLogRecord_Expire(t *testing.T) {
+	record := &LogRecord{
+		Key:    []byte("name"),
+		Value:  []byte("bitcask-kv-go"),
+		Type:   LogRecordNormal,
+		Expire: 1700000000000000000,
+	}
+	res, n := EncodeLogRecord(record)
+	h, size := decodeLogRecordHeader(res)
+	assert.Equal(t, LogRecordNormal, h.recordType)
+	assert.Equal(t, int64(1700000000000000000), h.expire)
+	assert.Equal(t, n, size+int64(len(record.Key)+len(record.Value)))
+	assert.Equal(t, h.crc, getLogRecordCRC(record, res[crc32.Size:size]))
+
+	pos := DecodeLogRecordPos(EncodeLogRecordPos(&Position{Fid: 1, Offset: 10, Size: 20, Expire: 30}))
+	assert.Equal(t, int64(30), pos.Expire)
+	pos = DecodeLogRecordPos(EncodeLogRecordPos(&Position{Fid: 1, Offset: 10, Size: 20}))
+	assert.Equal(t, int64(0), pos.Expire)
+	assert.Equal(t, uint32(20), pos.Size)
+	assert.Nil(t, pos.Blob)
+	pos = DecodeLogRecordPos(EncodeLogRecordPos(&Position{Fid: 1, Offset: 10, Size: 20, Blob: &BlobPointer{Fid: 2, Offset: 4096, Size: 1 << 30}}))
+	assert.Equal(t, int64(0), pos.Expire)
+	assert.Equal(t, &BlobPointer{Fid: 2, Offset: 4096, Size: 1 << 30}, pos.Blob)
+}
+
+func TestEncodeLogRecord_Seq(t *testing.T) {
+	record := &LogRecord{
+		Key:          []byte("name"),
+		Value:        []byte("bitcask-kv-go"),
+		Type:         LogRecordDeleted,
+		Expire:       1700000000000000000,
+		ColumnFamily: 3,
+		Seq:          1 << 40,
+	}
+	res, n := EncodeLogRecord(record)
+	h, size := decodeLogRecordHeader(res)
+	assert.Equal(t, LogRecordDeleted, h.recordType)
+	assert.Equal(t, int64(1700000000000000000), h.expire)
+	assert.Equal(t, uint32(3), h.family)
+	assert.Equal(t, uint64(1<<40), h.seq)
+	assert.Equal(t, n, size+int64(len(record.Key)+len(record.Value)))
+	assert.Equal(t, h.crc, getLogRecordCRC(record, res[crc32.Size:size]))
+}
@@ -15,11 +15,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
-	seqNoKey     = "seq.no"
-	fileLockName = "flock"
+	seqNoKey       = "seq.no"
+	changeSeqNoKey = "change.seq.no"
+	fileLockName   = "flock"
 )
 
 // DB represents a key-value storage engine instance.
@@ -37,6 +39,51 @@ type DB struct {
 	fileLock              *flock.Flock              // 文件锁
 	bytesWrittenSinceSync int                       // 当前累计写了多少个字节
 	reclaimSize           int64                     // 表示有多少数据是无效的
+	fileReclaimSize       map[uint32]int64          // 每个数据文件中无效的数据量
+	fileSeqRanges         map[uint32]seqRange       // 每个数据文件中修改序列号的范围，没有范围的文件读取修改时需要完整扫描
+	fileGeneration        uint64                    // 数据文件被 Compact 或者 merge 替换的次数，原子操作
+	pinLock               *sync.Mutex               // 保护 pinnedFiles 和 retiredFiles，持有读锁时也可以引用数据文件
+	pinnedFiles           map[*data.DataFile]int    // 被快照引用的数据文件及其引用计数
+	retiredFiles          map[*data.DataFile]bool   // 不再使用、等待快照释放后再关闭的数据文件
+	families              map[string]*ColumnFamily  // 所有的列族，包括默认列族
+	familyByID            map[uint32]*ColumnFamily  // 按 id 索引的列族
+	defaultFamily         *ColumnFamily             // 默认列族，使用的是 db.index
+	expiryIndex           *expiryHeap               // 过期索引，只在开启后台清理时使用
+	hasExpiringKeys       bool                      // 是否写入过带有过期时间的 key
+	closeCh               chan struct{}             // 关闭时通知后台任务退出
+	closeOnce             sync.Once
+	bgTasks               *sync.WaitGroup                      // 后台任务
+	pendingTxns           map[uint64][]*data.TransactionRecord // 重放数据文件时还没有读到完成标记的事务数据
+	secondary             bool                                 // 是否是跟随其他进程数据目录的从库
+	mergeMarker           time.Time                            // 加载索引时 merge 完成标记文件的修改时间
+	watchers              map[*Watcher]struct{}                // 所有的订阅者
+	seq                   uint64                               // 全局递增的修改序列号，每一次修改都会分配一个
+	cursors               map[string]uint64                    // 持久化的修改记录消费位置
+	appendTicket          uint64                               // 追加写入的编号，每追加一条记录递增
+	activeHints           fileHints                            // 活跃文件中每条记录编码之后的 hint，文件不再写入时写到 hint 文件中
+	fileHints             *fileHintWriter                      // 后台写入 hint 文件，不生成 hint 文件时为 nil
+	groupCommit           *groupCommit                         // 合并并发写入的 fsync
+	writeNeedSync         bool                                 // 当前持有互斥锁的写入是否需要等待持久化
+	syncedTicket          uint64                               // 已经持久化的最大写入编号，和 groupCommit 中的相同，由互斥锁保护
+	pendingIndex          []*pendingIndexOp                    // 按写入顺序等待生效的索引修改，需要持久化的写入在持久化之后才修改索引
+	pendingKeys           map[pendingIndexKey]*pendingIndexOp  // 每个 key 最后一次等待生效的修改
+	pendingEvents         []*pendingEvents                     // 等待持久化之后再发送的事件
+	syncErr               error                                // fsync 失败的错误，之后数据库不再接受写入
+	blobFiles             map[uint32]*data.BlobFile            // 存储大 value 的 blob 文件
+	activeBlobFile        *data.BlobFile                       // 当前写入的 blob 文件
+	blobWriteLock         *sync.Mutex                          // 写入 blob 文件时持有，不阻塞数据文件的读写
+	blobLock              *sync.RWMutex                        // 保护 blobFiles 以及 blob 文件的引用
+	blobLive              map[uint32]int64                     // 每个 blob 文件中仍然被索引引用的 value 大小
+	pinnedBlobs           map[*data.BlobFile]int               // 被快照或者 reader 引用的 blob 文件及其引用计数
+	retiredBlobs          map[uint32]*data.BlobFile            // 已经回收、等待引用释放后再删除的 blob 文件
+	isBlobGC              bool                                 // 是否正在回收 blob 文件
+	rawValueSize          int64                                // 写入以及重放的 value 压缩前的大小
+	storedValueSize       int64                                // 写入以及重放的 value 在磁盘上的大小
+	keyProvider           KeyProvider                          // 加密数据文件使用的密钥，没有开启加密时为 nil
+	recovery              RecoveryReport                       // 打开时处理损坏数据的情况
+	autoMergeRuns         uint                                 // 后台 merge 的次数
+	lastAutoMerge         AutoMergeResult                      // 最近一次后台 merge 的结果
+	mergeProgress         *MergeProgress                       // 正在进行的 merge 的进度
 }
 
 // Stat 存储引擎统计信息
@@ -45,6 +92,19 @@ type Stat struct {
 	DataFileNum     uint  // 数据文件的数量
 	ReclaimableSize int64 // 可以进行 merge 回收的数据量，字节为单位
 	DiskSize        int64 // 数据目录所占磁盘空间大小
+
+	BlobFileNum         uint  // blob 文件的数量
+	BlobReclaimableSize int64 // 可以通过 BlobGC 回收的数据量，字节为单位
+
+	CompressionRatio float64 // 本次打开以来写入以及重放的 value 压缩前后的大小之比，没有数据时为 1
+
+	AutoMergeRuns uint            // 本次打开以来后台 merge 的次数
+	LastAutoMerge AutoMergeResult // 最近一次后台 merge 的结果，还没有进行过时为零值
+
+	MergeProgress *MergeProgress // 正在进行的 merge 的进度，没有进行时为 nil
+
+	FileHintFailures  uint  // 本次打开以来写入 hint 文件失败的次数，失败时启动会重放对应的数据文件
+	LastFileHintError error // 最近一次写入 hint 文件失败的原因
 }
 
 // Open opens or creates a DB at the specified path with the given config.
@@ -55,19 +115,30 @@ func Open(configs Configs) (*DB, error) {
 	}
 
 	var isInitial bool
-	if err := os.MkdirAll(configs.DirPath, os.ModePerm); err != nil {
-		return nil, fmt.Errorf("failed to create directory: %v", err)
-	}
+	var fileLock *flock.Flock
+	// 只读模式下不创建目录，也不加文件锁，否则会和持有排他锁的写入进程冲突
+	if !configs.ReadOnly {
+		if err := os.MkdirAll(configs.DirPath, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %v", err)
+		}
 
-	// Check if database is already in use
-	fileLock := flock.New(filepath.Join(configs.DirPath, fileLockName))
-	hold, err := fileLock.TryLock()
-	if err != nil {
-		return nil, fmt.Errorf("failed to lock database: %v", err)
-	}
-	if !hold {
-		return nil, ErrDatabaseIsUsing
+		// Check if database is already in use
+		fileLock = flock.New(filepath.Join(configs.DirPath, fileLockName))
+		hold, err := fileLock.TryLock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock database: %v", err)
+		}
+		if !hold {
+			return nil, ErrDatabaseIsUsing
+		}
 	}
+	// 打开失败时释放文件锁，例如密钥不正确时可以换一个密钥重新打开
+	var opened bool
+	defer func() {
+		if !opened && fileLock != nil {
+			_ = fileLock.Unlock()
+		}
+	}()
 
 	entries, err := os.ReadDir(configs.DirPath)
 	if err != nil {
@@ -77,32 +148,75 @@ func Open(configs Configs) (*DB, error) {
 
 	// 初始化 DB 实例结构体
 	db := &DB{
-		config:        configs,
-		mutex:         new(sync.RWMutex),
-		archivedFiles: make(map[uint32]*data.DataFile),
-		index:         index.NewIndexer(configs.IndexType, configs.DirPath, configs.SyncWrites),
-		isInitial:     isInitial,
-		fileLock:      fileLock,
-	}
+		config:          configs,
+		mutex:           new(sync.RWMutex),
+		archivedFiles:   make(map[uint32]*data.DataFile),
+		pinLock:         new(sync.Mutex),
+		pinnedFiles:     make(map[*data.DataFile]int),
+		retiredFiles:    make(map[*data.DataFile]bool),
+		index:           index.NewIndexer(configs.IndexType, configs.DirPath, configs.SyncWrites),
+		isInitial:       isInitial,
+		fileLock:        fileLock,
+		closeCh:         make(chan struct{}),
+		bgTasks:         new(sync.WaitGroup),
+		pendingTxns:     make(map[uint64][]*data.TransactionRecord),
+		watchers:        make(map[*Watcher]struct{}),
+		cursors:         make(map[string]uint64),
+		groupCommit:     newGroupCommit(),
+		blobFiles:       make(map[uint32]*data.BlobFile),
+		blobWriteLock:   new(sync.Mutex),
+		blobLock:        new(sync.RWMutex),
+		blobLive:        make(map[uint32]int64),
+		fileReclaimSize: make(map[uint32]int64),
+		fileSeqRanges:   make(map[uint32]seqRange),
+		pinnedBlobs:     make(map[*data.BlobFile]int),
+		retiredBlobs:    make(map[uint32]*data.BlobFile),
+		keyProvider:     configs.keyProvider(),
+	}
+	if db.fileHintsEnabled() {
+		db.fileHints = newFileHintWriter()
+	}
+	if configs.ExpirySweepInterval > 0 && !configs.ReadOnly {
+		db.expiryIndex = new(expiryHeap)
+	}
+	db.defaultFamily = &ColumnFamily{db: db, id: defaultFamilyID, name: DefaultColumnFamily, indexType: configs.IndexType, index: db.index}
+	db.families = map[string]*ColumnFamily{DefaultColumnFamily: db.defaultFamily}
+	db.familyByID = map[uint32]*ColumnFamily{defaultFamilyID: db.defaultFamily}
 
 	// Load existing data
-	if err := db.loadMergeFiles(); err != nil {
-		return nil, fmt.Errorf("failed to load merge files: %v", err)
+	// 只读模式下不处理 merge 目录，未完成替换的 merge 结果留给写入进程处理
+	if !configs.ReadOnly {
+		if err := db.loadMergeFiles(); err != nil {
+			return nil, fmt.Errorf("failed to load merge files: %w", err)
+		}
 	}
 
 	if err := db.loadDataFiles(); err != nil {
-		return nil, fmt.Errorf("failed to load data files: %v", err)
+		return nil, fmt.Errorf("failed to load data files: %w", err)
+	}
+
+	if err := db.loadBlobFiles(); err != nil {
+		return nil, fmt.Errorf("failed to load blob files: %w", err)
+	}
+
+	if err := db.loadColumnFamilies(); err != nil {
+		return nil, fmt.Errorf("failed to load column families: %w", err)
+	}
+
+	if err := db.loadCursors(); err != nil {
+		return nil, fmt.Errorf("failed to load cursors: %w", err)
 	}
 
 	// Handle index loading based on index type
 	if configs.IndexType != BPlusTree {
 		if err := db.loadIndexFromHintFile(); err != nil {
-			return nil, fmt.Errorf("failed to load hint index: %v", err)
+			return nil, fmt.Errorf("failed to load hint index: %w", err)
 		}
 
 		if err := db.loadIndexFromDataFiles(); err != nil {
-			return nil, fmt.Errorf("failed to load data files index: %v", err)
+			return nil, fmt.Errorf("failed to load data files index: %w", err)
 		}
+		db.pruneReclaimSize()
 
 		if configs.MMapAtStartup {
 			if err := db.resetIoType(); err != nil {
@@ -117,35 +231,73 @@ func Open(configs Configs) (*DB, error) {
 			return nil, fmt.Errorf("failed to load sequence number: %v", err)
 		}
 		if db.activeFile != nil {
-			size, err := db.activeFile.IoManager.Size()
+			size, err := db.activeFile.Size()
 			if err != nil {
 				return nil, fmt.Errorf("failed to get active file size: %v", err)
 			}
 			db.activeFile.WriteOff = size
 		}
+		// 索引持久化在磁盘上，blob 文件的有效数据量需要遍历索引统计
+		db.loadBlobLive()
 	}
 
+	if db.expiryIndex != nil {
+		db.startExpirySweeper()
+	}
+	if configs.AutoMergeInterval > 0 && !configs.ReadOnly {
+		db.startAutoMerge()
+	}
+
+	opened = true
 	return db, nil
 }
 
 // Close 关闭数据库
 func (db *DB) Close() error {
 	defer func() {
-		_ = db.fileLock.Unlock()
+		if db.fileLock != nil {
+			_ = db.fileLock.Unlock()
+		}
 	}()
+	// 等待后台任务退出
+	db.closeOnce.Do(func() {
+		// 持有锁时关闭，保证之后持有锁的操作不会再启动新的后台任务
+		db.mutex.Lock()
+		close(db.closeCh)
+		db.mutex.Unlock()
+	})
+	db.bgTasks.Wait()
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	// 关闭索引之前让等待持久化的写入对索引的修改生效，失败时已经记录在 syncErr 中
+	_ = db.syncPendingLocked()
+	db.closeWatchers()
+
+	if err := db.closeBlobFiles(); err != nil {
+		return err
+	}
+
 	if db.activeFile == nil {
 		return nil
 	}
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
 
 	// 关闭索引
-	if err := db.index.Close(); err != nil {
-		return err
+	for _, cf := range db.familyByID {
+		if err := cf.index.Close(); err != nil {
+			return err
+		}
 	}
 
-	// 保存当前事务序列号
-	seqNoFile, err := data.OpenSeqNoFile(db.config.DirPath)
+	if db.config.ReadOnly {
+		return db.closeDataFiles()
+	}
+
+	// 保存当前事务序列号，旧的文件可能是使用轮换之前的密钥加密的，重新创建
+	if err := os.Remove(filepath.Join(db.config.DirPath, data.SeqNoFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	seqNoFile, err := db.encryptDataFile(data.OpenSeqNoFile(db.config.DirPath))
 	if err != nil {
 		return err
 	}
@@ -154,20 +306,34 @@ func (db *DB) Close() error {
 		Value: []byte(strconv.FormatUint(db.transactionID, 10)),
 	}
 	encRecord, _ := data.EncodeLogRecord(record)
+	changeSeqRecord := &data.LogRecord{
+		Key:   []byte(changeSeqNoKey),
+		Value: []byte(strconv.FormatUint(db.seq, 10)),
+	}
+	encChangeSeqRecord, _ := data.EncodeLogRecord(changeSeqRecord)
+	// 加密时每次写入的数据作为一条记录，所以分开写入
 	if err := seqNoFile.Write(encRecord); err != nil {
 		return fmt.Errorf("failed to write sequence number: %v", err)
 	}
+	if err := seqNoFile.Write(encChangeSeqRecord); err != nil {
+		return fmt.Errorf("failed to write sequence number: %v", err)
+	}
 	if err := seqNoFile.Sync(); err != nil {
 		return fmt.Errorf("failed to sync sequence number file: %v", err)
 	}
 
+	return db.closeDataFiles()
+}
+
+// closeDataFiles 关闭所有的数据文件，调用前必须持有互斥锁
+func (db *DB) closeDataFiles() error {
 	//	关闭当前活跃文件
-	if err := db.activeFile.Close(); err != nil {
+	if err := db.retireDataFile(db.activeFile); err != nil {
 		return fmt.Errorf("failed to close active file: %v", err)
 	}
 	// 关闭旧的数据文件
 	for _, file := range db.archivedFiles {
-		if err := file.Close(); err != nil {
+		if err := db.retireDataFile(file); err != nil {
 			return fmt.Errorf("failed to close data file: %v", err)
 		}
 	}
@@ -176,12 +342,19 @@ func (db *DB) Close() error {
 
 // ListKeys 获取数据库中所有的 key
 func (db *DB) ListKeys() [][]byte {
-	iterator := db.index.Iterator(false)
-	keys := make([][]byte, db.index.Size())
-	var idx int
+	return db.defaultFamily.ListKeys()
+}
+
+func listKeys(idx index.Indexer) [][]byte {
+	iterator := idx.Iterator(false)
+	defer iterator.Close()
+	keys := make([][]byte, 0, idx.Size())
+	now := time.Now().UnixNano()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		keys[idx] = iterator.Key()
-		idx++
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
+		keys = append(keys, iterator.Key())
 	}
 	return keys
 }
@@ -189,23 +362,79 @@ func (db *DB) ListKeys() [][]byte {
 // Put stores a key-value pair in the database.
 // If the key already exists, its previous value will be overwritten.
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.putWithExpire(key, value, 0)
+}
+
+// PutWithTTL stores a key-value pair that expires after the given ttl.
+// Expired keys are treated as missing and are dropped by the next merge.
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return db.putWithExpire(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// TTL returns the remaining time to live of the key, or -1 if the key never expires.
+// Returns ErrKeyNotFound if the key does not exist or has already expired.
+func (db *DB) TTL(key []byte) (time.Duration, error) {
+	if len(key) == 0 {
+		return 0, ErrKeyIsEmpty
+	}
+
+	db.mutex.RLock()
+	logRecordPos := db.index.Get(key)
+	db.mutex.RUnlock()
+	now := time.Now().UnixNano()
+	if logRecordPos == nil || logRecordPos.IsExpired(now) {
+		return 0, ErrKeyNotFound
+	}
+	if logRecordPos.Expire == 0 {
+		return -1, nil
+	}
+	return time.Duration(logRecordPos.Expire - now), nil
+}
+
+func (db *DB) putWithExpire(key []byte, value []byte, expire int64) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
 
-	logRecord := &data.LogRecord{
-		Key:   logRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Value: value,
-		Type:  data.LogRecordNormal,
+	logRecord, err := db.separateValue(db.defaultFamily, key, value)
+	if err != nil {
+		return err
 	}
+	logRecord.Expire = expire
+	return db.write(db.config.SyncWrites, func() error {
+		return db.putRecordLocked(db.defaultFamily, key, logRecord)
+	})
+}
 
-	pos, err := db.appendLogRecordWithLock(logRecord)
+// putRecordLocked 补全记录的 key、列族和序列号后写入，并更新内存索引，调用前必须持有互斥锁
+// 需要分离存储的 value 必须在获取互斥锁之前通过 separateValue 写到 blob 文件中
+func (db *DB) putRecordLocked(cf *ColumnFamily, key []byte, logRecord *data.LogRecord) error {
+	if db.config.ReadOnly {
+		return ErrReadOnly
+	}
+	value, blob := logRecord.Value, logRecord.Blob
+	db.seq++
+	logRecord.Key = logRecordKeyWithSeq(key, nonTransactionSeqNo)
+	logRecord.Type = data.LogRecordNormal
+	logRecord.ColumnFamily = cf.id
+	logRecord.Seq = db.seq
+
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return fmt.Errorf("failed to append log record: %v", err)
 	}
 
-	if oldPos := db.index.Put(key, pos); oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
+	oldPos := db.indexPut(cf.index, key, pos)
+	if oldPos != nil {
+		db.addReclaimSize(oldPos.Fid, int64(oldPos.Size))
+	}
+	db.trackBlob(pos, oldPos)
+	db.trackExpiry(cf.id, key, pos)
+	if len(db.watchers) > 0 {
+		db.publish([]*data.LogRecord{{Key: key, Value: value, Type: data.LogRecordNormal, Expire: logRecord.Expire, ColumnFamily: cf.id, Seq: logRecord.Seq, Blob: blob}})
 	}
 	return nil
 }
@@ -224,30 +453,48 @@ func (db *DB) Delete(key []byte) error {
 		return ErrKeyIsEmpty
 	}
 
+	return db.write(db.config.SyncWrites, func() error {
+		return db.deleteLocked(db.defaultFamily, key)
+	})
+}
+
+// deleteLocked 向列族中写入删除记录并更新内存索引，key 不存在时不做处理
+// 调用前必须持有互斥锁
+func (db *DB) deleteLocked(cf *ColumnFamily, key []byte) error {
+	if db.config.ReadOnly {
+		return ErrReadOnly
+	}
 	// Check if key exists
-	if pos := db.index.Get(key); pos == nil {
+	if pos := db.lookupIndex(cf.index, key); pos == nil {
 		return nil
 	}
 
 	// 构造 LogRecord 结构体,标识其是被删除的
+	db.seq++
 	logRecord := &data.LogRecord{
-		Key:  logRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Type: data.LogRecordDeleted,
+		Key:          logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Type:         data.LogRecordDeleted,
+		ColumnFamily: cf.id,
+		Seq:          db.seq,
 	}
 
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return fmt.Errorf("failed to append delete record: %v", err)
 	}
 
-	db.reclaimSize += int64(pos.Size)
+	db.addReclaimSize(pos.Fid, int64(pos.Size))
 
-	oldPos, ok := db.index.Delete(key)
+	oldPos, ok := db.indexDelete(cf.index, key)
 	if !ok {
 		return ErrIndexUpdateFailed
 	}
 	if oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
+		db.addReclaimSize(oldPos.Fid, int64(oldPos.Size))
+	}
+	db.trackBlob(nil, oldPos)
+	if len(db.watchers) > 0 {
+		db.publish([]*data.LogRecord{{Key: key, Type: data.LogRecordDeleted, ColumnFamily: cf.id, Seq: logRecord.Seq}})
 	}
 	return nil
 }
@@ -263,29 +510,43 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	defer db.mutex.RUnlock()
 
 	logRecordPos := db.index.Get(key)
-	if logRecordPos == nil {
+	if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
 		return nil, ErrKeyNotFound
 	}
 
 	return db.getValueByPosition(logRecordPos)
 }
 
-func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.Position, error) {
+// removeExpired 将已经过期的 key 从内存索引中删除，并计入可回收的数据量
+// 如果 key 在此期间已经被更新，则不做处理
+func (db *DB) removeExpired(family uint32, key []byte, pos *data.Position) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
-	return db.appendLogRecord(logRecord)
+	idx := db.indexFor(family)
+	if idx == nil || !samePosition(db.lookupIndex(idx, key), pos) {
+		return
+	}
+	if oldPos, _ := idx.Delete(key); oldPos != nil {
+		db.addReclaimSize(oldPos.Fid, int64(oldPos.Size))
+		db.trackBlob(nil, oldPos)
+	}
 }
 
 // appendLogRecord appends a log record to the active data file.
 // This method must be called with the write lock held.
 func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.Position, error) {
+	// fsync 失败之后数据文件中的内容不再可信，不能继续追加
+	if db.syncErr != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSyncFailed, db.syncErr)
+	}
 	if db.activeFile == nil {
 		if err := db.setActiveDataFile(); err != nil {
 			return nil, fmt.Errorf("failed to set active data file: %v", err)
 		}
 	}
 
-	encRecord, size := data.EncodeLogRecord(logRecord)
+	storedRecord := db.compressLogRecord(logRecord)
+	encRecord, size := data.EncodeLogRecord(storedRecord)
 
 	// Check if we need to rotate to a new data file
 	if db.activeFile.WriteOff+size > db.config.FileSize {
@@ -294,11 +555,8 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.Position, error)
 			return nil, fmt.Errorf("failed to sync active file: %v", err)
 		}
 
-		// Move current file to older files
-		db.archivedFiles[db.activeFile.FileId] = db.activeFile
-
-		// Create new active file
-		if err := db.setActiveDataFile(); err != nil {
+		// Move current file to older files and create new active file
+		if err := db.rotateActiveFile(); err != nil {
 			return nil, fmt.Errorf("failed to create new active file: %v", err)
 		}
 	}
@@ -307,27 +565,67 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.Position, error)
 	if err := db.activeFile.Write(encRecord); err != nil {
 		return nil, fmt.Errorf("failed to write log record: %v", err)
 	}
+	// 加密之后记录在磁盘上的大小会变化
+	size = db.activeFile.WriteOff - writeOff
 
 	db.bytesWrittenSinceSync += int(size)
+	db.appendTicket++
 
-	// Handle sync based on configuration
-	needSync := db.config.SyncWrites
-	if !needSync && db.config.BytesPerSync > 0 && db.bytesWrittenSinceSync >= db.config.BytesPerSync {
-		needSync = true
-	}
-
-	if needSync {
+	// 开启 SyncWrites 时由写入者在释放锁之后统一持久化，这里只处理 BytesPerSync
+	if db.config.BytesPerSync > 0 && db.bytesWrittenSinceSync >= db.config.BytesPerSync {
 		if err := db.activeFile.Sync(); err != nil {
 			return nil, fmt.Errorf("failed to sync file: %v", err)
 		}
 		db.bytesWrittenSinceSync = 0
 	}
 
-	return &data.Position{
+	pos := &data.Position{
 		Fid:    db.activeFile.FileId,
 		Offset: writeOff,
 		Size:   uint32(size),
-	}, nil
+		Expire: logRecord.Expire,
+	}
+	if logRecord.Blob {
+		pos.Blob = data.DecodeBlobPointer(logRecord.Value)
+	}
+
+	hint := &data.FileHint{Record: logRecord, Pos: pos}
+	if logRecord.Type == data.LogRecordNormal && !logRecord.Blob {
+		hint.RawValueSize = int64(len(logRecord.Value))
+		hint.StoredValueSize = int64(len(storedRecord.Value))
+	}
+	db.rawValueSize += hint.RawValueSize
+	db.storedValueSize += hint.StoredValueSize
+	db.trackFileSeq(pos.Fid, logRecord.Seq)
+	if db.fileHints != nil {
+		db.activeHints.add(hint)
+	}
+	return pos, nil
+}
+
+// compressLogRecord 使用配置的压缩算法压缩 value，返回实际写入的记录
+// 从数据文件中读出的记录 value 已经解压，merge 重写时会使用当前的算法重新压缩
+func (db *DB) compressLogRecord(logRecord *data.LogRecord) *data.LogRecord {
+	codec := data.CompressionType(db.config.Compression)
+	if logRecord.Type != data.LogRecordNormal || logRecord.Blob {
+		codec = data.CompressionNone
+	}
+	codec, value := data.CompressValue(codec, logRecord.Value)
+	if codec == data.CompressionNone && logRecord.Compression == data.CompressionNone {
+		return logRecord
+	}
+	storedRecord := *logRecord
+	storedRecord.Value = value
+	storedRecord.Compression = codec
+	return &storedRecord
+}
+
+// compressionRatio 计算压缩前后的大小之比
+func compressionRatio(rawSize, storedSize int64) float64 {
+	if storedSize == 0 {
+		return 1
+	}
+	return float64(rawSize) / float64(storedSize)
 }
 
 // 设置当前活跃文件
@@ -340,11 +638,12 @@ func (db *DB) setActiveDataFile() error {
 		initialFileId = db.activeFile.FileId + 1
 	}
 
-	dataFile, err := data.OpenDataFile(db.config.DirPath, initialFileId, fio.StandardFIO)
+	dataFile, err := db.encryptDataFile(data.OpenDataFile(db.config.DirPath, initialFileId, fio.StandardFIO))
 	if err != nil {
 		return err
 	}
 	db.activeFile = dataFile
+	db.beginFileSeq(dataFile.FileId)
 
 	return nil
 }
@@ -356,7 +655,11 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
+	now := time.Now().UnixNano()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
 		value, err := db.getValueByPosition(iterator.Value())
 		if err != nil {
 			return err
@@ -370,6 +673,10 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 
 // Sync 持久化数据文件
 func (db *DB) Sync() error {
+	if err := db.syncActiveBlobFile(); err != nil {
+		return err
+	}
+
 	if db.activeFile == nil {
 		return nil
 	}
@@ -393,24 +700,62 @@ func (db *DB) Stat() *Stat {
 		dataFiles++
 	}
 
+	var mergeProgress *MergeProgress
+	if db.mergeProgress != nil {
+		progress := *db.mergeProgress
+		mergeProgress = &progress
+	}
+
+	blobFiles, blobReclaimable := db.blobStat()
+	var hintFailures uint
+	var hintErr error
+	if db.fileHints != nil {
+		hintFailures, hintErr = db.fileHints.failures, db.fileHints.lastErr
+	}
 	return &Stat{
-		KeyNum:          uint(db.index.Size()),
-		DataFileNum:     dataFiles,
-		ReclaimableSize: db.reclaimSize,
-		DiskSize:        dirSize,
+		KeyNum:              db.liveKeyNum(db.index),
+		DataFileNum:         dataFiles,
+		ReclaimableSize:     db.reclaimSize,
+		DiskSize:            dirSize,
+		BlobFileNum:         blobFiles,
+		BlobReclaimableSize: blobReclaimable,
+		CompressionRatio:    compressionRatio(db.rawValueSize, db.storedValueSize),
+		AutoMergeRuns:       db.autoMergeRuns,
+		LastAutoMerge:       db.lastAutoMerge,
+		MergeProgress:       mergeProgress,
+		FileHintFailures:    hintFailures,
+		LastFileHintError:   hintErr,
 	}
 }
 
 // getValueByPosition retrieves a value from the data files using its position.
 func (db *DB) getValueByPosition(pos *data.Position) ([]byte, error) {
-	// Find the correct data file
-	var dataFile *data.DataFile
-	if db.activeFile.FileId == pos.Fid {
-		dataFile = db.activeFile
-	} else {
-		dataFile = db.archivedFiles[pos.Fid]
+	return db.readValueFromFile(db.dataFileByID(pos.Fid), pos)
+}
+
+// readLogRecordByPosition 根据位置信息读取数据文件中的记录
+func (db *DB) readLogRecordByPosition(pos *data.Position) (*data.LogRecord, error) {
+	dataFile := db.dataFileByID(pos.Fid)
+	if dataFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	logRecord, _, err := dataFile.ReadLogRecord(pos.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log record: %v", err)
 	}
+	return logRecord, nil
+}
+
+// dataFileByID 根据文件 id 获取活跃文件或者旧的数据文件
+func (db *DB) dataFileByID(fid uint32) *data.DataFile {
+	if db.activeFile != nil && db.activeFile.FileId == fid {
+		return db.activeFile
+	}
+	return db.archivedFiles[fid]
+}
 
+// readValueFromFile 从指定的数据文件中读取 value，value 存储在 blob 文件中时读取 blob 文件
+func (db *DB) readValueFromFile(dataFile *data.DataFile, pos *data.Position) ([]byte, error) {
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
 	}
@@ -425,29 +770,18 @@ func (db *DB) getValueByPosition(pos *data.Position) ([]byte, error) {
 		return nil, ErrKeyNotFound
 	}
 
+	if logRecord.Blob {
+		return db.readBlob(logRecord.Value)
+	}
 	return logRecord.Value, nil
 }
 
 // loadDataFiles loads all data files from the database directory.
 func (db *DB) loadDataFiles() error {
-	files, err := os.ReadDir(db.config.DirPath)
+	fileIds, err := getDataFileIds(db.config.DirPath)
 	if err != nil {
-		return fmt.Errorf("failed to read directory: %v", err)
-	}
-
-	var fileIds []int
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), data.DataFileNameSuffix) {
-			splitNames := strings.Split(file.Name(), ".")
-			fileId, err := strconv.Atoi(splitNames[0])
-			if err != nil {
-				return ErrDataDirectoryCorrupted
-			}
-			fileIds = append(fileIds, fileId)
-		}
+		return err
 	}
-
-	sort.Ints(fileIds)
 	db.dataFileIDs = fileIds
 
 	// Open all data files
@@ -457,9 +791,14 @@ func (db *DB) loadDataFiles() error {
 			ioType = fio.MemoryMap
 		}
 
-		dataFile, err := data.OpenDataFile(db.config.DirPath, uint32(fid), ioType)
+		dataFile, err := db.encryptDataFile(data.OpenDataFile(db.config.DirPath, uint32(fid), ioType))
+		// 活跃文件的文件头写了一半，说明还没有写入任何记录时发生了崩溃
+		if i == len(fileIds)-1 && errors.Is(err, data.ErrPartialFileHeader) &&
+			db.config.RecoveryMode != RecoveryFailHard && !db.config.ReadOnly {
+			dataFile, err = db.truncateTornHeader(uint32(fid), err)
+		}
 		if err != nil {
-			return fmt.Errorf("failed to open data file %d: %v", fid, err)
+			return fmt.Errorf("failed to open data file %d: %w", fid, err)
 		}
 
 		if i == len(fileIds)-1 {
@@ -472,6 +811,29 @@ func (db *DB) loadDataFiles() error {
 	return nil
 }
 
+// getDataFileIds 获取目录中所有数据文件的 id，按从小到大排序
+func getDataFileIds(dirPath string) ([]int, error) {
+	files, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %v", err)
+	}
+
+	var fileIds []int
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), data.DataFileNameSuffix) {
+			splitNames := strings.Split(file.Name(), ".")
+			fileId, err := strconv.Atoi(splitNames[0])
+			if err != nil {
+				return nil, ErrDataDirectoryCorrupted
+			}
+			fileIds = append(fileIds, fileId)
+		}
+	}
+
+	sort.Ints(fileIds)
+	return fileIds, nil
+}
+
 func (db *DB) loadIndexFromDataFiles() error {
 	// 没有文件，说明数据库是空的，直接返回
 	if len(db.dataFileIDs) == 0 {
@@ -481,99 +843,163 @@ func (db *DB) loadIndexFromDataFiles() error {
 	// 查看是否有过merge
 	hasMerge, nonMergeFileId := false, uint32(0)
 	mergeFileName := filepath.Join(db.config.DirPath, data.MergeFinishedFileName)
-	if _, err := os.Stat(mergeFileName); err == nil {
+	if info, err := os.Stat(mergeFileName); err == nil {
 		fid, err := db.getNonMergeFileId(db.config.DirPath)
 		if err != nil {
 			return err
 		}
 		hasMerge = true
 		nonMergeFileId = fid
-	}
+		db.mergeMarker = info.ModTime()
 
-	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.Position) {
-		var oldPos *data.Position
-		if typ == data.LogRecordDeleted {
-			oldPos, _ = db.index.Delete(key)
-			db.reclaimSize += int64(pos.Size)
-		} else {
-			oldPos = db.index.Put(key, pos)
+		// 参与 merge 的文件中被丢弃的记录也分配过序列号
+		mergedSeq, err := db.getMergedSeq(db.config.DirPath)
+		if err != nil {
+			return err
 		}
-		if oldPos != nil {
-			db.reclaimSize += int64(oldPos.Size)
+		if mergedSeq > db.seq {
+			db.seq = mergedSeq
 		}
 	}
 
-	// 暂存事务数据
-	transactionRecords := make(map[uint64][]*data.TransactionRecord)
-	var currentSeqNo = nonTransactionSeqNo
-
-	// 遍历所有的文件id，处理文件中的记录
-	for i, fid := range db.dataFileIDs {
+	// 不再写入的数据文件并行解析，按照文件 id 的顺序更新索引
+	var sealedFiles []*data.DataFile
+	for _, fid := range db.dataFileIDs {
 		var fileId = uint32(fid)
 		// 如果比最近未参与的merge文件id小，则说明已经从Hint文件中加载索引了
 		if hasMerge && fileId < nonMergeFileId {
 			continue
 		}
+		if fileId != db.activeFile.FileId {
+			sealedFiles = append(sealedFiles, db.archivedFiles[fileId])
+		}
+	}
+	if err := db.loadSealedDataFiles(sealedFiles); err != nil {
+		return err
+	}
 
-		var dataFile *data.DataFile
-		if fileId == db.activeFile.FileId {
-			dataFile = db.activeFile
+	// 最后重放活跃文件，并更新这个文件的 WriteOff
+	if !hasMerge || db.activeFile.FileId >= nonMergeFileId {
+		// 只读模式下写入进程可能正在追加数据，活跃文件末尾不完整的记录直接忽略，也不能修改文件
+		var offset int64
+		var err error
+		if db.config.ReadOnly {
+			offset, err = db.replayDataFile(db.activeFile, 0, true)
 		} else {
-			dataFile = db.archivedFiles[fileId]
+			offset, err = db.recoverDataFile(db.activeFile, true)
 		}
+		if err != nil {
+			return err
+		}
+		db.activeFile.WriteOff = offset
+	}
 
-		var offset int64 = 0
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
+	// 没有完成标记的事务数据是无效的，只读模式下保留，从库追赶时可能会读到完成标记
+	if !db.config.ReadOnly {
+		db.pendingTxns = make(map[uint64][]*data.TransactionRecord)
+	}
 
-			// 构造内存索引并保存
-			logRecordPos := &data.Position{Fid: fileId, Offset: offset, Size: uint32(size)}
-
-			// 解析 key，拿到事务序列号
-			realKey, seqNo := parseLogRecordKey(logRecord.Key)
-			if seqNo == nonTransactionSeqNo {
-				// 非事务操作，直接更新内存索引
-				updateIndex(realKey, logRecord.Type, logRecordPos)
-			} else {
-				// 事务完成，对应的 seq no 的数据可以更新到内存索引中
-				if logRecord.Type == data.LogRecordTxnFinished {
-					for _, txnRecord := range transactionRecords[seqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
-					}
-					delete(transactionRecords, seqNo)
-				} else {
-					logRecord.Key = realKey
-					transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
-						Record: logRecord,
-						Pos:    logRecordPos,
-					})
-				}
-			}
+	// 加密文件中记录的 nonce 和位置相关，截断之后不能在相同的位置写入新的数据，换一个新的活跃文件
+	if len(db.recovery.Truncated) > 0 && db.keyProvider != nil {
+		if err := db.rotateActiveFile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			// 更新事务序列号,防止在重启后拿到最新的序列号
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
+// replayDataFile 从指定的位置开始重放数据文件中的记录并更新内存索引，返回读取结束的位置
+// allowTornTail 为 true 时，遇到文件末尾写了一半的记录会停止读取而不是返回错误
+func (db *DB) replayDataFile(dataFile *data.DataFile, offset int64, allowTornTail bool) (int64, error) {
+	if offset == 0 {
+		db.beginFileSeq(dataFile.FileId)
+	}
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF || (allowTornTail && isTornTail(err)) {
+				return offset, nil
 			}
-
-			// 递增 offset，下一次从新的位置开始读取
-			offset += size
+			return offset, err
 		}
+		db.replayLogRecord(dataFile.FileId, logRecord, offset, size)
+
+		// 递增 offset，下一次从新的位置开始读取
+		offset += size
+	}
+}
+
+// replayLogRecord 重放数据文件中 offset 位置的一条记录
+func (db *DB) replayLogRecord(fid uint32, logRecord *data.LogRecord, offset int64, size int64) {
+	db.replayFileHint(newFileHint(fid, logRecord, offset, size))
+}
 
-		// 如果是当前活跃文件，更新这个文件的 WriteOff
-		if i == len(db.dataFileIDs)-1 {
-			db.activeFile.WriteOff = offset
+// replayFileHint 根据数据文件中一条记录的 hint 更新内存索引
+func (db *DB) replayFileHint(hint *data.FileHint) {
+	logRecord, logRecordPos := hint.Record, hint.Pos
+	db.rawValueSize += hint.RawValueSize
+	db.storedValueSize += hint.StoredValueSize
+	db.trackFileSeq(logRecordPos.Fid, logRecord.Seq)
+	// 重放活跃文件时同样需要记录 hint，文件不再写入时使用
+	if db.activeFile != nil && logRecordPos.Fid == db.activeFile.FileId && db.fileHints != nil {
+		db.activeHints.add(hint)
+	}
+
+	// 解析 key，拿到事务序列号
+	realKey, seqNo := parseLogRecordKey(logRecord.Key)
+	if seqNo == nonTransactionSeqNo {
+		// 非事务操作，直接更新内存索引
+		db.replayRecord(logRecord.ColumnFamily, realKey, logRecord.Type, logRecordPos)
+	} else {
+		// 事务完成，对应的 seq no 的数据可以更新到内存索引中
+		if logRecord.Type == data.LogRecordTxnFinished {
+			for _, txnRecord := range db.pendingTxns[seqNo] {
+				db.replayRecord(txnRecord.Record.ColumnFamily, txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
+			}
+			delete(db.pendingTxns, seqNo)
+		} else {
+			logRecord.Key = realKey
+			db.pendingTxns[seqNo] = append(db.pendingTxns[seqNo], &data.TransactionRecord{
+				Record: logRecord,
+				Pos:    logRecordPos,
+			})
 		}
 	}
 
-	// 更新事务序列号
-	db.transactionID = currentSeqNo
-	return nil
+	// 更新事务序列号,防止在重启后拿到最新的序列号
+	if seqNo > db.transactionID {
+		db.transactionID = seqNo
+	}
+	if logRecord.Seq > db.seq {
+		db.seq = logRecord.Seq
+	}
+}
+
+// replayRecord 根据重放的记录更新内存索引
+func (db *DB) replayRecord(family uint32, key []byte, typ data.LogRecordType, pos *data.Position) {
+	idx := db.indexFor(family)
+	var oldPos *data.Position
+	// 已经过期的数据和删除的数据一样处理，不存在的列族中的数据同样是无效的
+	if idx == nil {
+		db.addReclaimSize(pos.Fid, int64(pos.Size))
+	} else if typ == data.LogRecordDeleted || pos.IsExpired(time.Now().UnixNano()) {
+		oldPos, _ = idx.Delete(key)
+		db.addReclaimSize(pos.Fid, int64(pos.Size))
+	} else {
+		oldPos = idx.Put(key, pos)
+		db.trackExpiry(family, key, pos)
+		db.trackBlob(pos, nil)
+	}
+	if oldPos != nil {
+		db.addReclaimSize(oldPos.Fid, int64(oldPos.Size))
+		db.trackBlob(nil, oldPos)
+	}
+}
+
+// isTornTail 判断读取错误是否由文件末尾写了一半的记录导致
+func isTornTail(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, data.ErrInvalidCRC) || errors.Is(err, data.ErrInvalidSize)
 }
 
 func (db *DB) resetDataFileIoType() error {
@@ -604,14 +1030,15 @@ func (db *DB) resetDataFileIoType() error {
 func (db *DB) loadSeqNo() error {
 	fileName := filepath.Join(db.config.DirPath, data.SeqNoFileName)
 	if _, err := os.Stat(fileName); os.IsNotExist(err) {
-		return nil
+		// 没有正常关闭，从数据文件中恢复全局序列号
+		return db.recoverSeq()
 	}
 
-	seqNoFile, err := data.OpenSeqNoFile(db.config.DirPath)
+	seqNoFile, err := db.encryptDataFile(data.OpenSeqNoFile(db.config.DirPath))
 	if err != nil {
 		return err
 	}
-	record, _, err := seqNoFile.ReadLogRecord(0)
+	record, size, err := seqNoFile.ReadLogRecord(0)
 	seqNo, err := strconv.ParseUint(string(record.Value), 10, 64)
 	if err != nil {
 		return err
@@ -619,9 +1046,54 @@ func (db *DB) loadSeqNo() error {
 	db.transactionID = seqNo
 	db.seqNoFileExists = true
 
+	// 旧版本的文件中没有全局序列号
+	if record, _, err := seqNoFile.ReadLogRecord(size); err == nil {
+		changeSeq, err := strconv.ParseUint(string(record.Value), 10, 64)
+		if err != nil {
+			return err
+		}
+		db.seq = changeSeq
+	}
+	_ = seqNoFile.Close()
+
 	return os.Remove(fileName)
 }
 
+// recoverSeq 从最新的有记录的数据文件中读取最大的全局序列号
+// B+ 树索引启动时不重放数据文件，没有正常关闭时 seq 文件不存在，全局序列号不能从 0 重新开始
+func (db *DB) recoverSeq() error {
+	dataFiles := make([]*data.DataFile, 0, len(db.archivedFiles)+1)
+	if db.activeFile != nil {
+		dataFiles = append(dataFiles, db.activeFile)
+	}
+	for i := len(db.dataFileIDs) - 2; i >= 0; i-- {
+		dataFiles = append(dataFiles, db.archivedFiles[uint32(db.dataFileIDs[i])])
+	}
+
+	// 全局序列号按写入顺序递增，fid 最大的有记录的文件中包含最大的序列号
+	for _, dataFile := range dataFiles {
+		var offset int64
+		for {
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				// 读到文件末尾，或者文件末尾写了一半的记录
+				if isTornTail(err) {
+					break
+				}
+				return err
+			}
+			if logRecord.Seq > db.seq {
+				db.seq = logRecord.Seq
+			}
+			offset += size
+		}
+		if db.seq > 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
 // 将数据文件的 IO 类型设置为标准文件 IO
 func (db *DB) resetIoType() error {
 	if db.activeFile == nil {
@@ -649,5 +1121,45 @@ func checkOptions(configs Configs) error {
 	if configs.DataFileMergeRatio < 0 || configs.DataFileMergeRatio > 1 {
 		return errors.New("invalid merge ratio, must between 0 and 1")
 	}
+	if configs.ExpirySweepInterval > 0 && configs.ExpirySweepBatchSize <= 0 {
+		return errors.New("expiry sweep batch size must be greater than 0")
+	}
+	if configs.AutoMergeRatio < 0 || configs.AutoMergeRatio > 1 {
+		return errors.New("invalid auto merge ratio, must between 0 and 1")
+	}
+	if configs.AutoCompactFiles < 0 {
+		return errors.New("auto compact files must not be negative")
+	}
+	if configs.IndexLoadWorkers < 0 {
+		return errors.New("index load workers must not be negative")
+	}
+	if configs.AutoMergeInterval < 0 {
+		return errors.New("auto merge interval must not be negative")
+	}
+	if configs.Compression > LZCompression {
+		return errors.New("unknown compression type")
+	}
+	if configs.RecoveryMode < RecoveryTruncateTail || configs.RecoveryMode > RecoveryFailHard {
+		return errors.New("unknown recovery mode")
+	}
+	if configs.BlobThreshold < 0 {
+		return errors.New("blob threshold must not be negative")
+	}
+	if configs.BlobGCRatio < 0 || configs.BlobGCRatio > 1 {
+		return errors.New("invalid blob gc ratio, must between 0 and 1")
+	}
+	if configs.ReadOnly && configs.IndexType == BPlusTree {
+		return errors.New("read-only mode does not support the BPlusTree index")
+	}
+	if configs.KeyProvider != nil && len(configs.EncryptionKey) > 0 {
+		return errors.New("encryption key and key provider can not be set at the same time")
+	}
+	if n := len(configs.EncryptionKey); n > 0 && n != 16 && n != 24 && n != 32 {
+		return errors.New("invalid encryption key size, must be 16, 24 or 32 bytes")
+	}
+	// B+ 树索引的 key 直接存储在索引文件中，无法加密
+	if configs.keyProvider() != nil && configs.IndexType == BPlusTree {
+		return errors.New("encryption does not support the BPlusTree index")
+	}
 	return nil
 }
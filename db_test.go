@@ -1,9 +1,12 @@
 package rdb
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/data"
 	"github.com/youzeliang/rdb/utils"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -384,3 +387,197 @@ func TestDB_Backup(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, db2)
 }
+
+func TestDB_PutWithTTL(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(24), 0)
+	assert.Equal(t, ErrInvalidTTL, err)
+
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(24), time.Millisecond*50)
+	assert.Nil(t, err)
+	err = db.PutWithTTL(utils.GetTestKey(2), utils.RandomValue(24), time.Hour)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(3), utils.RandomValue(24))
+	assert.Nil(t, err)
+
+	ttl, err := db.TTL(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Minute*59 && ttl <= time.Hour)
+	ttl, err = db.TTL(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 过期之后读取不到
+	time.Sleep(time.Millisecond * 100)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.TTL(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 2, len(db.ListKeys()))
+	// 还没有被清理的过期 key 不计入 KeyNum
+	assert.Equal(t, uint(2), db.Stat().KeyNum)
+
+	var count int
+	iterator := db.NewIterator(DefaultIteratorConfigs)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		assert.NotEqual(t, utils.GetTestKey(1), iterator.Key())
+		count++
+	}
+	iterator.Close()
+	assert.Equal(t, 2, count)
+
+	// 重新 Put 之后过期时间被清除
+	err = db.Put(utils.GetTestKey(2), []byte("no ttl"))
+	assert.Nil(t, err)
+	ttl, err = db.TTL(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+
+	// 重启之后过期时间仍然有效
+	err = db.PutWithTTL(utils.GetTestKey(4), utils.RandomValue(24), time.Hour)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	ttl, err = db2.TTL(utils.GetTestKey(4))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Minute*59)
+	assert.True(t, db2.reclaimSize > 0)
+}
+
+func TestDB_OpenReadOnly(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-readonly")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	assert.Nil(t, db.Sync())
+
+	// 写入进程持有文件锁时仍然可以只读打开
+	roOpts := opts
+	roOpts.ReadOnly = true
+	roDB, err := Open(roOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(roDB.ListKeys()))
+	val, err := roDB.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	assert.Equal(t, ErrReadOnly, roDB.Put(utils.GetTestKey(1), []byte("a")))
+	assert.Equal(t, ErrReadOnly, roDB.Delete(utils.GetTestKey(1)))
+	assert.Equal(t, ErrReadOnly, roDB.Delete(utils.GetTestKey(1000)))
+	_, err = roDB.CompareAndSwap(utils.GetTestKey(1), nil, []byte("a"))
+	assert.Equal(t, ErrReadOnly, err)
+	_, err = roDB.Increment([]byte("counter"), 1)
+	assert.Equal(t, ErrReadOnly, err)
+	wb := roDB.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), []byte("a")))
+	assert.Equal(t, ErrReadOnly, wb.Commit())
+	_, err = roDB.CreateColumnFamily("users", DefaultColumnFamilyConfigs)
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Equal(t, ErrReadOnly, roDB.Merge())
+	assert.Nil(t, roDB.Close())
+
+	// 只读模式关闭时不会写入 seq-no 文件
+	_, err = os.Stat(filepath.Join(dir, data.SeqNoFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	// 不存在的目录不会被创建
+	roOpts.DirPath = dir + "-missing"
+	_, err = Open(roOpts)
+	assert.NotNil(t, err)
+	_, err = os.Stat(roOpts.DirPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDB_OpenReadOnly_TornTail(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-readonly-torn")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	assert.Nil(t, db.Sync())
+
+	// 模拟写入进程只写了一半的记录
+	file, err := os.OpenFile(data.GetDataFileName(dir, db.activeFile.FileId), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{0x12, 0x34, 0x56, 0x78, 0x00, 0x20, 0x40, 'k', 'e'})
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	roOpts := opts
+	roOpts.ReadOnly = true
+	roDB, err := Open(roOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(roDB.ListKeys()))
+	assert.Nil(t, roDB.Close())
+}
+
+func TestDB_Compression(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-compression")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte(`{"id":1,"name":"bitcask","tags":["kv","go"]},`), 20)
+	assert.Nil(t, db.Put(utils.GetTestKey(0), value))
+	uncompressed := db.activeFile.WriteOff
+	assert.Equal(t, float64(1), db.Stat().CompressionRatio)
+
+	// 切换压缩算法之后，旧的数据仍然可以读取
+	for _, codec := range []CompressionType{FlateCompression, LZCompression} {
+		assert.Nil(t, db.Close())
+		opts.Compression = codec
+		db, err = Open(opts)
+		assert.Nil(t, err)
+
+		offset := db.activeFile.WriteOff
+		assert.Nil(t, db.Put(utils.GetTestKey(int(codec)), value))
+		assert.True(t, db.activeFile.WriteOff-offset < uncompressed)
+		for i := 0; i <= int(codec); i++ {
+			read, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, value, read)
+		}
+		assert.True(t, db.Stat().CompressionRatio > 1)
+	}
+
+	// merge 使用当前的算法重新压缩旧的数据
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		pos := db.index.Get(utils.GetTestKey(i))
+		logRecord, err := db.readLogRecordByPosition(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, data.CompressionLZ, logRecord.Compression)
+		assert.Equal(t, value, logRecord.Value)
+	}
+}
@@ -0,0 +1,89 @@
+package rdb
+
+import (
+	"fmt"
+	"github.com/youzeliang/rdb/data"
+	"os"
+	"path/filepath"
+)
+
+// KeyProvider 提供加密数据文件使用的密钥
+type KeyProvider = data.KeyProvider
+
+// KeyRing 保存多个版本的密钥，新创建的文件使用 Current 对应的密钥
+// 轮换密钥时加入新的密钥并修改 Current，数据文件在 merge 之后、blob 文件在 BlobGC 之后使用新的密钥重写，
+// 两者都完成之后旧的密钥就不再需要了
+type KeyRing struct {
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+func (r *KeyRing) CurrentKey() (uint32, []byte, error) {
+	key, err := r.Key(r.Current)
+	return r.Current, key, err
+}
+
+func (r *KeyRing) Key(id uint32) ([]byte, error) {
+	key, ok := r.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %d not found", id)
+	}
+	return key, nil
+}
+
+// keyProvider 根据配置项获取密钥，没有开启加密时返回 nil
+func (configs *Configs) keyProvider() KeyProvider {
+	if configs.KeyProvider != nil {
+		return configs.KeyProvider
+	}
+	if len(configs.EncryptionKey) > 0 {
+		return &KeyRing{Keys: map[uint32][]byte{0: configs.EncryptionKey}}
+	}
+	return nil
+}
+
+// encryptDataFile 为打开的文件设置密钥，密钥不正确时关闭文件并返回错误
+func (db *DB) encryptDataFile(dataFile *data.DataFile, err error) (*data.DataFile, error) {
+	return encryptWith(db.keyProvider)(dataFile, err)
+}
+
+// encryptWith 返回使用 provider 为打开的文件设置密钥的函数，用于没有 DB 实例的场景
+func encryptWith(provider KeyProvider) func(*data.DataFile, error) (*data.DataFile, error) {
+	return func(dataFile *data.DataFile, err error) (*data.DataFile, error) {
+		if err != nil {
+			return nil, err
+		}
+		if err := dataFile.SetEncryption(provider); err != nil {
+			_ = dataFile.Close()
+			return nil, err
+		}
+		return dataFile, nil
+	}
+}
+
+// encryptBlobFile 为打开的 blob 文件设置密钥
+func (db *DB) encryptBlobFile(blobFile *data.BlobFile, err error) (*data.BlobFile, error) {
+	if err != nil {
+		return nil, err
+	}
+	if err := blobFile.SetEncryption(db.keyProvider); err != nil {
+		_ = blobFile.Close()
+		return nil, err
+	}
+	return blobFile, nil
+}
+
+// reencryptMetaFiles 使用当前的密钥重写游标和列族文件，调用前必须持有互斥锁
+func (db *DB) reencryptMetaFiles() error {
+	if _, err := os.Stat(filepath.Join(db.config.DirPath, data.CursorFileName)); err == nil {
+		if err := db.saveCursors(); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(db.config.DirPath, data.ColumnFamilyFileName)); err == nil {
+		if err := db.saveColumnFamilies(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
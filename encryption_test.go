@@ -0,0 +1,182 @@
+package rdb
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_Encryption(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	opts.EncryptionKey = bytes.Repeat([]byte("k"), 32)
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("plaintext-value")))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	assert.Nil(t, db.SetCursor("consumer", 10))
+	assert.Nil(t, db.Close())
+
+	// 数据文件中看不到明文
+	raw, err := os.ReadFile(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("plaintext-value")))
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	value, err := db.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("plaintext-value"), value)
+	seq, err := db.Cursor("consumer")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), seq)
+	assert.Nil(t, db.Close())
+
+	// 密钥不正确或者没有设置密钥时打开失败
+	wrongOpts := opts
+	wrongOpts.EncryptionKey = bytes.Repeat([]byte("x"), 32)
+	_, err = Open(wrongOpts)
+	assert.ErrorIs(t, err, ErrWrongEncryptionKey)
+
+	plainOpts := opts
+	plainOpts.EncryptionKey = nil
+	_, err = Open(plainOpts)
+	assert.ErrorIs(t, err, ErrEncryptionKeyRequired)
+
+	// 不支持的配置
+	badOpts := opts
+	badOpts.EncryptionKey = []byte("short")
+	_, err = Open(badOpts)
+	assert.NotNil(t, err)
+	badOpts = opts
+	badOpts.IndexType = BPlusTree
+	_, err = Open(badOpts)
+	assert.NotNil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+}
+
+func TestDB_Encryption_PlainDirectory(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption-plain")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(10)))
+	assert.Nil(t, db.Close())
+
+	encryptedOpts := opts
+	encryptedOpts.EncryptionKey = bytes.Repeat([]byte("k"), 16)
+	_, err = Open(encryptedOpts)
+	assert.ErrorIs(t, err, ErrFileNotEncrypted)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+}
+
+func TestDB_Encryption_KeyRotation(t *testing.T) {
+	key1 := bytes.Repeat([]byte("1"), 32)
+	key2 := bytes.Repeat([]byte("2"), 32)
+
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption-rotation")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.KeyProvider = &KeyRing{Current: 1, Keys: map[uint32][]byte{1: key1}}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	users, err := db.CreateColumnFamily("users", DefaultColumnFamilyConfigs)
+	assert.Nil(t, err)
+	assert.Nil(t, users.Put([]byte("alice"), []byte("admin")))
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	assert.Nil(t, db.SetCursor("consumer", 10))
+	assert.Nil(t, db.Close())
+
+	// 加入新的密钥，merge 时使用新的密钥重新加密
+	opts.KeyProvider = &KeyRing{Current: 2, Keys: map[uint32][]byte{1: key1, 2: key2}}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	// 新写入的数据文件使用新的密钥
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("rotated")))
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	// merge 之后不再需要旧的密钥
+	opts.KeyProvider = &KeyRing{Current: 2, Keys: map[uint32][]byte{2: key2}}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	value, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("rotated"), value)
+	_, err = db.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	users, err = db.ColumnFamily("users")
+	assert.Nil(t, err)
+	value, err = users.Get([]byte("alice"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("admin"), value)
+	seq, err := db.Cursor("consumer")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), seq)
+
+	_, err = os.Stat(filepath.Join(dir, data.HintFileName))
+	assert.Nil(t, err)
+}
+
+func TestDB_Encryption_KeyRotationBlob(t *testing.T) {
+	key0 := bytes.Repeat([]byte("0"), 32)
+	key1 := bytes.Repeat([]byte("1"), 32)
+
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption-rotation-blob")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.BlobThreshold = 64
+	opts.KeyProvider = &KeyRing{Current: 0, Keys: map[uint32][]byte{0: key0}}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(256)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 轮换密钥之后，BlobGC 使用新的密钥重写所有的 blob 文件，包括活跃的 blob 文件
+	opts.KeyProvider = &KeyRing{Current: 1, Keys: map[uint32][]byte{0: key0, 1: key1}}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.BlobGC())
+	assert.Nil(t, db.Close())
+
+	// merge 和 BlobGC 之后不再需要旧的密钥
+	opts.KeyProvider = &KeyRing{Current: 1, Keys: map[uint32][]byte{1: key1}}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		value, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, len(utils.RandomValue(256)), len(value))
+	}
+}
@@ -1,16 +1,44 @@
 package rdb
 
-import "errors"
+import (
+	"errors"
+	"github.com/youzeliang/rdb/data"
+)
 
 var (
-	ErrKeyIsEmpty             = errors.New("the key is empty")
-	ErrKeyNotFound            = errors.New("key not found in database")
-	ErrDataFileNotFound       = errors.New("data file is not found")
-	ErrDataDirectoryCorrupted = errors.New("the database directory maybe corrupted")
-	ErrIndexUpdateFailed      = errors.New("failed to update index")
-	ErrExceedMaxBatchNum      = errors.New("exceed the max batch num")
-	ErrMergeInProgress        = errors.New("merge is in progress, try again later")
-	ErrMergeRatioUnreached    = errors.New("the merge ratio do not reach the option")
-	ErrNoEnoughSpaceForMerge  = errors.New("no enough disk space for merge")
-	ErrDatabaseIsUsing        = errors.New("database directory is using by another process")
+	ErrKeyIsEmpty              = errors.New("the key is empty")
+	ErrKeyNotFound             = errors.New("key not found in database")
+	ErrDataFileNotFound        = errors.New("data file is not found")
+	ErrDataDirectoryCorrupted  = errors.New("the database directory maybe corrupted")
+	ErrIndexUpdateFailed       = errors.New("failed to update index")
+	ErrExceedMaxBatchNum       = errors.New("exceed the max batch num")
+	ErrMergeInProgress         = errors.New("merge is in progress, try again later")
+	ErrMergeRatioUnreached     = errors.New("the merge ratio do not reach the option")
+	ErrNoEnoughSpaceForMerge   = errors.New("no enough disk space for merge")
+	ErrDatabaseIsUsing         = errors.New("database directory is using by another process")
+	ErrTxnConflict             = errors.New("transaction conflict, the keys it read have been modified")
+	ErrInvalidTTL              = errors.New("the ttl must be greater than 0")
+	ErrSyncFailed              = errors.New("failed to sync data files, the database no longer accepts writes")
+	ErrValueNotInteger         = errors.New("the value is not an integer")
+	ErrIntegerOverflow         = errors.New("increment would overflow")
+	ErrColumnFamilyNameEmpty   = errors.New("the column family name is empty")
+	ErrColumnFamilyExists      = errors.New("column family already exists")
+	ErrColumnFamilyNotFound    = errors.New("column family not found")
+	ErrColumnFamilyUnsupported = errors.New("column families do not support the BPlusTree index")
+	ErrReadOnly                = errors.New("the database is opened in read-only mode")
+	ErrNotSecondary            = errors.New("the database is not a secondary instance")
+	ErrWatchOverflow           = errors.New("the watcher is closed because its buffer is full")
+	ErrCursorNameEmpty         = errors.New("the cursor name is empty")
+	ErrCursorNotFound          = errors.New("cursor not found")
+	ErrTxnFinished             = errors.New("transaction has already been committed or rolled back")
+	ErrInvalidValueSize        = errors.New("the value size must not be negative")
+	ErrBlobGCInProgress        = errors.New("blob gc is in progress, try again later")
+	ErrInvalidCompactConfigs   = errors.New("the max files of compaction must be greater than 0")
+	ErrInvalidMergeOptions     = errors.New("the merge rate limit must not be negative")
+	ErrRepairBPlusTreeIndex    = errors.New("cannot repair corrupted data files of a database using the BPlusTree index")
+	ErrFileHintMismatch        = errors.New("the hint file does not cover its data file")
+	ErrUpgradeRecordSize       = errors.New("the size of a re-encoded record changed, the data file cannot be upgraded in place")
+	ErrEncryptionKeyRequired   = data.ErrEncryptionKeyRequired
+	ErrWrongEncryptionKey      = data.ErrWrongEncryptionKey
+	ErrFileNotEncrypted        = data.ErrFileNotEncrypted
 )
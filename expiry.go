@@ -0,0 +1,147 @@
+package rdb
+
+import (
+	"container/heap"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/index"
+	"time"
+)
+
+// expiryItem 过期索引中的一项
+type expiryItem struct {
+	family uint32
+	key    []byte
+	expire int64
+}
+
+// expiryHeap 按过期时间排序的小顶堆
+// key 被覆盖或删除之后不会从堆中移除，弹出时再和内存索引比对
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expire < h[j].expire }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x any) {
+	*h = append(*h, x.(*expiryItem))
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// trackExpiry 将带有过期时间的 key 加入过期索引，未开启后台清理时只做记录
+// 调用前必须持有互斥锁
+func (db *DB) trackExpiry(family uint32, key []byte, pos *data.Position) {
+	if pos.Expire == 0 {
+		return
+	}
+	db.hasExpiringKeys = true
+	if db.expiryIndex == nil {
+		return
+	}
+	heap.Push(db.expiryIndex, &expiryItem{family: family, key: key, expire: pos.Expire})
+}
+
+// liveKeyNum 返回索引中没有过期的 key 的数量，没有写入过带有过期时间的 key 时直接返回索引的大小
+// 调用前必须持有互斥锁
+func (db *DB) liveKeyNum(idx index.Indexer) uint {
+	if !db.hasExpiringKeys {
+		return uint(idx.Size())
+	}
+	now := time.Now().UnixNano()
+	iterator := idx.Iterator(false)
+	defer iterator.Close()
+	var count uint
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if !iterator.Value().IsExpired(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// startExpirySweeper 启动后台清理过期数据的协程
+func (db *DB) startExpirySweeper() {
+	db.bgTasks.Add(1)
+	go func() {
+		defer db.bgTasks.Done()
+		ticker := time.NewTicker(db.config.ExpirySweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.closeCh:
+				return
+			case <-ticker.C:
+				// 一批写满说明可能还有过期的数据，继续清理
+				for db.sweepExpired() == db.config.ExpirySweepBatchSize {
+					select {
+					case <-db.closeCh:
+						return
+					default:
+					}
+				}
+			}
+		}
+	}()
+}
+
+// sweepExpired 为一批已经过期的 key 写入删除记录，返回写入的记录数量
+func (db *DB) sweepExpired() int {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	now := time.Now().UnixNano()
+	var count int
+	var expired []*data.LogRecord
+	for db.expiryIndex.Len() > 0 && count < db.config.ExpirySweepBatchSize {
+		item := (*db.expiryIndex)[0]
+		if item.expire > now {
+			break
+		}
+		heap.Pop(db.expiryIndex)
+
+		// 列族已经被删除，或者 key 已经被覆盖或者删除
+		idx := db.indexFor(item.family)
+		if idx == nil {
+			continue
+		}
+		logRecordPos := db.lookupIndex(idx, item.key)
+		if logRecordPos == nil || logRecordPos.Expire != item.expire {
+			continue
+		}
+
+		db.seq++
+		logRecord := &data.LogRecord{
+			Key:          logRecordKeyWithSeq(item.key, nonTransactionSeqNo),
+			Type:         data.LogRecordDeleted,
+			ColumnFamily: item.family,
+			Seq:          db.seq,
+		}
+		pos, err := db.appendLogRecord(logRecord)
+		if err != nil {
+			// 写入失败时放回堆中，等待下一次清理
+			heap.Push(db.expiryIndex, item)
+			break
+		}
+		db.addReclaimSize(pos.Fid, int64(pos.Size))
+		if oldPos, _ := db.indexDelete(idx, item.key); oldPos != nil {
+			db.addReclaimSize(oldPos.Fid, int64(oldPos.Size))
+			db.trackBlob(nil, oldPos)
+		}
+		if len(db.watchers) > 0 {
+			expired = append(expired, &data.LogRecord{Key: item.key, Type: data.LogRecordDeleted, ColumnFamily: item.family, Seq: logRecord.Seq})
+		}
+		count++
+	}
+	// 清理过期数据产生的删除事件
+	if len(expired) > 0 {
+		db.publish(expired)
+	}
+	return count
+}
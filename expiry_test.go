@@ -0,0 +1,97 @@
+package rdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_ExpirySweeper(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-expiry-sweep")
+	opts.DirPath = dir
+	// 间隔足够长，后台协程不会触发，测试中直接调用 sweepExpired
+	opts.ExpirySweepInterval = time.Hour
+	opts.ExpirySweepBatchSize = 10
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 直接写入已经过期的时间戳，不依赖真实的时间流逝
+	expired := time.Now().Add(-time.Minute).UnixNano()
+	for i := 0; i < 100; i++ {
+		err := db.putWithExpire(utils.GetTestKey(i), utils.RandomValue(128), expired)
+		assert.Nil(t, err)
+	}
+	// 被覆盖的 key 不会被清理
+	err = db.Put(utils.GetTestKey(1), []byte("no ttl"))
+	assert.Nil(t, err)
+	err = db.PutWithTTL(utils.GetTestKey(200), utils.RandomValue(128), time.Hour)
+	assert.Nil(t, err)
+
+	// 每一批最多清理 ExpirySweepBatchSize 个 key
+	assert.Equal(t, 10, db.sweepExpired())
+	for db.sweepExpired() == opts.ExpirySweepBatchSize {
+	}
+	assert.Equal(t, 0, db.sweepExpired())
+	assert.Equal(t, 2, db.index.Size())
+	stat := db.Stat()
+	assert.Equal(t, uint(2), stat.KeyNum)
+	assert.True(t, stat.ReclaimableSize > 0)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("no ttl"), val)
+
+	// 重启之后，写入的删除记录仍然有效
+	err = db.Close()
+	assert.Nil(t, err)
+	opts.ExpirySweepInterval = 0
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assert.Equal(t, 2, db2.index.Size())
+}
+
+func TestDB_ExpirySweeper_ColumnFamily(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-expiry-sweep-cf")
+	opts.DirPath = dir
+	opts.ExpirySweepInterval = time.Hour
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	cf, err := db.CreateColumnFamily("users", DefaultColumnFamilyConfigs)
+	assert.Nil(t, err)
+
+	expired := time.Now().Add(-time.Minute).UnixNano()
+	for i := 0; i < 10; i++ {
+		err := cf.putWithExpire(utils.GetTestKey(i), utils.RandomValue(128), expired)
+		assert.Nil(t, err)
+	}
+	// 默认列族中同名的 key 不受影响
+	err = db.Put(utils.GetTestKey(1), []byte("default"))
+	assert.Nil(t, err)
+	err = cf.PutWithTTL(utils.GetTestKey(100), utils.RandomValue(128), time.Hour)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 10, db.sweepExpired())
+	assert.Equal(t, 1, cf.index.Size())
+	assert.Equal(t, 1, db.index.Size())
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+
+	// 重启之后，列族中的删除记录仍然有效
+	err = db.Close()
+	assert.Nil(t, err)
+	opts.ExpirySweepInterval = 0
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	cf2, err := db2.ColumnFamily("users")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cf2.index.Size())
+}
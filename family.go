@@ -0,0 +1,274 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/index"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultColumnFamily 默认列族的名称，直接通过 DB 读写的数据都属于默认列族
+	DefaultColumnFamily = "default"
+
+	defaultFamilyID uint32 = 0
+)
+
+// ColumnFamily 列族，同一个数据目录下的独立 key 空间
+// 所有列族共享数据文件和 merge，每个列族拥有自己的内存索引
+type ColumnFamily struct {
+	db        *DB
+	id        uint32
+	name      string
+	indexType IndexerType
+	index     index.Indexer
+}
+
+// ColumnFamilyConfigs 列族配置项
+type ColumnFamilyConfigs struct {
+	// 索引类型，只支持内存索引
+	IndexType IndexerType
+}
+
+var DefaultColumnFamilyConfigs = ColumnFamilyConfigs{
+	IndexType: BTree,
+}
+
+// CreateColumnFamily 创建一个新的列族
+func (db *DB) CreateColumnFamily(name string, opts ColumnFamilyConfigs) (*ColumnFamily, error) {
+	if db.config.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if name == "" {
+		return nil, ErrColumnFamilyNameEmpty
+	}
+	// B+ 树索引在启动时不会重放数据文件，无法重建列族的索引
+	if db.config.IndexType == BPlusTree || opts.IndexType == BPlusTree {
+		return nil, ErrColumnFamilyUnsupported
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, ok := db.families[name]; ok {
+		return nil, ErrColumnFamilyExists
+	}
+
+	var id uint32
+	for fid := range db.familyByID {
+		if fid > id {
+			id = fid
+		}
+	}
+	id++
+
+	// 持久化列族信息
+	familyFile, err := db.encryptDataFile(data.OpenColumnFamilyFile(db.config.DirPath))
+	if err != nil {
+		return nil, err
+	}
+	defer familyFile.Close()
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   []byte(name),
+		Value: encodeColumnFamilyMeta(id, opts.IndexType),
+	})
+	if err := familyFile.Write(encRecord); err != nil {
+		return nil, err
+	}
+	if err := familyFile.Sync(); err != nil {
+		return nil, err
+	}
+
+	return db.addColumnFamily(id, name, opts.IndexType), nil
+}
+
+// ColumnFamily 根据名称获取列族
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	cf, ok := db.families[name]
+	if !ok {
+		return nil, ErrColumnFamilyNotFound
+	}
+	return cf, nil
+}
+
+// Name 列族的名称
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// Put 向列族中写入数据
+func (cf *ColumnFamily) Put(key []byte, value []byte) error {
+	return cf.putWithExpire(key, value, 0)
+}
+
+// PutWithTTL 向列族中写入在 ttl 之后过期的数据
+func (cf *ColumnFamily) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return cf.putWithExpire(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+func (cf *ColumnFamily) putWithExpire(key []byte, value []byte, expire int64) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	logRecord, err := cf.db.separateValue(cf, key, value)
+	if err != nil {
+		return err
+	}
+	logRecord.Expire = expire
+	return cf.db.write(cf.db.config.SyncWrites, func() error {
+		return cf.db.putRecordLocked(cf, key, logRecord)
+	})
+}
+
+// Get 读取列族中的数据
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	cf.db.mutex.RLock()
+	defer cf.db.mutex.RUnlock()
+
+	logRecordPos := cf.index.Get(key)
+	if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return cf.db.getValueByPosition(logRecordPos)
+}
+
+// Delete 删除列族中的数据
+func (cf *ColumnFamily) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	return cf.db.write(cf.db.config.SyncWrites, func() error {
+		return cf.db.deleteLocked(cf, key)
+	})
+}
+
+// NewIterator 创建列族的迭代器
+func (cf *ColumnFamily) NewIterator(opts IteratorConfigs) *Iterator {
+	// 先读取替换次数，保证索引迭代器中的位置不会比它更旧
+	generation := atomic.LoadUint64(&cf.db.fileGeneration)
+	cf.db.mutex.RLock()
+	indexIter := cf.index.Iterator(opts.Reverse)
+	cf.db.mutex.RUnlock()
+	return &Iterator{
+		db:         cf.db,
+		family:     cf,
+		generation: generation,
+		indexIter:  indexIter,
+		configs:    opts,
+	}
+}
+
+// ListKeys 获取列族中所有的 key
+func (cf *ColumnFamily) ListKeys() [][]byte {
+	cf.db.mutex.RLock()
+	idx := cf.index
+	cf.db.mutex.RUnlock()
+	return listKeys(idx)
+}
+
+// Stat 返回列族的统计信息，除 key 的数量之外，其余的数据由所有列族共享
+func (cf *ColumnFamily) Stat() *Stat {
+	stat := cf.db.Stat()
+	if stat != nil {
+		cf.db.mutex.RLock()
+		stat.KeyNum = cf.db.liveKeyNum(cf.index)
+		cf.db.mutex.RUnlock()
+	}
+	return stat
+}
+
+// addColumnFamily 在内存中注册列族
+func (db *DB) addColumnFamily(id uint32, name string, indexType IndexerType) *ColumnFamily {
+	cf := &ColumnFamily{
+		db:        db,
+		id:        id,
+		name:      name,
+		indexType: indexType,
+		index:     index.NewIndexer(indexType, db.config.DirPath, db.config.SyncWrites),
+	}
+	db.families[name] = cf
+	db.familyByID[id] = cf
+	return cf
+}
+
+// indexFor 获取列族对应的内存索引，列族不存在时返回 nil
+func (db *DB) indexFor(family uint32) index.Indexer {
+	cf, ok := db.familyByID[family]
+	if !ok {
+		return nil
+	}
+	return cf.index
+}
+
+// loadColumnFamilies 从列族文件中加载所有的列族
+func (db *DB) loadColumnFamilies() error {
+	fileName := filepath.Join(db.config.DirPath, data.ColumnFamilyFileName)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+
+	familyFile, err := db.encryptDataFile(data.OpenColumnFamilyFile(db.config.DirPath))
+	if err != nil {
+		return err
+	}
+	defer familyFile.Close()
+
+	var offset int64 = 0
+	for {
+		logRecord, size, err := familyFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		// 从库追赶时会重新加载，已经存在的列族不再重复创建
+		if _, ok := db.families[string(logRecord.Key)]; !ok {
+			id, indexType := decodeColumnFamilyMeta(logRecord.Value)
+			db.addColumnFamily(id, string(logRecord.Key), indexType)
+		}
+		offset += size
+	}
+	return nil
+}
+
+// saveColumnFamilies 重新写入所有的列族信息，调用前必须持有互斥锁
+func (db *DB) saveColumnFamilies() error {
+	var records [][]byte
+	for id, cf := range db.familyByID {
+		if id == defaultFamilyID {
+			continue
+		}
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+			Key:   []byte(cf.name),
+			Value: encodeColumnFamilyMeta(id, cf.indexType),
+		})
+		records = append(records, encRecord)
+	}
+	return db.replaceRecordFile(filepath.Join(db.config.DirPath, data.ColumnFamilyFileName), records)
+}
+
+func encodeColumnFamilyMeta(id uint32, indexType IndexerType) []byte {
+	buf := make([]byte, binary.MaxVarintLen32+1)
+	n := binary.PutUvarint(buf, uint64(id))
+	buf[n] = byte(indexType)
+	return buf[:n+1]
+}
+
+func decodeColumnFamilyMeta(buf []byte) (uint32, IndexerType) {
+	id, n := binary.Uvarint(buf)
+	return uint32(id), IndexerType(buf[n])
+}
@@ -0,0 +1,180 @@
+package rdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"testing"
+)
+
+func TestDB_CreateColumnFamily(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-cf")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	cf, err := db.CreateColumnFamily("users", DefaultColumnFamilyConfigs)
+	assert.Nil(t, err)
+	assert.Equal(t, "users", cf.Name())
+
+	_, err = db.CreateColumnFamily("users", DefaultColumnFamilyConfigs)
+	assert.Equal(t, ErrColumnFamilyExists, err)
+	_, err = db.CreateColumnFamily(DefaultColumnFamily, DefaultColumnFamilyConfigs)
+	assert.Equal(t, ErrColumnFamilyExists, err)
+	_, err = db.CreateColumnFamily("", DefaultColumnFamilyConfigs)
+	assert.Equal(t, ErrColumnFamilyNameEmpty, err)
+	_, err = db.CreateColumnFamily("tree", ColumnFamilyConfigs{IndexType: BPlusTree})
+	assert.Equal(t, ErrColumnFamilyUnsupported, err)
+
+	got, err := db.ColumnFamily("users")
+	assert.Nil(t, err)
+	assert.Equal(t, cf, got)
+	_, err = db.ColumnFamily("unknown")
+	assert.Equal(t, ErrColumnFamilyNotFound, err)
+}
+
+func TestColumnFamily_PutGetDelete(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-cf-put")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	users, err := db.CreateColumnFamily("users", DefaultColumnFamilyConfigs)
+	assert.Nil(t, err)
+	orders, err := db.CreateColumnFamily("orders", ColumnFamilyConfigs{IndexType: ART})
+	assert.Nil(t, err)
+
+	// 相同的 key 在不同的列族中互不影响
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("default")))
+	assert.Nil(t, users.Put(utils.GetTestKey(1), []byte("users")))
+	assert.Nil(t, orders.Put(utils.GetTestKey(1), []byte("orders")))
+
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+	val, err = users.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+	val, err = orders.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("orders"), val)
+
+	assert.Nil(t, users.Delete(utils.GetTestKey(1)))
+	_, err = users.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, orders.Put(utils.GetTestKey(i), utils.RandomValue(10)))
+	}
+	assert.Equal(t, 10, len(orders.ListKeys()))
+	assert.Equal(t, uint(10), orders.Stat().KeyNum)
+	assert.Equal(t, uint(1), db.Stat().KeyNum)
+
+	iter := orders.NewIterator(DefaultIteratorConfigs)
+	defer iter.Close()
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		_, err := iter.Value()
+		assert.Nil(t, err)
+		count++
+	}
+	assert.Equal(t, 10, count)
+}
+
+func TestColumnFamily_WriteBatch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-cf-batch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	users, err := db.CreateColumnFamily("users", DefaultColumnFamilyConfigs)
+	assert.Nil(t, err)
+	assert.Nil(t, users.Put(utils.GetTestKey(2), []byte("old")))
+
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), []byte("default")))
+	assert.Nil(t, wb.PutCF(users, utils.GetTestKey(1), []byte("users")))
+	assert.Nil(t, wb.DeleteCF(users, utils.GetTestKey(2)))
+	assert.Nil(t, wb.Commit())
+
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+	val, err = users.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+	_, err = users.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 重启之后批量写入的数据仍然属于各自的列族
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	users, err = db.ColumnFamily("users")
+	assert.Nil(t, err)
+	val, err = users.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+	_, err = users.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestColumnFamily_Reopen(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-cf-reopen")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	users, err := db.CreateColumnFamily("users", DefaultColumnFamilyConfigs)
+	assert.Nil(t, err)
+	orders, err := db.CreateColumnFamily("orders", ColumnFamilyConfigs{IndexType: ART})
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("default")))
+		assert.Nil(t, users.Put(utils.GetTestKey(i), []byte("users")))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, users.Delete(utils.GetTestKey(i)))
+		assert.Nil(t, orders.Put(utils.GetTestKey(i), []byte("orders")))
+	}
+
+	check := func(db *DB) {
+		users, err := db.ColumnFamily("users")
+		assert.Nil(t, err)
+		orders, err := db.ColumnFamily("orders")
+		assert.Nil(t, err)
+		assert.Equal(t, uint(1000), db.Stat().KeyNum)
+		assert.Equal(t, uint(500), users.Stat().KeyNum)
+		assert.Equal(t, uint(500), orders.Stat().KeyNum)
+		val, err := users.Get(utils.GetTestKey(600))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("users"), val)
+		val, err = orders.Get(utils.GetTestKey(100))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("orders"), val)
+	}
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+
+	// merge 之后从 hint 文件中加载索引
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+}
@@ -0,0 +1,231 @@
+package rdb
+
+import (
+	"fmt"
+	"github.com/youzeliang/rdb/data"
+	"io"
+	"os"
+	"sync"
+)
+
+// fileHintsEnabled 是否为不再写入的数据文件生成 hint 文件，B+ 树索引启动时不需要重放数据文件
+func (db *DB) fileHintsEnabled() bool {
+	return !db.config.ReadOnly && db.config.IndexType != BPlusTree
+}
+
+// newFileHint 根据数据文件中 offset 位置的记录生成 hint
+func newFileHint(fid uint32, logRecord *data.LogRecord, offset int64, size int64) *data.FileHint {
+	hint := &data.FileHint{
+		Record: logRecord,
+		Pos:    &data.Position{Fid: fid, Offset: offset, Size: uint32(size), Expire: logRecord.Expire},
+	}
+	if logRecord.Blob {
+		hint.Pos.Blob = data.DecodeBlobPointer(logRecord.Value)
+	} else if logRecord.Type == data.LogRecordNormal {
+		hint.RawValueSize = int64(len(logRecord.Value))
+		if logRecord.Compression != data.CompressionNone {
+			hint.StoredValueSize = logRecord.StoredValueSize
+		} else {
+			hint.StoredValueSize = int64(len(logRecord.Value))
+		}
+	}
+	return hint
+}
+
+// fileHints 活跃文件中每条记录编码之后的 hint，连续地存放在一个 buffer 中
+type fileHints struct {
+	buf  []byte
+	ends []uint32 // 每条 hint 在 buf 中结束的位置，加密时需要逐条写入
+}
+
+func (h *fileHints) add(hint *data.FileHint) {
+	h.buf = append(h.buf, data.EncodeFileHint(hint)...)
+	h.ends = append(h.ends, uint32(len(h.buf)))
+}
+
+// fileHintJob 一个不再写入的数据文件以及它的 hint
+type fileHintJob struct {
+	dataFile *data.DataFile
+	hints    fileHints
+}
+
+// fileHintWriter 在后台写入 hint 文件，除 wg 之外的字段由数据库的互斥锁保护
+// hint 文件只用于加快启动，写入失败时启动会重放数据文件，失败的次数和原因通过 Stat 获取
+type fileHintWriter struct {
+	pending  []*fileHintJob
+	running  bool            // 是否有协程正在写入，没有等待中的 hint 文件时协程退出
+	wg       *sync.WaitGroup // 还没有写完的 hint 文件
+	failures uint
+	lastErr  error
+}
+
+func newFileHintWriter() *fileHintWriter {
+	return &fileHintWriter{wg: new(sync.WaitGroup)}
+}
+
+// rotateActiveFile 将活跃文件转换为旧的数据文件并打开新的活跃文件，然后交给后台协程为旧的文件写入 hint 文件
+// 调用前必须持有互斥锁
+func (db *DB) rotateActiveFile() error {
+	sealed, hints := db.activeFile, db.activeHints
+	db.archivedFiles[sealed.FileId] = sealed
+	if err := db.setActiveDataFile(); err != nil {
+		return err
+	}
+	db.activeHints = fileHints{}
+	if db.fileHints == nil {
+		return nil
+	}
+	select {
+	case <-db.closeCh:
+		// 正在关闭，不再启动后台任务，启动时会重放这个数据文件
+		return nil
+	default:
+	}
+	db.fileHints.pending = append(db.fileHints.pending, &fileHintJob{dataFile: sealed, hints: hints})
+	db.fileHints.wg.Add(1)
+	if !db.fileHints.running {
+		db.fileHints.running = true
+		db.bgTasks.Add(1)
+		go db.writePendingFileHints()
+	}
+	return nil
+}
+
+// writePendingFileHints 写入所有等待中的 hint 文件，写完之后退出
+func (db *DB) writePendingFileHints() {
+	defer db.bgTasks.Done()
+	for {
+		db.mutex.Lock()
+		jobs := db.fileHints.pending
+		db.fileHints.pending = nil
+		if len(jobs) == 0 {
+			db.fileHints.running = false
+		}
+		db.mutex.Unlock()
+		if len(jobs) == 0 {
+			return
+		}
+		for _, job := range jobs {
+			db.writeFileHint(job)
+			db.fileHints.wg.Done()
+		}
+	}
+}
+
+// writeFileHint 将 hint 写到临时文件中，数据文件没有被 merge 或者 Compact 替换时再替换 hint 文件
+func (db *DB) writeFileHint(job *fileHintJob) {
+	fid := job.dataFile.FileId
+	fileName := data.GetFileHintName(db.config.DirPath, fid)
+	tmpFileName := fileName + ".tmp"
+	err := db.writeFileHintTmp(tmpFileName, job.hints)
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err == nil {
+		if db.archivedFiles[fid] != job.dataFile {
+			_ = os.Remove(tmpFileName)
+			return
+		}
+		err = os.Rename(tmpFileName, fileName)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFileName)
+		db.fileHints.failures++
+		db.fileHints.lastErr = fmt.Errorf("failed to write hint file of data file %d: %w", fid, err)
+	}
+}
+
+// writeFileHintTmp 将 hint 写到临时文件中，没有开启加密时一次写入
+func (db *DB) writeFileHintTmp(tmpFileName string, hints fileHints) error {
+	if err := os.Remove(tmpFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	file, err := db.encryptDataFile(data.OpenTmpFile(tmpFileName))
+	if err != nil {
+		return err
+	}
+	if db.keyProvider == nil {
+		err = file.Write(hints.buf)
+	} else {
+		// 加密时每次写入的数据作为一条记录，所以逐条写入
+		var start uint32
+		for _, end := range hints.ends {
+			if err = file.Write(hints.buf[start:end]); err != nil {
+				break
+			}
+			start = end
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readFileHint 读取数据文件的 hint 文件，hint 文件不存在或者和数据文件不一致时返回 false，需要读取数据文件
+// 使用 hint 文件时不会读取数据文件，所以只有 RecoveryTruncateTail 模式下才使用，其他模式需要检查每一条记录
+func (db *DB) readFileHint(dataFile *data.DataFile) ([]*data.FileHint, bool) {
+	if db.config.RecoveryMode != RecoveryTruncateTail {
+		return nil, false
+	}
+	fileName := data.GetFileHintName(db.config.DirPath, dataFile.FileId)
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, false
+	}
+	hintFile, err := db.encryptDataFile(data.OpenFileHint(db.config.DirPath, dataFile.FileId))
+	if err != nil {
+		return nil, false
+	}
+	defer hintFile.Close()
+	fileSize, err := dataFile.Size()
+	if err != nil {
+		return nil, false
+	}
+	hints, err := checkFileHint(hintFile, dataFile.FileId, fileSize)
+	if err != nil {
+		return nil, false
+	}
+	return hints, true
+}
+
+// checkFileHint 读取 fid 对应的 hint 文件，hint 必须连续地覆盖数据文件中 size 之前的全部记录
+func checkFileHint(hintFile *data.DataFile, fid uint32, size int64) ([]*data.FileHint, error) {
+	var hints []*data.FileHint
+	var offset, end int64
+	for {
+		logRecord, recordSize, err := hintFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return hints, err
+		}
+		hint, err := data.DecodeFileHint(logRecord)
+		if err != nil {
+			return hints, err
+		}
+		if hint.Pos.Fid != fid || hint.Pos.Offset != end {
+			return hints, fmt.Errorf("%w: hint at offset %d points to fid %d offset %d, expected offset %d",
+				ErrFileHintMismatch, offset, hint.Pos.Fid, hint.Pos.Offset, end)
+		}
+		hints = append(hints, hint)
+		end += int64(hint.Pos.Size)
+		offset += recordSize
+	}
+	if end != size {
+		return hints, fmt.Errorf("%w: hints cover %d bytes of the %d bytes data file", ErrFileHintMismatch, end, size)
+	}
+	return hints, nil
+}
+
+// removeFileHint 删除数据文件对应的 hint 文件，不存在时不做处理
+func removeFileHint(dirPath string, fid uint32) error {
+	if err := os.Remove(data.GetFileHintName(dirPath, fid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package rdb
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB_FileHint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-hint")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	opts.Compression = FlateCompression
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("value-value-value-value-value")))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(500), []byte("ttl"), time.Hour))
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	for i := 600; i < 700; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), []byte("batch")))
+	}
+	assert.Nil(t, wb.Commit())
+	for i := 2000; i < 3000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+
+	// 只有不再写入的数据文件有 hint 文件
+	db.fileHints.wg.Wait()
+	for fid := range db.archivedFiles {
+		_, err := os.Stat(data.GetFileHintName(dir, fid))
+		assert.Nil(t, err)
+	}
+	_, err = os.Stat(data.GetFileHintName(dir, db.activeFile.FileId))
+	assert.True(t, os.IsNotExist(err))
+	report, err := db.Verify(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+
+	before := db.Stat()
+	seq := db.LatestSeq()
+	check := func() {
+		for i := 0; i < 3000; i++ {
+			value, err := db.Get(utils.GetTestKey(i))
+			switch {
+			case i < 500:
+				assert.Equal(t, ErrKeyNotFound, err)
+			case i == 500:
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("ttl"), value)
+			case i >= 600 && i < 700:
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("batch"), value)
+			case i < 2000:
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("value-value-value-value-value"), value)
+			default:
+				assert.Nil(t, err)
+			}
+		}
+		stat := db.Stat()
+		assert.Equal(t, before.KeyNum, stat.KeyNum)
+		assert.Equal(t, before.ReclaimableSize, stat.ReclaimableSize)
+		assert.Equal(t, before.CompressionRatio, stat.CompressionRatio)
+		assert.Equal(t, seq, db.LatestSeq())
+	}
+
+	// 重新打开之后使用 hint 文件加载索引，结果和重放数据文件相同
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check()
+
+	// 不完整的 hint 文件会被忽略
+	assert.Nil(t, os.Truncate(data.GetFileHintName(dir, 1), 100))
+	assert.Nil(t, removeFileHint(dir, 2))
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check()
+
+	// 重新打开之后继续写入，活跃文件的 hint 包括打开之前写入的记录
+	activeFid := db.activeFile.FileId
+	for i := 3000; i < 4000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	assert.True(t, db.activeFile.FileId > activeFid)
+	assert.Nil(t, db.Close())
+	// 数据文件中的损坏不会被读取，说明使用了 hint 文件
+	fileName := data.GetDataFileName(dir, activeFid)
+	buf, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	buf[data.FileHeaderSize+10] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, buf, 0644))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 3000; i < 4000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+func TestDB_FileHint_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-hint-merge")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%500), utils.RandomValue(24)))
+	}
+	compacted, err := db.Compact(CompactConfigs{MaxFiles: 1, MinGarbageRatio: 0.5})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(compacted.Compacted))
+	_, err = os.Stat(data.GetFileHintName(dir, compacted.Compacted[0]))
+	assert.True(t, os.IsNotExist(err))
+
+	// merge 之后参与 merge 的文件都没有 hint 文件
+	assert.Nil(t, db.Merge())
+	for fid := range db.archivedFiles {
+		_, err := os.Stat(data.GetFileHintName(dir, fid))
+		assert.True(t, os.IsNotExist(err))
+	}
+	report, err := db.Verify(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+func TestDB_FileHint_WriteFailed(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-hint-failed")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 临时文件的位置被目录占用，hint 文件无法写入
+	assert.Nil(t, os.MkdirAll(filepath.Join(data.GetFileHintName(dir, 0)+".tmp", "sub"), os.ModePerm))
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	db.fileHints.wg.Wait()
+	assert.True(t, len(db.archivedFiles) > 1)
+
+	stat := db.Stat()
+	assert.Equal(t, uint(1), stat.FileHintFailures)
+	assert.NotNil(t, stat.LastFileHintError)
+	_, err = os.Stat(data.GetFileHintName(dir, 0))
+	assert.True(t, os.IsNotExist(err))
+	for fid := range db.archivedFiles {
+		if fid != 0 {
+			_, err := os.Stat(data.GetFileHintName(dir, fid))
+			assert.Nil(t, err)
+		}
+	}
+
+	// 没有 hint 文件的数据文件在启动时重放
+	assert.Nil(t, os.RemoveAll(data.GetFileHintName(dir, 0)+".tmp"))
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
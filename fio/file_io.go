@@ -46,3 +46,8 @@ func (fi *FileIO) Size() (int64, error) {
 	}
 	return stat.Size(), nil
 }
+
+// Truncate changes the size of the file.
+func (fi *FileIO) Truncate(size int64) error {
+	return fi.fd.Truncate(size)
+}
@@ -228,6 +228,26 @@ func TestFileIO_Sync(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestFileIO_Truncate(t *testing.T) {
+	h := setupTest(t)
+	defer h.tearDown()
+
+	_, err := h.fio.Write([]byte("test data"))
+	assert.Nil(t, err)
+	assert.Nil(t, h.fio.Truncate(4))
+	size, err := h.fio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), size)
+
+	// 截断之后继续追加写入
+	_, err = h.fio.Write([]byte("-more"))
+	assert.Nil(t, err)
+	b := make([]byte, 9)
+	_, err = h.fio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("test-more"), b)
+}
+
 func TestFileIO_Close(t *testing.T) {
 	h := setupTest(t)
 	defer h.tearDown()
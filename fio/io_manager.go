@@ -28,6 +28,9 @@ type IOManager interface {
 
 	// Size get the size of the file
 	Size() (int64, error)
+
+	// Truncate changes the size of the file, used to drop a torn tail.
+	Truncate(int64) error
 }
 
 // NewIOManager Initializes an IOManager
@@ -1,10 +1,14 @@
 package fio
 
 import (
+	"errors"
 	"golang.org/x/exp/mmap"
 	"os"
 )
 
+// ErrMMapTruncate mmap 打开的文件只能读取，不能截断
+var ErrMMapTruncate = errors.New("the memory-mapped file is read only and cannot be truncated")
+
 // MMap (Memory Map a File) IO type
 type MMap struct {
 	readerAt *mmap.ReaderAt
@@ -41,3 +45,7 @@ func (mmap *MMap) Close() error {
 func (mmap *MMap) Size() (int64, error) {
 	return int64(mmap.readerAt.Len()), nil
 }
+
+func (mmap *MMap) Truncate(int64) error {
+	return ErrMMapTruncate
+}
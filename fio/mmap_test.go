@@ -40,4 +40,7 @@ func TestMMap_Read(t *testing.T) {
 	n2, err := mmapIO2.Read(b2, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, 2, n2)
+
+	// mmap 打开的文件不能截断
+	assert.Equal(t, ErrMMapTruncate, mmapIO2.Truncate(2))
 }
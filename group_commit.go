@@ -0,0 +1,274 @@
+package rdb
+
+import (
+	"fmt"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/index"
+	"sync"
+)
+
+// groupCommit 将并发写入的 fsync 合并为一次
+// 写入者在持有互斥锁时追加记录，释放锁之后等待持久化，
+// 第一个等待的写入者成为 leader，一次 fsync 覆盖此前所有已经追加的记录，其余的写入者等待 leader 完成
+// 需要持久化的写入对索引的修改和产生的事件在持久化成功之后才按照写入的顺序生效，读取不会看到还没有持久化的写入；
+// 持久化失败时丢弃它们，数据库不再接受写入
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	syncing bool   // 是否有 leader 正在执行 fsync
+	synced  uint64 // 已经持久化的最大写入编号
+	err     error  // fsync 失败的错误，之后所有等待持久化的写入都会失败
+}
+
+// pendingIndexOp 还没有生效的一次索引修改，pos 为 nil 表示删除
+// needSync 为 true 时需要等待编号不大于 ticket 的写入持久化，为 false 时排在同一个 key 还没有生效的修改之后
+type pendingIndexOp struct {
+	ticket   uint64
+	needSync bool
+	idx      index.Indexer
+	key      []byte
+	pos      *data.Position
+}
+
+// pendingIndexKey 索引中的一个 key，不同列族的索引中相同的 key 互不影响
+type pendingIndexKey struct {
+	idx index.Indexer
+	key string
+}
+
+// pendingEvents 一次写入产生的等待发送的事件，needSync 为 true 时需要等待编号不大于 ticket 的写入持久化
+type pendingEvents struct {
+	ticket   uint64
+	needSync bool
+	records  []*data.LogRecord
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// write 在持有互斥锁的情况下执行 fn，needSync 为 true 时在释放锁之后等待 fn 追加的记录持久化
+func (db *DB) write(needSync bool, fn func() error) error {
+	db.mutex.Lock()
+	if db.syncErr != nil {
+		db.mutex.Unlock()
+		return fmt.Errorf("%w: %v", ErrSyncFailed, db.syncErr)
+	}
+	before := db.appendTicket
+	db.writeNeedSync = needSync
+	err := fn()
+	db.writeNeedSync = false
+	ticket := db.appendTicket
+	db.mutex.Unlock()
+
+	if err != nil || !needSync || ticket == before {
+		return err
+	}
+	return db.waitSync(ticket)
+}
+
+// waitSync 等待编号不大于 ticket 的写入全部持久化
+func (db *DB) waitSync(ticket uint64) error {
+	g := db.groupCommit
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for g.synced < ticket {
+		if g.err != nil {
+			return fmt.Errorf("%w: %v", ErrSyncFailed, g.err)
+		}
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+
+		// 成为 leader，持久化此前所有已经追加的记录
+		g.syncing = true
+		g.mu.Unlock()
+		target, err := db.syncAppended()
+		db.finishSync(target, err)
+		g.mu.Lock()
+		g.syncing = false
+		g.finish(target, err)
+	}
+	return nil
+}
+
+// finish 记录一次 fsync 的结果并唤醒等待的写入者，调用前必须持有 g.mu
+func (g *groupCommit) finish(target uint64, err error) {
+	if err != nil {
+		if g.err == nil {
+			g.err = err
+		}
+	} else if target > g.synced {
+		g.synced = target
+	}
+	g.cond.Broadcast()
+}
+
+// syncPendingLocked 在持有互斥锁的情况下持久化所有已经追加的记录，持久化失败或者之前已经失败时返回错误
+// 用于在替换或者关闭索引之前让等待中的修改生效，调用前必须持有互斥锁
+func (db *DB) syncPendingLocked() error {
+	if len(db.pendingIndex) > 0 {
+		target := db.appendTicket
+		err := db.syncActiveBlobFile()
+		if err == nil && db.activeFile != nil {
+			err = db.activeFile.Sync()
+		}
+		db.finishSyncLocked(target, err)
+
+		g := db.groupCommit
+		g.mu.Lock()
+		g.finish(target, err)
+		g.mu.Unlock()
+	}
+	if db.syncErr != nil {
+		return fmt.Errorf("%w: %v", ErrSyncFailed, db.syncErr)
+	}
+	return nil
+}
+
+// syncAppended 持久化当前活跃文件，返回此次持久化覆盖的最大写入编号
+// 切换活跃文件时旧的文件已经持久化过，所以只需要持久化当前的活跃文件
+func (db *DB) syncAppended() (uint64, error) {
+	db.mutex.RLock()
+	activeFile := db.activeFile
+	target := db.appendTicket
+	db.mutex.RUnlock()
+
+	// 先持久化 blob 文件，保证数据文件中的指针不会指向没有落盘的 value
+	if err := db.syncActiveBlobFile(); err != nil {
+		return target, err
+	}
+	if activeFile == nil {
+		return target, nil
+	}
+	return target, activeFile.Sync()
+}
+
+// finishSync 持久化完成之后让已经持久化的写入对索引的修改生效，并发送它们产生的事件
+// 持久化失败时丢弃所有还没有持久化的写入对索引的修改和事件，数据库不再接受写入
+func (db *DB) finishSync(target uint64, err error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.finishSyncLocked(target, err)
+}
+
+// finishSyncLocked 调用前必须持有互斥锁
+func (db *DB) finishSyncLocked(target uint64, err error) {
+	if err != nil {
+		if db.syncErr == nil {
+			db.syncErr = err
+		}
+		// 不需要持久化的写入已经返回成功，它们的修改仍然生效
+		for _, op := range db.pendingIndex {
+			if !op.needSync {
+				db.applyIndexOp(op)
+			}
+		}
+		db.pendingIndex = nil
+		db.pendingKeys = nil
+		for _, pending := range db.pendingEvents {
+			if !pending.needSync {
+				db.deliver(pending.records)
+			}
+		}
+		db.pendingEvents = nil
+		return
+	}
+
+	if target > db.syncedTicket {
+		db.syncedTicket = target
+	}
+	n := 0
+	for n < len(db.pendingIndex) {
+		op := db.pendingIndex[n]
+		if op.needSync && op.ticket > db.syncedTicket {
+			break
+		}
+		db.applyIndexOp(op)
+		db.pendingIndex[n] = nil
+		n++
+	}
+	db.pendingIndex = db.pendingIndex[n:]
+	db.flushEvents()
+}
+
+// applyIndexOp 将一次等待中的修改更新到索引中，调用前必须持有互斥锁
+func (db *DB) applyIndexOp(op *pendingIndexOp) {
+	if op.pos == nil {
+		_, _ = op.idx.Delete(op.key)
+	} else {
+		op.idx.Put(op.key, op.pos)
+	}
+	k := pendingIndexKey{idx: op.idx, key: string(op.key)}
+	if db.pendingKeys[k] == op {
+		delete(db.pendingKeys, k)
+	}
+}
+
+// queueIndexOp 将索引修改加入等待队列，调用前必须持有互斥锁
+func (db *DB) queueIndexOp(idx index.Indexer, key []byte, pos *data.Position) {
+	op := &pendingIndexOp{ticket: db.appendTicket, needSync: db.writeNeedSync, idx: idx, key: key, pos: pos}
+	if db.pendingKeys == nil {
+		db.pendingKeys = make(map[pendingIndexKey]*pendingIndexOp)
+	}
+	db.pendingKeys[pendingIndexKey{idx: idx, key: string(key)}] = op
+	db.pendingIndex = append(db.pendingIndex, op)
+}
+
+// lookupIndex 返回 key 包括还没有生效的修改在内的最新位置，写入时根据它判断 key 当前的状态
+// 调用前必须持有互斥锁
+func (db *DB) lookupIndex(idx index.Indexer, key []byte) *data.Position {
+	if op, ok := db.pendingKeys[pendingIndexKey{idx: idx, key: string(key)}]; ok {
+		return op.pos
+	}
+	return idx.Get(key)
+}
+
+// indexPut 更新索引，返回 key 原来的最新位置
+// 需要持久化的写入，以及 key 还有没有生效的修改的写入，先加入等待队列，按写入的顺序生效
+// 调用前必须持有互斥锁
+func (db *DB) indexPut(idx index.Indexer, key []byte, pos *data.Position) *data.Position {
+	if !db.writeNeedSync && !db.hasPendingIndex(idx, key) {
+		return idx.Put(key, pos)
+	}
+	oldPos := db.lookupIndex(idx, key)
+	db.queueIndexOp(idx, key, pos)
+	return oldPos
+}
+
+// indexDelete 从索引中删除 key，返回 key 原来的最新位置，等待的规则和 indexPut 相同
+// 调用前必须持有互斥锁
+func (db *DB) indexDelete(idx index.Indexer, key []byte) (*data.Position, bool) {
+	if !db.writeNeedSync && !db.hasPendingIndex(idx, key) {
+		return idx.Delete(key)
+	}
+	oldPos := db.lookupIndex(idx, key)
+	db.queueIndexOp(idx, key, nil)
+	return oldPos, true
+}
+
+// hasPendingIndex key 是否还有没有生效的修改，调用前必须持有互斥锁
+func (db *DB) hasPendingIndex(idx index.Indexer, key []byte) bool {
+	_, ok := db.pendingKeys[pendingIndexKey{idx: idx, key: string(key)}]
+	return ok
+}
+
+// flushEvents 按照写入的顺序发送等待中的事件，遇到还没有持久化的写入时停止
+// 调用前必须持有互斥锁
+func (db *DB) flushEvents() {
+	n := 0
+	for n < len(db.pendingEvents) {
+		pending := db.pendingEvents[n]
+		if pending.needSync && pending.ticket > db.syncedTicket {
+			break
+		}
+		db.deliver(pending.records)
+		db.pendingEvents[n] = nil
+		n++
+	}
+	db.pendingEvents = db.pendingEvents[n:]
+}
@@ -0,0 +1,176 @@
+package rdb
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/fio"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestDB_GroupCommit(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit")
+	opts.DirPath = dir
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := utils.GetTestKey(i*100 + j)
+				assert.Nil(t, db.Put(key, []byte("value")))
+				if j%10 == 0 {
+					assert.Nil(t, db.Delete(key))
+				}
+			}
+			wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+			assert.Nil(t, wb.Put([]byte("batch-"+string(utils.GetTestKey(i))), []byte("v")))
+			assert.Nil(t, wb.Commit())
+		}(i)
+	}
+	wg.Wait()
+
+	// 所有返回成功的写入都已经持久化
+	assert.Equal(t, db.appendTicket, db.groupCommit.synced)
+
+	// 没有写入时不需要等待持久化
+	ok, err := db.CompareAndSwap(utils.GetTestKey(1), []byte("not-match"), []byte("v"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 16*90+16, len(db.ListKeys()))
+}
+
+// failingSyncIOManager 写入正常，fsync 返回错误
+type failingSyncIOManager struct {
+	fio.IOManager
+}
+
+func (m *failingSyncIOManager) Sync() error {
+	return errors.New("injected fsync failure")
+}
+
+func TestDB_GroupCommit_SyncFailure(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit-fail")
+	opts.DirPath = dir
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("durable")))
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("durable")))
+	watcher := db.Watch(nil, DefaultWatchConfigs)
+	defer watcher.Close()
+
+	ioManager := db.activeFile.IoManager
+	db.activeFile.IoManager = &failingSyncIOManager{IOManager: ioManager}
+	defer func() { db.activeFile.IoManager = ioManager }()
+
+	err = db.Put(utils.GetTestKey(1), []byte("lost"))
+	assert.ErrorIs(t, err, ErrSyncFailed)
+	err = db.Put(utils.GetTestKey(3), []byte("lost"))
+	assert.ErrorIs(t, err, ErrSyncFailed)
+	err = db.Delete(utils.GetTestKey(2))
+	assert.ErrorIs(t, err, ErrSyncFailed)
+
+	// 没有持久化的写入不会修改索引，也不会发送事件
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("durable"), val)
+	_, err = db.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("durable"), val)
+	select {
+	case events := <-watcher.Events():
+		t.Fatalf("unexpected events: %v", events)
+	default:
+	}
+	assert.Equal(t, 0, len(db.pendingIndex))
+}
+
+// blockingSyncIOManager fsync 阻塞到 release 被关闭，然后返回 err
+type blockingSyncIOManager struct {
+	fio.IOManager
+	once    sync.Once
+	entered chan struct{}
+	release chan struct{}
+	err     error
+}
+
+func (m *blockingSyncIOManager) Sync() error {
+	m.once.Do(func() { close(m.entered) })
+	<-m.release
+	if m.err != nil {
+		return m.err
+	}
+	return m.IOManager.Sync()
+}
+
+func TestDB_GroupCommit_PendingIndex(t *testing.T) {
+	for name, syncErr := range map[string]error{"synced": nil, "failed": errors.New("injected fsync failure")} {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-group-commit-pending")
+			opts.DirPath = dir
+			db, err := Open(opts)
+			defer destroyDB(db)
+			assert.Nil(t, err)
+			assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("old")))
+
+			ioManager := db.activeFile.IoManager
+			blocking := &blockingSyncIOManager{IOManager: ioManager, entered: make(chan struct{}), release: make(chan struct{}), err: syncErr}
+			db.activeFile.IoManager = blocking
+			defer func() { db.activeFile.IoManager = ioManager }()
+
+			committed := make(chan error)
+			go func() {
+				wbOpts := DefaultWriteBatchConfigs
+				wbOpts.SyncWrites = true
+				wb := db.NewWriteBatch(wbOpts)
+				_ = wb.Put(utils.GetTestKey(1), []byte("sync"))
+				committed <- wb.Commit()
+			}()
+			<-blocking.entered
+
+			// 持久化之前读取不到需要持久化的写入
+			val, err := db.Get(utils.GetTestKey(1))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("old"), val)
+
+			// 之后的写入能看到它，并且排在它之后生效
+			ok, err := db.CompareAndSwap(utils.GetTestKey(1), []byte("sync"), []byte("later"))
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			val, err = db.Get(utils.GetTestKey(1))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("old"), val)
+
+			close(blocking.release)
+			if syncErr == nil {
+				assert.Nil(t, <-committed)
+			} else {
+				assert.ErrorIs(t, <-committed, ErrSyncFailed)
+			}
+			// 持久化失败时不需要持久化的写入仍然生效，不会被回滚覆盖
+			val, err = db.Get(utils.GetTestKey(1))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("later"), val)
+			assert.Equal(t, 0, len(db.pendingIndex))
+		})
+	}
+}
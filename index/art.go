@@ -68,6 +68,21 @@ func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
 	return iterator
 }
 
+// Clone 将当前所有的索引数据拷贝到一棵新的 ART 中
+func (art *AdaptiveRadixTree) Clone() Indexer {
+	art.lock.RLock()
+	defer art.lock.RUnlock()
+	tree := goart.New()
+	art.tree.ForEach(func(node goart.Node) bool {
+		tree.Insert(node.Key(), node.Value())
+		return true
+	})
+	return &AdaptiveRadixTree{
+		tree: tree,
+		lock: new(sync.RWMutex),
+	}
+}
+
 func (art *AdaptiveRadixTree) Close() error {
 	return nil
 }
@@ -79,11 +94,11 @@ type artIterator struct {
 	values    []*Item // key+位置索引信息
 }
 
-func (a artIterator) Rewind() {
+func (a *artIterator) Rewind() {
 	a.currIndex = 0
 }
 
-func (a artIterator) Seek(key []byte) {
+func (a *artIterator) Seek(key []byte) {
 	if a.reverse {
 		a.currIndex = sort.Search(len(a.values), func(i int) bool {
 			return bytes.Compare(a.values[i].key, key) <= 0
@@ -95,23 +110,23 @@ func (a artIterator) Seek(key []byte) {
 	}
 }
 
-func (a artIterator) Next() {
+func (a *artIterator) Next() {
 	a.currIndex += 1
 }
 
-func (a artIterator) Valid() bool {
+func (a *artIterator) Valid() bool {
 	return a.currIndex < len(a.values)
 }
 
-func (a artIterator) Key() []byte {
+func (a *artIterator) Key() []byte {
 	return a.values[a.currIndex].key
 }
 
-func (a artIterator) Value() *data.Position {
+func (a *artIterator) Value() *data.Position {
 	return a.values[a.currIndex].pos
 }
 
-func (a artIterator) Close() {
+func (a *artIterator) Close() {
 	a.values = nil
 }
 
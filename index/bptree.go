@@ -1,14 +1,22 @@
 package index
 
 import (
+	"encoding/binary"
 	"github.com/youzeliang/rdb/data"
 	"go.etcd.io/bbolt"
 	"path/filepath"
 )
 
-const indexFileName = "bptree-index"
+// BPlusTreeIndexFileName B+ 树索引在数据目录中的文件名
+const BPlusTreeIndexFileName = "bptree-index"
 
-var indexBucketName = []byte("bitcask-index")
+var (
+	indexBucketName = []byte("bitcask-index")
+	metaBucketName  = []byte("bitcask-meta")
+
+	// 最近一次已经应用到索引中的 merge 的标识
+	appliedMergeKey = []byte("applied-merge")
+)
 
 // BPlusTree B+树索引，将索引存储到磁盘上
 type BPlusTree struct {
@@ -20,7 +28,7 @@ func NewBPlusTree(dirPath string, sync bool) *BPlusTree {
 	// 打开 bbolt 实例
 	opts := bbolt.DefaultOptions
 	opts.NoSync = !sync
-	bptree, err := bbolt.Open(filepath.Join(dirPath, indexFileName), 0644, opts)
+	bptree, err := bbolt.Open(filepath.Join(dirPath, BPlusTreeIndexFileName), 0644, opts)
 	if err != nil {
 		panic("failed to open bptree at startup")
 	}
@@ -28,7 +36,10 @@ func NewBPlusTree(dirPath string, sync bool) *BPlusTree {
 	// 创建一个对应的 bucket
 	if err := bptree.Update(func(tx *bbolt.Tx) error {
 		// 这里是初始化阶段，其实是不需要bucket的返回的
-		_, err := tx.CreateBucketIfNotExists(indexBucketName)
+		if _, err := tx.CreateBucketIfNotExists(indexBucketName); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucketName)
 		return err
 	}); err != nil {
 		panic("failed to create bptree bucket at startup")
@@ -85,10 +96,73 @@ func (bpt *BPlusTree) Delete(key []byte) (*data.Position, bool) {
 	return data.DecodeLogRecordPos(oldVal), true
 }
 
+// ApplyMerge 在一个事务中将 merge 之后的位置写入索引，nonMergeFid 是没有参与 merge 的最小的文件 id
+// fn 对每个 merge 重写过的 key 调用 swap，只有 key 当前的位置仍然在参与 merge 的文件中时才会替换，返回被替换的旧位置
+// 已经应用过的 merge 会记录在索引中，重复应用同一次 merge 时不会调用 fn，返回 false
+func (bpt *BPlusTree) ApplyMerge(nonMergeFid uint32, fn func(swap func(key []byte, pos *data.Position) *data.Position) error) (bool, error) {
+	var applied bool
+	err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket(metaBucketName)
+		// 文件 id 只会增大，所以每次 merge 的 nonMergeFid 都比之前的大
+		if value := meta.Get(appliedMergeKey); len(value) == 4 && binary.LittleEndian.Uint32(value) >= nonMergeFid {
+			return nil
+		}
+
+		bucket := tx.Bucket(indexBucketName)
+		var putErr error
+		swap := func(key []byte, pos *data.Position) *data.Position {
+			value := bucket.Get(key)
+			if len(value) == 0 || putErr != nil {
+				return nil
+			}
+			oldPos := data.DecodeLogRecordPos(value)
+			if oldPos.Fid >= nonMergeFid {
+				return nil
+			}
+			if putErr = bucket.Put(key, data.EncodeLogRecordPos(pos)); putErr != nil {
+				return nil
+			}
+			return oldPos
+		}
+		if err := fn(swap); err != nil {
+			return err
+		}
+		if putErr != nil {
+			return putErr
+		}
+		applied = true
+		return meta.Put(appliedMergeKey, binary.LittleEndian.AppendUint32(nil, nonMergeFid))
+	})
+	return applied, err
+}
+
 func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
 	return newBptreeIterator(bpt.tree, reverse)
 }
 
+// Clone B+ 树的数据在磁盘上，长时间持有 bbolt 的读事务会阻塞写入时的扩容，
+// 所以这里将索引数据拷贝到内存中的 BTree 里
+func (bpt *BPlusTree) Clone() Indexer {
+	bt := NewBTree()
+	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(indexBucketName).ForEach(func(k, v []byte) error {
+			// bbolt 返回的 key 只在事务内有效，需要拷贝一份
+			key := make([]byte, len(k))
+			copy(key, k)
+			bt.Put(key, data.DecodeLogRecordPos(v))
+			return nil
+		})
+	}); err != nil {
+		panic("failed to clone bptree")
+	}
+	return bt
+}
+
+// Sync 将索引持久化到磁盘，关闭了 fsync 时事务提交之后的数据可能还没有落盘
+func (bpt *BPlusTree) Sync() error {
+	return bpt.tree.Sync()
+}
+
 func (bpt *BPlusTree) Close() error {
 	return bpt.tree.Close()
 }
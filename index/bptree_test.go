@@ -107,3 +107,37 @@ func TestBPlusTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter.Value())
 	}
 }
+
+func TestBPlusTree_Clone(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-clone")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPlusTree(path, false)
+	defer tree.Close()
+
+	tree.Put([]byte("aac"), &data.Position{Fid: 123, Offset: 999})
+	tree.Put([]byte("abc"), &data.Position{Fid: 123, Offset: 888})
+
+	cloned := tree.Clone()
+	tree.Delete([]byte("aac"))
+	assert.Equal(t, 2, cloned.Size())
+	assert.Equal(t, int64(999), cloned.Get([]byte("aac")).Offset)
+}
+
+func TestBPlusTree_Sync(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-sync")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPlusTree(path, false)
+	tree.Put([]byte("aac"), &data.Position{Fid: 123, Offset: 999})
+	assert.Nil(t, tree.Sync())
+	assert.Nil(t, tree.Close())
+
+	tree = NewBPlusTree(path, false)
+	defer tree.Close()
+	assert.Equal(t, int64(999), tree.Get([]byte("aac")).Offset)
+}
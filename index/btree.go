@@ -67,6 +67,16 @@ func (b *btreeIterator) Rewind() {
 	b.index = 0
 }
 
+// Clone 底层 BTree 采用写时复制，克隆的代价很小
+func (bt *BTree) Clone() Indexer {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return &BTree{
+		btree: bt.btree.Clone(),
+		lock:  new(sync.RWMutex),
+	}
+}
+
 func (bt *BTree) Close() error {
 	return nil
 }
@@ -105,6 +115,8 @@ func (b *btreeIterator) Close() {
 }
 
 func (bt *BTree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return bt.btree.Len()
 }
 
@@ -124,7 +136,9 @@ func (bt *BTree) Get(key []byte) *data.Position {
 		key: key,
 	}
 	// item 里的less方法是比较key的大小的规则
+	bt.lock.RLock()
 	btreeItem := bt.btree.Get(it)
+	bt.lock.RUnlock()
 	if btreeItem == nil {
 		return nil
 	}
@@ -94,3 +94,19 @@ func TestBTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter6.Key())
 	}
 }
+
+func TestBTree_Clone(t *testing.T) {
+	bt := NewBTree()
+	bt.Put([]byte("a"), &data.Position{Fid: 1, Offset: 10})
+	bt.Put([]byte("b"), &data.Position{Fid: 1, Offset: 20})
+
+	cloned := bt.Clone()
+	bt.Put([]byte("a"), &data.Position{Fid: 2, Offset: 30})
+	bt.Delete([]byte("b"))
+	bt.Put([]byte("c"), &data.Position{Fid: 2, Offset: 40})
+
+	assert.Equal(t, 2, cloned.Size())
+	assert.Equal(t, int64(10), cloned.Get([]byte("a")).Offset)
+	assert.Equal(t, int64(20), cloned.Get([]byte("b")).Offset)
+	assert.Nil(t, cloned.Get([]byte("c")))
+}
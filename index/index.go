@@ -22,6 +22,9 @@ type Indexer interface {
 	// Size 索引中的数据量
 	Size() int
 
+	// Clone 返回索引当前状态的副本，之后对原索引的修改不会影响副本
+	Clone() Indexer
+
 	Close() error
 }
 
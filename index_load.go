@@ -0,0 +1,131 @@
+package rdb
+
+import (
+	"github.com/youzeliang/rdb/data"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// dataFileLoad 一个不再写入的数据文件的解析结果
+type dataFileLoad struct {
+	dataFile  *data.DataFile
+	hints     []*data.FileHint
+	corrupted []CorruptRange
+	err       error
+	done      chan struct{} // 解析完成时关闭
+}
+
+// loadSealedDataFiles 使用 IndexLoadWorkers 个协程并行解析不再写入的数据文件，再按照文件 id 的顺序更新索引
+// 按顺序更新保证后写入的记录覆盖之前的记录，事务数据在读到完成标记之后才生效
+// 等待更新索引的文件数量不超过协程的数量，避免所有文件的记录都缓存在内存中
+func (db *DB) loadSealedDataFiles(dataFiles []*data.DataFile) error {
+	if len(dataFiles) == 0 {
+		return nil
+	}
+	workers := db.config.IndexLoadWorkers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(dataFiles) {
+		workers = len(dataFiles)
+	}
+
+	jobs := make(chan *dataFileLoad)
+	ordered := make(chan *dataFileLoad, workers)
+	stop := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	// 更新索引失败时通知还在解析的协程退出
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for load := range jobs {
+				load.hints, load.corrupted, load.err = db.parseDataFile(load.dataFile)
+				close(load.done)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		defer close(ordered)
+		for _, dataFile := range dataFiles {
+			load := &dataFileLoad{dataFile: dataFile, done: make(chan struct{})}
+			select {
+			case ordered <- load:
+			case <-stop:
+				return
+			}
+			select {
+			case jobs <- load:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for load := range ordered {
+		<-load.done
+		if load.err != nil {
+			return load.err
+		}
+		db.beginFileSeq(load.dataFile.FileId)
+		for _, hint := range load.hints {
+			db.replayFileHint(hint)
+		}
+		if err := db.recoverCorruptRanges(load.dataFile, load.corrupted, 0, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseDataFile 读取不再写入的数据文件中所有记录的 hint，有 hint 文件时直接读取 hint 文件
+// 在解析的协程中调用，不能修改数据库的状态
+func (db *DB) parseDataFile(dataFile *data.DataFile) ([]*data.FileHint, []CorruptRange, error) {
+	if hints, ok := db.readFileHint(dataFile); ok {
+		return hints, nil, nil
+	}
+
+	var hints []*data.FileHint
+	collect := func(logRecord *data.LogRecord, offset int64, size int64) error {
+		hints = append(hints, newFileHint(dataFile.FileId, logRecord, offset, size))
+		// 更新索引时不需要 value，不保留在内存中
+		// key 和 value 共用读取时的 buffer，拷贝 key 之后 buffer 才能被回收
+		logRecord.Key = append([]byte(nil), logRecord.Key...)
+		logRecord.Value = nil
+		return nil
+	}
+	// 只读模式下不处理损坏的数据
+	if db.config.ReadOnly {
+		var offset int64
+		for {
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err == io.EOF {
+				return hints, nil, nil
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			_ = collect(logRecord, offset, size)
+			offset += size
+		}
+	}
+
+	fileSize, err := dataFile.Size()
+	if err != nil {
+		return nil, nil, err
+	}
+	corrupted, err := scanDataFile(dataFile, fileSize, collect)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hints, corrupted, nil
+}
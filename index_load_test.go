@@ -0,0 +1,105 @@
+package rdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDB_ParallelIndexLoad(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-index-load")
+	opts.DirPath = dir
+	opts.FileSize = 16 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%1000), []byte(strconv.Itoa(i))))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	// 事务数据跨越多个数据文件
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	for i := 500; i < 1000; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), []byte("batch")))
+	}
+	assert.Nil(t, wb.Commit())
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(5000+i), utils.RandomValue(24)))
+	}
+	before := db.Stat()
+	seq := db.LatestSeq()
+	assert.Nil(t, db.Close())
+
+	// 删除 hint 文件，解析数据文件
+	hintFiles, err := filepath.Glob(filepath.Join(dir, "*"+data.FileHintSuffix))
+	assert.Nil(t, err)
+	assert.True(t, len(hintFiles) > 4)
+	for _, hintFile := range hintFiles[:len(hintFiles)/2] {
+		assert.Nil(t, os.Remove(hintFile))
+	}
+
+	for _, workers := range []int{1, 3, 16} {
+		opts.IndexLoadWorkers = workers
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		stat := db.Stat()
+		assert.Equal(t, before.KeyNum, stat.KeyNum)
+		assert.Equal(t, before.ReclaimableSize, stat.ReclaimableSize)
+		assert.Equal(t, seq, db.LatestSeq())
+		for i := 0; i < 1000; i++ {
+			value, err := db.Get(utils.GetTestKey(i))
+			switch {
+			case i < 100:
+				assert.Equal(t, ErrKeyNotFound, err)
+			case i < 500:
+				assert.Nil(t, err)
+				assert.Equal(t, []byte(strconv.Itoa(i+2000)), value)
+			default:
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("batch"), value)
+			}
+		}
+		assert.Nil(t, db.Close())
+	}
+
+	opts.IndexLoadWorkers = -1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+func TestDB_ParallelIndexLoad_Corrupted(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-index-load-corrupted")
+	opts.DirPath = dir
+	opts.FileSize = 16 * 1024
+	opts.IndexLoadWorkers = 4
+	opts.RecoveryMode = RecoveryFailHard
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	pos := corruptRecord(t, db, utils.GetTestKey(1000))
+	assert.Nil(t, db.Close())
+
+	// 解析失败时返回错误
+	_, err = Open(opts)
+	assert.ErrorIs(t, err, data.ErrInvalidCRC)
+
+	opts.RecoveryMode = RecoverySkipCorrupted
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	report := db.RecoveryReport()
+	assert.Equal(t, 1, len(report.Skipped))
+	assert.Equal(t, pos.Fid, report.Skipped[0].Fid)
+	assert.Equal(t, 1999, len(db.ListKeys()))
+}
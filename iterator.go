@@ -2,24 +2,25 @@ package rdb
 
 import (
 	"bytes"
+	"github.com/youzeliang/rdb/data"
 	"github.com/youzeliang/rdb/index"
+	"sync/atomic"
+	"time"
 )
 
 // Iterator 迭代器
 type Iterator struct {
-	indexIter index.Iterator // 索引迭代器
-	db        *DB
-	configs   IteratorConfigs
+	indexIter  index.Iterator // 索引迭代器
+	family     *ColumnFamily  // 迭代的列族，快照上的迭代器为 nil
+	generation uint64         // 创建时数据文件被替换的次数
+	db         *DB
+	snapshot   *Snapshot // 非空时表示在快照上进行遍历
+	configs    IteratorConfigs
 }
 
 // NewIterator 初始化迭代器
 func (db *DB) NewIterator(opts IteratorConfigs) *Iterator {
-	indexIter := db.index.Iterator(opts.Reverse)
-	return &Iterator{
-		db:        db,
-		indexIter: indexIter,
-		configs:   opts,
-	}
+	return db.defaultFamily.NewIterator(opts)
 }
 
 // Rewind 重新回到迭代器的起点，即第一个数据
@@ -52,22 +53,39 @@ func (it *Iterator) Close() {
 
 // Value 当前遍历位置的 Value 数据
 func (it *Iterator) Value() ([]byte, error) {
-	logRecordPos := it.indexIter.Value()
+	if it.snapshot != nil {
+		return it.snapshot.getValueByPosition(it.indexIter.Value())
+	}
 	it.db.mutex.RLock()
 	defer it.db.mutex.RUnlock()
+	logRecordPos := it.position()
+	if logRecordPos == nil {
+		return nil, ErrKeyNotFound
+	}
 	return it.db.getValueByPosition(logRecordPos)
 }
 
-func (it *Iterator) skipToNext() {
+// position 当前遍历位置的数据在数据文件中的位置，调用前必须持有读锁
+func (it *Iterator) position() *data.Position {
+	// 数据文件在创建迭代器之后已经被 Compact 或者 merge 替换，记录被重写到了新的位置
+	// merge 会替换列族的索引，所以从列族当前的索引中查找
+	if it.snapshot == nil && it.generation != atomic.LoadUint64(&it.db.fileGeneration) {
+		return it.family.index.Get(it.indexIter.Key())
+	}
+	return it.indexIter.Value()
+}
 
+// skipToNext 跳过不满足前缀条件以及已经过期的 key
+func (it *Iterator) skipToNext() {
 	preLen := len(it.configs.Prefix)
-	if preLen == 0 {
-		return
-	}
+	now := time.Now().UnixNano()
 
 	for ; it.indexIter.Valid(); it.indexIter.Next() {
+		if it.indexIter.Value().IsExpired(now) {
+			continue
+		}
 		key := it.indexIter.Key()
-		if preLen <= len(key) && bytes.Compare(it.configs.Prefix, key[:preLen]) == 0 {
+		if preLen == 0 || (preLen <= len(key) && bytes.Compare(it.configs.Prefix, key[:preLen]) == 0) {
 			break
 		}
 	}
@@ -1,7 +1,11 @@
 package rdb
 
 import (
+	"context"
+	"fmt"
 	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/fio"
+	"github.com/youzeliang/rdb/index"
 	"github.com/youzeliang/rdb/utils"
 	"io"
 	"os"
@@ -9,72 +13,144 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	mergeDirName     = "-merge"
 	mergeFinishedKey = "merge.finished"
+	mergeFilesKey    = "merge.files"
+
+	// 每读取这么多数据报告一次 merge 的进度
+	mergeProgressStep = 1024 * 1024
 )
 
+// MergeProgress merge 的进度
+type MergeProgress struct {
+	StartedAt      time.Time
+	TotalBytes     int64         // 参与 merge 的数据文件的总大小
+	ProcessedBytes int64         // 已经读取的数据量
+	LiveBytes      int64         // 已经重写的数据量
+	ETA            time.Duration // 按照目前的速度估计的剩余时间，还没有读取数据时为 0
+}
+
+// Merge 清理无效数据，无效数据的占比需要达到 DataFileMergeRatio
 func (db *DB) Merge() error {
+	return db.merge(context.Background(), db.config.DataFileMergeRatio, MergeOptions{})
+}
+
+// MergeWithOptions 和 Merge 相同，可以限制读写的速率以及获取 merge 的进度
+// ctx 取消时删除 merge 目录并返回 ctx 的错误，数据库不受影响，开始安装 merge 的结果之后不再响应取消
+func (db *DB) MergeWithOptions(ctx context.Context, opts MergeOptions) error {
+	if opts.RateLimitBytesPerSec < 0 {
+		return ErrInvalidMergeOptions
+	}
+	return db.merge(ctx, db.config.DataFileMergeRatio, opts)
+}
+
+func (db *DB) merge(ctx context.Context, ratio float32, opts MergeOptions) error {
+	mergePath, err := db.writeMergeFiles(ctx, ratio, opts)
+	if mergePath == "" {
+		return err
+	}
+	defer func() {
+		db.mutex.Lock()
+		db.isMerging = false
+		db.mergeProgress = nil
+		db.mutex.Unlock()
+	}()
+	if err != nil {
+		return err
+	}
+
+	// 将 merge 的结果安装到数据库中，立即生效
+	return db.installMerge(mergePath)
+}
+
+// writeMergeFiles 将有效的数据重写到 merge 目录中，返回 merge 目录
+// 返回的目录不为空时说明已经设置了 isMerging，由调用方在安装之后清除，返回错误时 merge 目录已经被删除
+func (db *DB) writeMergeFiles(ctx context.Context, ratio float32, opts MergeOptions) (mergePath string, err error) {
+	if db.config.ReadOnly {
+		return "", ErrReadOnly
+	}
+	db.mutex.Lock()
 	// 如果数据库为空，则直接返回
 	if db.activeFile == nil {
-		return nil
+		db.mutex.Unlock()
+		return "", nil
 	}
-	db.mutex.Lock()
 	// 如果 merge 正在进行当中，则直接返回
 	if db.isMerging {
 		db.mutex.Unlock()
-		return ErrMergeInProgress
+		return "", ErrMergeInProgress
 	}
 
 	// 查看可以 merge 的数据量是否达到了阈值
 	totalSize, err := utils.DirSize(db.config.DirPath)
 	if err != nil {
 		db.mutex.Unlock()
-		return err
+		return "", err
 	}
-	if float32(db.reclaimSize)/float32(totalSize) < db.config.DataFileMergeRatio {
+	// blob 文件不参与 merge，由 BlobGC 单独回收
+	totalSize -= db.blobFilesSize()
+	if float32(db.reclaimSize)/float32(totalSize) < ratio {
 		db.mutex.Unlock()
-		return ErrMergeRatioUnreached
+		return "", ErrMergeRatioUnreached
 	}
 
 	// 查看剩余的空间容量是否可以容纳 merge 之后的数据量
 	availableDiskSize, err := utils.AvailableDiskSize()
 	if err != nil {
 		db.mutex.Unlock()
-		return err
+		return "", err
 	}
 	if uint64(totalSize-db.reclaimSize) >= availableDiskSize {
 		db.mutex.Unlock()
-		return ErrNoEnoughSpaceForMerge
+		return "", ErrNoEnoughSpaceForMerge
 	}
 
 	db.isMerging = true
-	defer func() {
-		db.isMerging = false
-	}()
+	mergePath = db.getMergePath()
 
 	// 持久化当前活跃文件
 	if err := db.activeFile.Sync(); err != nil {
 		db.mutex.Unlock()
-		return err
+		return mergePath, err
 	}
-	// 将当前活跃文件转换为旧的数据文件
-	db.archivedFiles[db.activeFile.FileId] = db.activeFile
-	// 打开新的活跃文件
-	if err := db.setActiveDataFile(); err != nil {
+	// 将当前活跃文件转换为旧的数据文件，打开新的活跃文件
+	if err := db.rotateActiveFile(); err != nil {
 		db.mutex.Unlock()
-		return nil
+		return mergePath, err
 	}
 	// 记录最近没有参与 merge 的文件 id
 	nonMergeFileId := db.activeFile.FileId
+	// 参与 merge 的文件中最大的序列号不会超过当前的序列号
+	mergedSeq := db.seq
+	// 序列号大于 retainSeq 的修改历史需要保留
+	retainSeq := db.changeRetainSeq()
+	// 使用当前的密钥重新加密游标和列族文件，数据文件在 merge 时重新写入
+	if db.keyProvider != nil {
+		if err := db.reencryptMetaFiles(); err != nil {
+			db.mutex.Unlock()
+			return mergePath, err
+		}
+	}
 
 	// 取出所有需要 merge 的文件
 	var mergeFiles []*data.DataFile
+	progress := MergeProgress{StartedAt: time.Now()}
 	for _, file := range db.archivedFiles {
 		mergeFiles = append(mergeFiles, file)
+		size, err := file.Size()
+		if err != nil {
+			db.mutex.Unlock()
+			return mergePath, err
+		}
+		progress.TotalBytes += size
 	}
+	db.mergeProgress = &progress
 	db.mutex.Unlock()
 
 	//	待 merge 的文件从小到大进行排序，依次 merge
@@ -82,91 +158,229 @@ func (db *DB) Merge() error {
 		return mergeFiles[i].FileId < mergeFiles[j].FileId
 	})
 
-	mergePath := db.getMergePath()
 	// 如果目录存在，说明发生过 merge，将其删除掉
 	if _, err := os.Stat(mergePath); err == nil {
 		if err := os.RemoveAll(mergePath); err != nil {
-			return err
+			return mergePath, err
 		}
 	}
 	// 新建一个 merge path 的目录
 	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
-		return err
+		return mergePath, err
 	}
+	// 失败或者被取消时删除 merge 目录，临时实例和 hint 文件在这之前关闭
+	var hintFile *data.DataFile
+	defer func() {
+		if err != nil {
+			if hintFile != nil {
+				_ = hintFile.Close()
+			}
+			_ = os.RemoveAll(mergePath)
+		}
+	}()
 	// 打开一个新的临时 bitcask 实例
 	mergeConfigs := db.config
 	mergeConfigs.DirPath = mergePath
 	mergeConfigs.SyncWrites = false
+	mergeConfigs.ExpirySweepInterval = 0
+	mergeConfigs.AutoMergeInterval = 0
+	// 临时实例只追加写入，不需要持久化的索引
+	mergeConfigs.IndexType = BTree
 	mergeDB, err := Open(mergeConfigs)
 	if err != nil {
-		return err
+		return mergePath, err
 	}
+	// 临时实例的数据文件使用 merge 目录中的 hint 文件，不生成每个文件的 hint 文件
+	mergeDB.fileHints = nil
+	mergeDBClosed := false
+	defer func() {
+		if !mergeDBClosed {
+			_ = mergeDB.Close()
+		}
+	}()
 
 	// 打开 hint 文件存储索引
-	hintFile, err := data.OpenHintFile(mergePath)
+	hintFile, err = db.encryptDataFile(data.OpenHintFile(mergePath))
 	if err != nil {
+		return mergePath, err
+	}
+	// 读写都计入限速，重写的数据计入有效数据量
+	limiter := utils.NewRateLimiter(opts.RateLimitBytesPerSec)
+	rewrite := func(logRecord *data.LogRecord) (*data.Position, error) {
+		pos, err := mergeDB.appendLogRecord(logRecord)
+		if err != nil {
+			return nil, err
+		}
+		progress.LiveBytes += int64(pos.Size)
+		return pos, limiter.Wait(ctx, int64(pos.Size))
+	}
+	var lastReport int64
+	report := func() {
+		lastReport = progress.ProcessedBytes
+		db.reportMergeProgress(&progress, opts.OnProgress)
+	}
+	// 需要保留的历史修改，事务中的数据读到完成标记之后才能确定是有效的
+	retainedTxns := make(map[uint64][]*data.LogRecord)
+	retain := func(logRecord *data.LogRecord) error {
+		_, err := rewrite(logRecord)
 		return err
 	}
+
 	// 遍历处理每个数据文件
+	now := time.Now().UnixNano()
 	for _, dataFile := range mergeFiles {
 		var offset int64 = 0
 		for {
 			logRecord, size, err := dataFile.ReadLogRecord(offset)
 			if err != nil {
+				// 跳过打开时已经发现的损坏数据
+				if next, ok := db.skipCorruptRange(dataFile.FileId, offset); ok {
+					offset = next
+					continue
+				}
 				if err == io.EOF {
 					break
 				}
-				return err
+				return mergePath, err
+			}
+			progress.ProcessedBytes += size
+			if err := limiter.Wait(ctx, size); err != nil {
+				return mergePath, err
+			}
+			if progress.ProcessedBytes-lastReport >= mergeProgressStep {
+				report()
 			}
 			// 解析拿到实际的 key
-			realKey, _ := parseLogRecordKey(logRecord.Key)
-			logRecordPos := db.index.Get(realKey)
+			realKey, seqNo := parseLogRecordKey(logRecord.Key)
+			if logRecord.Type == data.LogRecordTxnFinished {
+				for _, record := range retainedTxns[seqNo] {
+					if err := retain(record); err != nil {
+						return mergePath, err
+					}
+				}
+				delete(retainedTxns, seqNo)
+				offset += size
+				continue
+			}
+
+			var logRecordPos *data.Position
+			if idx := db.indexFor(logRecord.ColumnFamily); idx != nil {
+				logRecordPos = idx.Get(realKey)
+			}
 			// 和内存中的索引位置进行比较，如果有效则重写
 			if logRecordPos != nil &&
 				logRecordPos.Fid == dataFile.FileId &&
 				logRecordPos.Offset == offset {
 				// 清除事务标记
 				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
-				pos, err := mergeDB.appendLogRecord(logRecord)
-				if err != nil {
-					return err
+				// 已经过期的数据不再重写
+				if logRecordPos.IsExpired(now) {
+					db.removeExpired(logRecord.ColumnFamily, realKey, logRecordPos)
+				} else {
+					pos, err := rewrite(logRecord)
+					if err != nil {
+						return mergePath, err
+					}
+					// 将当前位置索引写到 Hint 文件当中
+					if err := hintFile.WriteHintRecord(realKey, logRecord.ColumnFamily, pos); err != nil {
+						return mergePath, err
+					}
+					offset += size
+					continue
 				}
-				// 将当前位置索引写到 Hint 文件当中
-				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
-					return err
+			}
+
+			// 无效的数据如果还在修改历史的保留范围内，则作为历史修改重写，但不写入 Hint 文件
+			if logRecord.Seq > retainSeq {
+				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
+				if seqNo == nonTransactionSeqNo {
+					if err := retain(logRecord); err != nil {
+						return mergePath, err
+					}
+				} else {
+					retainedTxns[seqNo] = append(retainedTxns[seqNo], logRecord)
 				}
 			}
 			// 增加 offset
 			offset += size
 		}
+		report()
 	}
 
 	// sync 保证持久化
 	if err := hintFile.Sync(); err != nil {
-		return err
+		return mergePath, err
+	}
+	if err := hintFile.Close(); err != nil {
+		return mergePath, err
 	}
 	if err := mergeDB.Sync(); err != nil {
-		return err
+		return mergePath, err
+	}
+	// merge 之后的文件 id 从 0 开始，必须小于没有参与 merge 的文件
+	var mergedFiles uint32
+	if mergeDB.activeFile != nil {
+		mergedFiles = mergeDB.activeFile.FileId + 1
+	}
+	mergeDBClosed = true
+	if err := mergeDB.Close(); err != nil {
+		return mergePath, err
+	}
+	if mergedFiles > nonMergeFileId {
+		_ = os.RemoveAll(mergePath)
+		return mergePath, fmt.Errorf("merged files %d exceed the non-merged file id %d", mergedFiles, nonMergeFileId)
 	}
 
 	// 写标识 merge 完成的文件
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
+	// 写标识之前最后一次检查是否被取消，写入之后的 merge 一定会被安装
+	if err := ctx.Err(); err != nil {
+		return mergePath, err
+	}
+	mergeFinishedFile, err := db.encryptDataFile(data.OpenMergeFinishedFile(mergePath))
 	if err != nil {
-		return err
+		return mergePath, err
 	}
+	defer mergeFinishedFile.Close()
 	mergeFinRecord := &data.LogRecord{
 		Key:   []byte(mergeFinishedKey),
 		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
+		Seq:   mergedSeq,
 	}
 	encRecord, _ := data.EncodeLogRecord(mergeFinRecord)
 	if err := mergeFinishedFile.Write(encRecord); err != nil {
-		return err
+		return mergePath, err
+	}
+	// 记录 merge 之后的文件数量，安装时中途崩溃可以在重新打开时继续完成
+	mergeFilesRecord := &data.LogRecord{
+		Key:   []byte(mergeFilesKey),
+		Value: []byte(strconv.Itoa(int(mergedFiles))),
+	}
+	encRecord, _ = data.EncodeLogRecord(mergeFilesRecord)
+	if err := mergeFinishedFile.Write(encRecord); err != nil {
+		return mergePath, err
 	}
 	if err := mergeFinishedFile.Sync(); err != nil {
-		return err
+		return mergePath, err
 	}
 
-	return nil
+	return mergePath, nil
+}
+
+// reportMergeProgress 估计剩余的时间，更新 Stat 中的进度并调用回调
+func (db *DB) reportMergeProgress(progress *MergeProgress, onProgress func(MergeProgress)) {
+	progress.ETA = 0
+	if progress.ProcessedBytes > 0 && progress.TotalBytes > progress.ProcessedBytes {
+		elapsed := time.Since(progress.StartedAt)
+		remaining := float64(progress.TotalBytes-progress.ProcessedBytes) / float64(progress.ProcessedBytes)
+		progress.ETA = time.Duration(float64(elapsed) * remaining)
+	}
+	current := *progress
+	db.mutex.Lock()
+	db.mergeProgress = &current
+	db.mutex.Unlock()
+	if onProgress != nil {
+		onProgress(current)
+	}
 }
 
 func (db *DB) getMergePath() string {
@@ -176,10 +390,11 @@ func (db *DB) getMergePath() string {
 }
 
 func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
+	mergeFinishedFile, err := db.encryptDataFile(data.OpenMergeFinishedFile(dirPath))
 	if err != nil {
 		return 0, err
 	}
+	defer mergeFinishedFile.Close()
 	record, _, err := mergeFinishedFile.ReadLogRecord(0)
 	if err != nil {
 		return 0, err
@@ -192,67 +407,216 @@ func (db *DB) getNonMergeFileId(dirPath string) (uint32, error) {
 	return uint32(nonMergeFileId), nil
 }
 
-// 加载merge数据目录
+// getMergedFileNum 获取 merge 之后的数据文件数量，旧版本的标记文件中没有记录时返回 false
+func (db *DB) getMergedFileNum(dirPath string) (uint32, bool, error) {
+	mergeFinishedFile, err := db.encryptDataFile(data.OpenMergeFinishedFile(dirPath))
+	if err != nil {
+		return 0, false, err
+	}
+	defer mergeFinishedFile.Close()
+	_, size, err := mergeFinishedFile.ReadLogRecord(0)
+	if err != nil {
+		return 0, false, err
+	}
+	record, _, err := mergeFinishedFile.ReadLogRecord(size)
+	if err == io.EOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	mergedFiles, err := strconv.Atoi(string(record.Value))
+	if err != nil {
+		return 0, false, err
+	}
+	return uint32(mergedFiles), true, nil
+}
+
+// getMergedSeq 获取参与 merge 的文件中最大的序列号
+func (db *DB) getMergedSeq(dirPath string) (uint64, error) {
+	mergeFinishedFile, err := db.encryptDataFile(data.OpenMergeFinishedFile(dirPath))
+	if err != nil {
+		return 0, err
+	}
+	defer mergeFinishedFile.Close()
+	record, _, err := mergeFinishedFile.ReadLogRecord(0)
+	if err != nil {
+		return 0, err
+	}
+	return record.Seq, nil
+}
+
+// 加载merge数据目录，上一次 merge 完成之后没有安装完的时候在这里继续完成
 func (db *DB) loadMergeFiles() error {
 	mergePath := db.getMergeDirPath()
 	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
 		return nil
 	}
-	defer func() {
-		_ = os.RemoveAll(mergePath)
-	}()
+	// 没有完成的 merge 直接丢弃
+	if _, err := os.Stat(filepath.Join(mergePath, data.MergeFinishedFileName)); os.IsNotExist(err) {
+		return os.RemoveAll(mergePath)
+	}
+	// B+ 树索引持久化在磁盘上，移动文件之前需要先将 merge 之后的位置写入索引，已经写入过时不会重复写入
+	if db.config.IndexType == BPlusTree {
+		nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+		if err != nil {
+			return err
+		}
+		if _, err := db.swapMergedPositions(mergePath, nonMergeFileId); err != nil {
+			return err
+		}
+	}
+	_, _, err := db.moveMergeFiles(mergePath)
+	return err
+}
 
+// moveMergeFiles 将 merge 目录中的文件移动到数据目录中，替换掉参与 merge 的数据文件，最后删除 merge 目录
+// 每一步都可以重复执行，中途崩溃时重新打开数据库会再次执行，返回没有参与 merge 的文件 id 和 merge 之后的文件数量
+func (db *DB) moveMergeFiles(mergePath string) (uint32, uint32, error) {
+	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	mergedFiles, ok, err := db.getMergedFileNum(mergePath)
+	if err != nil {
+		return 0, 0, err
+	}
 	dirEntries, err := os.ReadDir(mergePath)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
-
-	//	遍历查找是否完成了 merge
-	var mergeFinished bool
-	var fileNames []string
-	for _, entry := range dirEntries {
-		// 说明是全部完成了
-		if entry.Name() == data.MergeFinishedFileName {
-			mergeFinished = true
+	// 旧版本的标记文件，merge 目录中的数据文件还没有移动过
+	if !ok {
+		for _, entry := range dirEntries {
+			if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+				mergedFiles++
+			}
 		}
+	}
 
-		if entry.Name() == data.SeqNoFileName {
-			continue
+	// 先删除 merge 之后不会被替换的旧数据文件，参与 merge 的文件的 hint 文件都不再有效
+	for fileId := uint32(0); fileId < nonMergeFileId; fileId++ {
+		if err := removeFileHint(db.config.DirPath, fileId); err != nil {
+			return 0, 0, err
 		}
-		if entry.Name() == fileLockName {
+		if fileId < mergedFiles {
 			continue
 		}
+		fileName := data.GetDataFileName(db.config.DirPath, fileId)
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return 0, 0, err
+		}
+	}
 
-		fileNames = append(fileNames, entry.Name())
+	// 按文件名顺序移动，数据文件在前，标记文件最后移动
+	for _, entry := range dirEntries {
+		if entry.Name() == data.SeqNoFileName || entry.Name() == fileLockName ||
+			entry.Name() == data.MergeFinishedFileName || entry.Name() == index.BPlusTreeIndexFileName ||
+			strings.HasSuffix(entry.Name(), data.FileHintSuffix) {
+			continue
+		}
+		srcPath := filepath.Join(mergePath, entry.Name())
+		destPath := filepath.Join(db.config.DirPath, entry.Name())
+		if err := os.Rename(srcPath, destPath); err != nil {
+			return 0, 0, err
+		}
 	}
-	// 没有merge直接返回
-	if !mergeFinished {
-		return nil
+	srcPath := filepath.Join(mergePath, data.MergeFinishedFileName)
+	destPath := filepath.Join(db.config.DirPath, data.MergeFinishedFileName)
+	if err := os.Rename(srcPath, destPath); err != nil {
+		return 0, 0, err
+	}
+	// 删除 merge 目录之前，数据目录中的删除和重命名必须已经落盘
+	if err := utils.SyncDir(db.config.DirPath); err != nil {
+		return 0, 0, err
 	}
+	return nonMergeFileId, mergedFiles, os.RemoveAll(mergePath)
+}
 
+// installMerge 将 merge 的结果安装到正在运行的数据库中
+// merge 期间没有被修改的 key 的索引指向 merge 之后的位置，参与 merge 的数据文件在没有快照引用之后关闭
+func (db *DB) installMerge(mergePath string) error {
 	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
 	if err != nil {
 		return err
 	}
-	//	先删除旧的数据文件
-	var fileId uint32 = 0
-	for ; fileId < nonMergeFileId; fileId++ {
-		fileName := data.GetDataFileName(db.config.DirPath, fileId)
-		if _, err := os.Stat(fileName); err == nil {
-			if err := os.Remove(fileName); err != nil {
-				return err
-			}
+
+	// 先更新索引再移动文件，B+ 树索引在一个事务中完成更新，之后崩溃时重新打开会继续移动文件
+	if db.config.IndexType == BPlusTree {
+		db.mutex.Lock()
+		defer db.mutex.Unlock()
+		live, err := db.swapMergedPositions(mergePath, nonMergeFileId)
+		if err != nil {
+			return err
 		}
+		return db.replaceMergedFiles(mergePath, nonMergeFileId, live)
 	}
 
-	// 移动文件
-	for _, fileName := range fileNames {
-		srcPath := filepath.Join(mergePath, fileName)
-		destPath := filepath.Join(db.config.DirPath, fileName)
-		if err := os.Rename(srcPath, destPath); err != nil {
+	// 内存索引在副本上更新，不持有锁，安装时只需要同步期间被修改过的 key
+	swap, err := db.beginMergeSwap(nonMergeFileId)
+	if err != nil {
+		return err
+	}
+	swapErr := swap.apply(db, mergePath)
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if swapErr == nil {
+		swapErr = db.commitMergeSwap(swap)
+	}
+	if swapErr != nil {
+		db.abortMergeSwap(swap)
+		return swapErr
+	}
+	return db.replaceMergedFiles(mergePath, nonMergeFileId, swap.live)
+}
+
+// replaceMergedFiles 索引已经指向 merge 之后的位置，移动 merge 之后的数据文件，替换掉参与 merge 的数据文件
+// 调用前必须持有互斥锁
+func (db *DB) replaceMergedFiles(mergePath string, nonMergeFileId uint32, live map[uint32]int64) error {
+	_, mergedFiles, err := db.moveMergeFiles(mergePath)
+	if err != nil {
+		return err
+	}
+
+	merged := make(map[uint32]*data.DataFile, mergedFiles)
+	for fid := uint32(0); fid < mergedFiles; fid++ {
+		dataFile, err := db.encryptDataFile(data.OpenDataFile(db.config.DirPath, fid, fio.StandardFIO))
+		if err != nil {
+			return fmt.Errorf("failed to open merged data file %d: %w", fid, err)
+		}
+		merged[fid] = dataFile
+	}
+
+	// 替换数据文件，旧的文件已经被删除或者替换，仍然被引用时可以继续读取
+	for fid, dataFile := range db.archivedFiles {
+		if fid >= nonMergeFileId {
+			continue
+		}
+		delete(db.archivedFiles, fid)
+		db.reclaimSize -= db.fileReclaimSize[fid]
+		delete(db.fileReclaimSize, fid)
+		delete(db.fileSeqRanges, fid)
+		if err := db.retireDataFile(dataFile); err != nil {
 			return err
 		}
 	}
+	for fid, dataFile := range merged {
+		db.archivedFiles[fid] = dataFile
+		size, err := dataFile.Size()
+		if err != nil {
+			return err
+		}
+		// 修改历史以及 merge 期间被修改的 key 都是无效数据
+		if dead := size - live[fid]; dead > 0 {
+			db.addReclaimSize(fid, dead)
+		}
+	}
+	atomic.AddUint64(&db.fileGeneration, 1)
+
+	if info, err := os.Stat(filepath.Join(db.config.DirPath, data.MergeFinishedFileName)); err == nil {
+		db.mergeMarker = info.ModTime()
+	}
 	return nil
 }
 
@@ -263,15 +627,173 @@ func (db *DB) getMergeDirPath() string {
 }
 
 func (db *DB) loadIndexFromHintFile() error {
-	hintFileName := filepath.Join(db.config.DirPath, data.HintFileName)
+	now := time.Now().UnixNano()
+	return db.foldHintFile(db.config.DirPath, func(key []byte, family uint32, logRecordPos *data.Position) {
+		idx := db.indexFor(family)
+		if idx == nil || logRecordPos.IsExpired(now) {
+			db.addReclaimSize(logRecordPos.Fid, int64(logRecordPos.Size))
+		} else {
+			idx.Put(key, logRecordPos)
+			db.trackExpiry(family, key, logRecordPos)
+			db.trackBlob(logRecordPos, nil)
+		}
+	})
+}
+
+// swapMergedPositions 使用 merge 目录中的 hint 文件，将 B+ 树索引中 merge 期间没有被修改的 key 指向 merge 之后的位置
+// 返回每个 merge 之后的文件中有效的数据量，B+ 树索引在一个事务中完成更新，已经更新过时直接返回
+// 调用前必须持有互斥锁
+func (db *DB) swapMergedPositions(mergePath string, nonMergeFileId uint32) (map[uint32]int64, error) {
+	live := make(map[uint32]int64)
+	bpt := db.index.(*index.BPlusTree)
+	_, err := bpt.ApplyMerge(nonMergeFileId, func(swap func([]byte, *data.Position) *data.Position) error {
+		return db.foldHintFile(mergePath, func(key []byte, family uint32, pos *data.Position) {
+			// B+ 树索引不支持列族，只有默认列族
+			if family != defaultFamilyID {
+				return
+			}
+			if oldPos := swap(key, pos); oldPos != nil {
+				db.trackBlob(pos, oldPos)
+				live[pos.Fid] += int64(pos.Size)
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 移动文件之前索引必须已经落盘，否则崩溃之后索引中仍然是旧文件中的位置
+	return live, bpt.Sync()
+}
+
+// mergeSwap 安装 merge 时在内存索引的副本上更新 merge 之后的位置
+// 期间列族的索引替换为 recordingIndex，记录被修改过的 key，安装时再将它们当前的位置同步到副本中
+type mergeSwap struct {
+	nonMergeFileId uint32
+	families       map[uint32]*mergeSwapIndex
+	live           map[uint32]int64 // merge 之后的每个文件中有效的数据量
+	blobLive       map[uint32]int64 // 更新位置之后 blob 文件中有效数据量的变化
+}
+
+type mergeSwapIndex struct {
+	recording *recordingIndex
+	clone     index.Indexer
+}
+
+// recordingIndex 记录所有被修改过的 key，修改都在持有数据库互斥锁时进行
+type recordingIndex struct {
+	index.Indexer
+	changed map[string]struct{}
+}
+
+func (r *recordingIndex) Put(key []byte, pos *data.Position) *data.Position {
+	r.changed[string(key)] = struct{}{}
+	return r.Indexer.Put(key, pos)
+}
+
+func (r *recordingIndex) Delete(key []byte) (*data.Position, bool) {
+	r.changed[string(key)] = struct{}{}
+	return r.Indexer.Delete(key)
+}
+
+// beginMergeSwap 将每个列族的索引替换为 recordingIndex
+// 先持久化还没有持久化的写入，保证更新位置期间不会回滚之前的写入
+func (db *DB) beginMergeSwap(nonMergeFileId uint32) (*mergeSwap, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if err := db.syncPendingLocked(); err != nil {
+		return nil, err
+	}
+
+	swap := &mergeSwap{
+		nonMergeFileId: nonMergeFileId,
+		families:       make(map[uint32]*mergeSwapIndex, len(db.familyByID)),
+		live:           make(map[uint32]int64),
+		blobLive:       make(map[uint32]int64),
+	}
+	for id, cf := range db.familyByID {
+		recording := &recordingIndex{Indexer: cf.index, changed: make(map[string]struct{})}
+		cf.index = recording
+		swap.families[id] = &mergeSwapIndex{recording: recording}
+	}
+	db.index = db.defaultFamily.index
+	return swap, nil
+}
+
+// apply 复制每个列族的索引，并将副本中 merge 期间没有被修改的 key 指向 merge 之后的位置
+// 不持有数据库的锁，复制之后的修改都记录在 recordingIndex 中
+func (swap *mergeSwap) apply(db *DB, mergePath string) error {
+	for _, family := range swap.families {
+		family.clone = family.recording.Indexer.Clone()
+	}
+	return db.foldHintFile(mergePath, func(key []byte, family uint32, pos *data.Position) {
+		swapIndex, ok := swap.families[family]
+		if !ok {
+			return
+		}
+		// merge 期间被修改的 key 已经指向没有参与 merge 的文件
+		oldPos := swapIndex.clone.Get(key)
+		if oldPos == nil || oldPos.Fid >= swap.nonMergeFileId {
+			return
+		}
+		swapIndex.clone.Put(key, pos)
+		swap.live[pos.Fid] += int64(pos.Size)
+		if pos.Blob != nil {
+			swap.blobLive[pos.Blob.Fid] += pos.Blob.Size
+		}
+		if oldPos.Blob != nil {
+			swap.blobLive[oldPos.Blob.Fid] -= oldPos.Blob.Size
+		}
+	})
+}
+
+// commitMergeSwap 将更新位置期间被修改过的 key 同步到副本中，再用副本替换列族的索引
+// 调用前必须持有互斥锁
+func (db *DB) commitMergeSwap(swap *mergeSwap) error {
+	// 持久化失败时索引已经回滚，不再安装 merge 的结果，重新打开数据库时会继续安装
+	if err := db.syncPendingLocked(); err != nil {
+		return err
+	}
+	for id, swapIndex := range swap.families {
+		for key := range swapIndex.recording.changed {
+			// 副本中已经指向 merge 之后的位置的记录成为无效数据
+			if pos := swapIndex.clone.Get([]byte(key)); pos != nil && pos.Fid < swap.nonMergeFileId {
+				swap.live[pos.Fid] -= int64(pos.Size)
+			}
+			if pos := swapIndex.recording.Indexer.Get([]byte(key)); pos != nil {
+				swapIndex.clone.Put([]byte(key), pos)
+			} else {
+				swapIndex.clone.Delete([]byte(key))
+			}
+		}
+		db.familyByID[id].index = swapIndex.clone
+	}
+	db.index = db.defaultFamily.index
+	for fid, size := range swap.blobLive {
+		db.blobLive[fid] += size
+	}
+	return nil
+}
+
+// abortMergeSwap 恢复列族原来的索引，调用前必须持有互斥锁
+func (db *DB) abortMergeSwap(swap *mergeSwap) {
+	for id, swapIndex := range swap.families {
+		db.familyByID[id].index = swapIndex.recording.Indexer
+	}
+	db.index = db.defaultFamily.index
+}
+
+// foldHintFile 遍历 dirPath 中的 hint 文件中的所有索引位置，hint 文件不存在时直接返回
+func (db *DB) foldHintFile(dirPath string, fn func(key []byte, family uint32, pos *data.Position)) error {
+	hintFileName := filepath.Join(dirPath, data.HintFileName)
 	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
 		return nil
 	}
 
-	hintFile, err := data.OpenHintFile(db.config.DirPath)
+	hintFile, err := db.encryptDataFile(data.OpenHintFile(dirPath))
 	if err != nil {
 		return err
 	}
+	defer hintFile.Close()
 
 	var offset int64 = 0
 	for {
@@ -282,8 +804,7 @@ func (db *DB) loadIndexFromHintFile() error {
 			}
 			return err
 		}
-		logRecordPos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, logRecordPos)
+		fn(logRecord.Key, logRecord.ColumnFamily, data.DecodeLogRecordPos(logRecord.Value))
 		offset += size
 	}
 	return nil
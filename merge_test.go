@@ -1,11 +1,15 @@
 package rdb
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/data"
 	"github.com/youzeliang/rdb/utils"
 	"os"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 // 没有任何数据的情况下进行 merge
@@ -201,3 +205,413 @@ func TestDB_Merge5(t *testing.T) {
 		assert.NotNil(t, val)
 	}
 }
+
+// 过期的数据在 merge 时被清理
+func TestDB_Merge_Expired(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-ttl")
+	opts.FileSize = 32 * 1024 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(128), time.Millisecond*50)
+		assert.Nil(t, err)
+	}
+	for i := 1000; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	// merge 的结果立即生效，过期的数据已经被回收
+	assert.Equal(t, int64(0), db.reclaimSize)
+	assert.Equal(t, 1000, db.index.Size())
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	assert.Equal(t, 1000, db2.index.Size())
+}
+
+// merge 的结果不需要重新打开就立即生效，期间的写入不会丢失
+func TestDB_Merge_Online(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-online")
+	opts.FileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("old")))
+	}
+	db.fileHints.wg.Wait()
+	before := db.Stat()
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+	iterator := db.NewIterator(DefaultIteratorConfigs)
+	defer iterator.Close()
+
+	// merge 期间继续写入
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("new")))
+		}
+	}()
+	assert.Nil(t, db.Merge())
+	wg.Wait()
+
+	db.fileHints.wg.Wait()
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	after := db.Stat()
+	assert.True(t, after.DataFileNum < before.DataFileNum)
+	assert.True(t, after.ReclaimableSize < before.ReclaimableSize)
+	assert.True(t, after.DiskSize < before.DiskSize)
+
+	check := func() {
+		for i := 0; i < 2000; i++ {
+			value, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			switch {
+			case i < 500:
+				assert.Equal(t, []byte("new"), value)
+			case i < 1000:
+				assert.Equal(t, []byte("old"), value)
+			default:
+				assert.Equal(t, len(utils.RandomValue(24)), len(value))
+			}
+		}
+	}
+	check()
+
+	// 之前创建的快照读取的仍然是旧的数据，迭代器读取的是最新的数据
+	value, err := snapshot.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("old"), value)
+	var count int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		_, err := iterator.Value()
+		assert.Nil(t, err)
+		count++
+	}
+	assert.Equal(t, 2000, count)
+
+	// 再次 merge 以及重新打开之后数据保持一致
+	assert.Nil(t, db.Put(utils.GetTestKey(5000), []byte("last")))
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check()
+	value, err = db.Get(utils.GetTestKey(5000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("last"), value)
+}
+
+// 安装 merge 时在索引的副本上更新位置，期间不持有锁，可以正常读写
+func TestDB_Merge_SwapWithoutLock(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-swap")
+	opts.FileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	cf, err := db.CreateColumnFamily("cf", DefaultColumnFamilyConfigs)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("old")))
+		assert.Nil(t, cf.Put(utils.GetTestKey(i), []byte("cf-old")))
+	}
+	mergePath, err := db.writeMergeFiles(context.Background(), 0, MergeOptions{})
+	assert.Nil(t, err)
+	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+	assert.Nil(t, err)
+
+	swap, err := db.beginMergeSwap(nonMergeFileId)
+	assert.Nil(t, err)
+	// 复制索引之前和更新位置之后的修改都会同步到新的索引中
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("before")))
+	assert.Nil(t, cf.Delete(utils.GetTestKey(2)))
+	assert.Nil(t, swap.apply(db, mergePath))
+	assert.Nil(t, db.Put(utils.GetTestKey(3), []byte("after")))
+	assert.Nil(t, db.Delete(utils.GetTestKey(4)))
+	value, err := db.Get(utils.GetTestKey(5))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("old"), value)
+
+	db.mutex.Lock()
+	assert.Nil(t, db.commitMergeSwap(swap))
+	assert.Nil(t, db.replaceMergedFiles(mergePath, nonMergeFileId, swap.live))
+	db.isMerging = false
+	db.mutex.Unlock()
+
+	check := func() {
+		for i := 0; i < 2000; i++ {
+			value, err := db.Get(utils.GetTestKey(i))
+			switch i {
+			case 1:
+				assert.Equal(t, []byte("before"), value)
+			case 3:
+				assert.Equal(t, []byte("after"), value)
+			case 4:
+				assert.Equal(t, ErrKeyNotFound, err)
+			default:
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("old"), value)
+			}
+
+			value, err = cf.Get(utils.GetTestKey(i))
+			if i == 2 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("cf-old"), value)
+			}
+		}
+	}
+	check()
+	_, ok := db.index.(*recordingIndex)
+	assert.False(t, ok)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	cf, err = db.ColumnFamily("cf")
+	assert.Nil(t, err)
+	check()
+}
+
+func TestDB_Merge_BPlusTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-bptree")
+	opts.FileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.IndexType = BPlusTree
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("old")))
+	}
+	for i := 1500; i < 2000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	before := db.Stat()
+	assert.Nil(t, db.Merge())
+	assert.True(t, db.Stat().DataFileNum < before.DataFileNum)
+
+	check := func() {
+		for i := 0; i < 2000; i++ {
+			value, err := db.Get(utils.GetTestKey(i))
+			switch {
+			case i < 1000:
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("old"), value)
+			case i < 1500:
+				assert.Nil(t, err)
+				assert.Equal(t, len(utils.RandomValue(24)), len(value))
+			default:
+				assert.Equal(t, ErrKeyNotFound, err)
+			}
+		}
+	}
+	check()
+
+	// 持久化的索引在重新打开之后指向 merge 之后的文件
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check()
+}
+
+func TestDB_Merge_BPlusTreeCrash(t *testing.T) {
+	// 模拟 merge 安装过程中在不同阶段崩溃
+	crashes := map[string]func(db *DB, mergePath string){
+		"before swap": func(db *DB, mergePath string) {},
+		"after swap": func(db *DB, mergePath string) {
+			nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+			assert.Nil(t, err)
+			_, err = db.swapMergedPositions(mergePath, nonMergeFileId)
+			assert.Nil(t, err)
+		},
+		"during move": func(db *DB, mergePath string) {
+			nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+			assert.Nil(t, err)
+			_, err = db.swapMergedPositions(mergePath, nonMergeFileId)
+			assert.Nil(t, err)
+			fileName := data.GetDataFileName(mergePath, 0)
+			assert.Nil(t, os.Rename(fileName, data.GetDataFileName(db.config.DirPath, 0)))
+		},
+	}
+	for name, crash := range crashes {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-merge-bptree-crash")
+			opts.FileSize = 32 * 1024
+			opts.DataFileMergeRatio = 0
+			opts.IndexType = BPlusTree
+			opts.DirPath = dir
+			db, err := Open(opts)
+			defer destroyDB(db)
+			assert.Nil(t, err)
+
+			for i := 0; i < 1000; i++ {
+				assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+			}
+			for i := 0; i < 500; i++ {
+				assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("old")))
+			}
+			mergePath, err := db.writeMergeFiles(context.Background(), 0, MergeOptions{})
+			assert.Nil(t, err)
+			db.isMerging = false
+			// merge 完成之后安装之前写入的数据
+			assert.Nil(t, db.Put(utils.GetTestKey(0), []byte("new")))
+			crash(db, mergePath)
+
+			assert.Nil(t, db.Close())
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			_, err = os.Stat(mergePath)
+			assert.True(t, os.IsNotExist(err))
+			for i := 0; i < 1000; i++ {
+				value, err := db.Get(utils.GetTestKey(i))
+				assert.Nil(t, err)
+				switch {
+				case i == 0:
+					assert.Equal(t, []byte("new"), value)
+				case i < 500:
+					assert.Equal(t, []byte("old"), value)
+				default:
+					assert.Equal(t, len(utils.RandomValue(24)), len(value))
+				}
+			}
+		})
+	}
+}
+
+func TestDB_MergeWithOptions(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-options")
+	opts.FileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Equal(t, ErrInvalidMergeOptions, db.MergeWithOptions(context.Background(), MergeOptions{RateLimitBytesPerSec: -1}))
+
+	for i := 0; i < 20000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%10000), utils.RandomValue(24)))
+	}
+
+	var reports []MergeProgress
+	start := time.Now()
+	err = db.MergeWithOptions(context.Background(), MergeOptions{
+		RateLimitBytesPerSec: 4 * 1024 * 1024,
+		OnProgress: func(progress MergeProgress) {
+			stat := db.Stat()
+			assert.NotNil(t, stat.MergeProgress)
+			assert.Equal(t, progress, *stat.MergeProgress)
+			reports = append(reports, progress)
+		},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Stat().MergeProgress)
+
+	assert.True(t, len(reports) > 1)
+	for i := 1; i < len(reports); i++ {
+		assert.True(t, reports[i].ProcessedBytes >= reports[i-1].ProcessedBytes)
+	}
+	last := reports[len(reports)-1]
+	assert.Equal(t, last.TotalBytes, last.ProcessedBytes)
+	assert.Equal(t, time.Duration(0), last.ETA)
+	// 一半的数据被覆盖
+	assert.True(t, last.LiveBytes > 0 && last.LiveBytes < last.TotalBytes*2/3)
+	// 读写的数据量按照限速需要的时间
+	minDuration := time.Duration(float64(last.TotalBytes+last.LiveBytes) / (4 * 1024 * 1024) * float64(time.Second))
+	assert.True(t, time.Since(start) >= minDuration*9/10)
+
+	for i := 0; i < 10000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+func TestDB_MergeWithOptions_Cancel(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-cancel")
+	opts.FileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 20000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%10000), []byte(strconv.Itoa(i))))
+	}
+	before := db.Stat()
+
+	// 第一次报告进度之后取消
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = db.MergeWithOptions(ctx, MergeOptions{
+		RateLimitBytesPerSec: 1024 * 1024,
+		OnProgress: func(progress MergeProgress) {
+			assert.True(t, progress.ETA > 0)
+			cancel()
+		},
+	})
+	assert.Equal(t, context.Canceled, err)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db.Stat().MergeProgress)
+	assert.Equal(t, before.ReclaimableSize, db.Stat().ReclaimableSize)
+
+	check := func() {
+		for i := 0; i < 10000; i++ {
+			value, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte(strconv.Itoa(i+10000)), value)
+		}
+	}
+	check()
+
+	// 取消之后可以再次 merge
+	assert.Nil(t, db.Merge())
+	check()
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check()
+}
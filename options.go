@@ -1,6 +1,9 @@
 package rdb
 
-import "os"
+import (
+	"os"
+	"time"
+)
 
 // Configs 配置项的结构体、用户可传递过来的配置项
 type Configs struct {
@@ -24,6 +27,81 @@ type Configs struct {
 
 	// 数据文件合并的阈值
 	DataFileMergeRatio float32
+
+	// 后台清理过期数据的时间间隔，为 0 时不开启后台清理
+	ExpirySweepInterval time.Duration
+
+	// 后台清理时每一批最多写入多少条删除记录
+	ExpirySweepBatchSize int
+
+	// 是否以只读模式打开，只读模式下不加文件锁，可以和写入的进程同时打开同一个目录
+	ReadOnly bool
+
+	// 从库自动追赶主库写入的时间间隔，为 0 时只能手动调用 TryCatchUp
+	CatchUpInterval time.Duration
+
+	// merge 时是否为已注册的游标保留修改历史，开启后序列号大于最小游标的修改不会被清理
+	ChangeRetention bool
+
+	// value 超过该大小时写入单独的 blob 文件，数据文件中只保存指向它的指针，为 0 时不开启
+	BlobThreshold int64
+
+	// blob 文件中无效数据的占比达到该值时，BlobGC 才会回收这个文件
+	BlobGCRatio float32
+
+	// value 使用的压缩算法，只影响新写入的数据，merge 时会使用当前的算法重新压缩
+	Compression CompressionType
+
+	// 加密数据文件使用的 AES 密钥，长度为 16、24 或 32 字节，为空时不加密
+	EncryptionKey []byte
+
+	// 提供加密密钥，需要轮换密钥时使用，和 EncryptionKey 只能设置一个
+	// merge 时会使用当前的密钥重新加密数据文件
+	KeyProvider KeyProvider
+
+	// 打开数据库时遇到损坏的数据文件的处理方式
+	RecoveryMode RecoveryMode
+
+	// 打开数据库时并行解析数据文件的协程数量，为 0 时使用 CPU 的核数
+	IndexLoadWorkers int
+
+	// 后台检查是否需要 merge 的时间间隔，为 0 时不开启后台 merge
+	AutoMergeInterval time.Duration
+
+	// 无效数据的占比达到该值时后台才会进行 merge
+	AutoMergeRatio float32
+
+	// 至少有多少个归档的数据文件时后台才会进行 merge
+	AutoMergeMinFiles int
+
+	// 允许后台 merge 的时间段，为空时不限制
+	AutoMergeWindow TimeWindow
+
+	// 大于 0 时后台每次只 Compact 无效数据占比最高的这么多个文件，为 0 时进行完整的 merge
+	AutoCompactFiles int
+
+	// 每一次后台 merge 结束之后的回调，在后台 merge 的协程中调用
+	OnAutoMerge func(AutoMergeResult)
+}
+
+// TimeWindow 每天的一个时间段，Start 和 End 是距离本地时间零点的时长
+// Start 大于 End 时表示跨过零点的时间段，两者相等时表示不限制
+type TimeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// Contains t 是否在时间段内
+func (w TimeWindow) Contains(t time.Time) bool {
+	if w.Start == w.End {
+		return true
+	}
+	year, month, day := t.Date()
+	offset := t.Sub(time.Date(year, month, day, 0, 0, 0, 0, t.Location()))
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
 }
 
 // IteratorConfigs 索引迭代器配置项
@@ -43,6 +121,71 @@ type WriteBatchConfigs struct {
 	SyncWrites bool
 }
 
+// CompactConfigs 增量回收配置项
+type CompactConfigs struct {
+	// 一次最多回收多少个数据文件
+	MaxFiles int
+
+	// 无效数据的占比达到该值的文件才会被回收
+	MinGarbageRatio float32
+}
+
+// MergeOptions merge 的选项
+type MergeOptions struct {
+	// 每秒最多读写的字节数，为 0 时不限速
+	RateLimitBytesPerSec int64
+
+	// 报告 merge 进度的回调，在调用 MergeWithOptions 的协程中调用
+	OnProgress func(MergeProgress)
+}
+
+// WatchConfigs 订阅配置项
+type WatchConfigs struct {
+	// 缓冲区最多容纳多少组未被消费的事件
+	BufferSize int
+
+	// 缓冲区已满时的处理策略
+	OverflowPolicy WatchOverflowPolicy
+}
+
+type WatchOverflowPolicy = int8
+
+const (
+	// WatchOverflowClose 缓冲区已满时关闭订阅，Watcher.Err 返回 ErrWatchOverflow
+	WatchOverflowClose WatchOverflowPolicy = iota + 1
+
+	// WatchOverflowDropOldest 缓冲区已满时丢弃最旧的一组事件，丢弃的数量可以通过 Watcher.Dropped 获取
+	WatchOverflowDropOldest
+)
+
+type CompressionType = byte
+
+const (
+	// NoCompression 不压缩
+	NoCompression CompressionType = iota
+
+	// FlateCompression 标准库的 flate 算法，压缩率高
+	FlateCompression
+
+	// LZCompression LZ77 风格的算法，压缩率低一些，但是速度很快
+	LZCompression
+)
+
+type RecoveryMode = int8
+
+const (
+	// RecoveryTruncateTail 截断活跃文件末尾写了一半的记录，其他位置的损坏直接返回错误
+	// 有 hint 文件的数据文件打开时不会被读取，其中的损坏在读取对应的 key 时才会发现
+	RecoveryTruncateTail RecoveryMode = iota
+
+	// RecoverySkipCorrupted 截断活跃文件末尾写了一半的记录，并跳过其他位置损坏的记录
+	// 跳过的数据可以通过 DB.RecoveryReport 获取
+	RecoverySkipCorrupted
+
+	// RecoveryFailHard 遇到任何损坏的数据都返回错误
+	RecoveryFailHard
+)
+
 type IndexerType = int8
 
 const (
@@ -57,13 +200,23 @@ const (
 )
 
 var DefaultOptions = Configs{
-	DirPath:            os.TempDir(),
-	FileSize:           256 * 1024 * 1024, // 256MB
-	SyncWrites:         false,
-	IndexType:          BTree,
-	BytesPerSync:       0,
-	MMapAtStartup:      true,
-	DataFileMergeRatio: 0.5,
+	DirPath:              os.TempDir(),
+	FileSize:             256 * 1024 * 1024, // 256MB
+	SyncWrites:           false,
+	IndexType:            BTree,
+	BytesPerSync:         0,
+	MMapAtStartup:        true,
+	DataFileMergeRatio:   0.5,
+	ExpirySweepInterval:  0,
+	ExpirySweepBatchSize: 1000,
+	BlobThreshold:        0,
+	BlobGCRatio:          0.5,
+	Compression:          NoCompression,
+	RecoveryMode:         RecoveryTruncateTail,
+	IndexLoadWorkers:     0,
+	AutoMergeInterval:    0,
+	AutoMergeRatio:       0.5,
+	AutoMergeMinFiles:    1,
 }
 
 var DefaultIteratorConfigs = IteratorConfigs{
@@ -75,3 +228,13 @@ var DefaultWriteBatchConfigs = WriteBatchConfigs{
 	MaxBatchNum: 10000,
 	SyncWrites:  true,
 }
+
+var DefaultCompactConfigs = CompactConfigs{
+	MaxFiles:        1,
+	MinGarbageRatio: 0.5,
+}
+
+var DefaultWatchConfigs = WatchConfigs{
+	BufferSize:     1024,
+	OverflowPolicy: WatchOverflowClose,
+}
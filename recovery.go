@@ -0,0 +1,156 @@
+package rdb
+
+import (
+	"fmt"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/fio"
+	"os"
+)
+
+// CorruptRange 数据文件中损坏的一段数据，位置不包括文件头
+type CorruptRange struct {
+	Fid    uint32 `json:"fid"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+
+	err error
+}
+
+// RecoveryReport 打开数据库时处理损坏数据的情况
+type RecoveryReport struct {
+	Truncated []CorruptRange `json:"truncated"` // 活跃文件末尾被截断的数据
+	Skipped   []CorruptRange `json:"skipped"`   // 其他位置被跳过的数据，只在 RecoverySkipCorrupted 模式下出现
+}
+
+// RecoveryReport 获取打开数据库时截断以及跳过的数据
+func (db *DB) RecoveryReport() RecoveryReport {
+	return RecoveryReport{
+		Truncated: append([]CorruptRange(nil), db.recovery.Truncated...),
+		Skipped:   append([]CorruptRange(nil), db.recovery.Skipped...),
+	}
+}
+
+// recoverDataFile 重放数据文件，根据 RecoveryMode 处理其中损坏的数据，返回最后一条有效记录结束的位置
+func (db *DB) recoverDataFile(dataFile *data.DataFile, isActive bool) (int64, error) {
+	fileSize, err := dataFile.Size()
+	if err != nil {
+		return 0, err
+	}
+	var end int64
+	db.beginFileSeq(dataFile.FileId)
+	corrupted, err := scanDataFile(dataFile, fileSize, func(logRecord *data.LogRecord, offset int64, size int64) error {
+		db.replayLogRecord(dataFile.FileId, logRecord, offset, size)
+		end = offset + size
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := db.recoverCorruptRanges(dataFile, corrupted, end, isActive); err != nil {
+		return 0, err
+	}
+	return end, nil
+}
+
+// recoverCorruptRanges 根据 RecoveryMode 处理数据文件中损坏的数据，end 是最后一条有效记录结束的位置
+func (db *DB) recoverCorruptRanges(dataFile *data.DataFile, corrupted []CorruptRange, end int64, isActive bool) error {
+	for _, corrupt := range corrupted {
+		// 后面没有有效的记录，说明是写到一半时发生了崩溃
+		isTail := corrupt.Offset >= end
+		switch {
+		case db.config.RecoveryMode != RecoveryFailHard && isActive && isTail:
+			if err := db.truncateDataFile(dataFile, end); err != nil {
+				return err
+			}
+			db.recovery.Truncated = append(db.recovery.Truncated, corrupt)
+		case db.config.RecoveryMode == RecoverySkipCorrupted:
+			db.recovery.Skipped = append(db.recovery.Skipped, corrupt)
+			db.addReclaimSize(corrupt.Fid, corrupt.Size)
+		default:
+			return fmt.Errorf("data file %d is corrupted at offset %d: %w", corrupt.Fid, corrupt.Offset, corrupt.err)
+		}
+	}
+	return nil
+}
+
+// truncateDataFile 截断活跃文件末尾写了一半的记录
+func (db *DB) truncateDataFile(dataFile *data.DataFile, size int64) error {
+	// mmap 打开的文件只能读取
+	if _, ok := dataFile.IoManager.(*fio.MMap); ok {
+		if err := dataFile.SetIOManager(db.config.DirPath, fio.StandardFIO); err != nil {
+			return err
+		}
+	}
+	if err := dataFile.Truncate(size); err != nil {
+		return err
+	}
+	return dataFile.Sync()
+}
+
+// truncateTornHeader 清空文件头写了一半的活跃文件，然后重新打开
+func (db *DB) truncateTornHeader(fid uint32, cause error) (*data.DataFile, error) {
+	fileName := data.GetDataFileName(db.config.DirPath, fid)
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Truncate(fileName, 0); err != nil {
+		return nil, err
+	}
+	db.recovery.Truncated = append(db.recovery.Truncated, CorruptRange{
+		Fid:    fid,
+		Size:   info.Size(),
+		Reason: cause.Error(),
+		err:    cause,
+	})
+	return db.encryptDataFile(data.OpenDataFile(db.config.DirPath, fid, fio.StandardFIO))
+}
+
+// skipCorruptRange offset 是打开时跳过的损坏数据的起始位置时，返回这段数据结束的位置
+func (db *DB) skipCorruptRange(fid uint32, offset int64) (int64, bool) {
+	for _, corrupt := range db.recovery.Skipped {
+		if corrupt.Fid == fid && corrupt.Offset == offset {
+			return offset + corrupt.Size, true
+		}
+	}
+	return 0, false
+}
+
+// scanDataFile 依次读取数据文件中 fileSize 之前的每一条记录，遇到损坏的数据时从下一条可以解析的记录继续读取
+// 返回所有损坏的数据，读取文件失败等其他错误直接返回
+func scanDataFile(dataFile *data.DataFile, fileSize int64, fn func(logRecord *data.LogRecord, offset int64, size int64) error) ([]CorruptRange, error) {
+	var corrupted []CorruptRange
+	var offset int64
+	for offset < fileSize {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err == nil {
+			if fn != nil {
+				if err := fn(logRecord, offset, size); err != nil {
+					return corrupted, err
+				}
+			}
+			offset += size
+			continue
+		}
+
+		// 文件中间读到 EOF 说明遇到了全部是 0 的数据
+		if !isTornTail(err) {
+			return corrupted, err
+		}
+		next, nextErr := dataFile.NextValidRecord(offset, fileSize)
+		if nextErr != nil {
+			return corrupted, nextErr
+		}
+		corrupted = append(corrupted, CorruptRange{
+			Fid:    dataFile.FileId,
+			Offset: offset,
+			Size:   next - offset,
+			Reason: err.Error(),
+			err:    err,
+		})
+		offset = next
+	}
+	return corrupted, nil
+}
@@ -0,0 +1,260 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// corruptRecord 修改 key 对应的记录的最后一个字节
+func corruptRecord(t *testing.T, db *DB, key []byte) *data.Position {
+	pos := db.index.Get(key)
+	assert.NotNil(t, pos)
+	fileName := data.GetDataFileName(db.config.DirPath, pos.Fid)
+	buf, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	buf[data.FileHeaderSize+pos.Offset+int64(pos.Size)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, buf, 0644))
+	return pos
+}
+
+func TestDB_Recovery_TornTail(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recovery-torn")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 模拟写到一半时崩溃
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte("torn"), Value: utils.RandomValue(100)})
+	fileName := data.GetDataFileName(dir, 0)
+	info, _ := os.Stat(fileName)
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(encRecord[:len(encRecord)/2])
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	failOpts := opts
+	failOpts.RecoveryMode = RecoveryFailHard
+	_, err = Open(failOpts)
+	assert.NotNil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	report := db.RecoveryReport()
+	assert.Equal(t, 1, len(report.Truncated))
+	assert.Equal(t, int64(len(encRecord)/2), report.Truncated[0].Size)
+	truncated, _ := os.Stat(fileName)
+	assert.Equal(t, info.Size(), truncated.Size())
+
+	assert.Nil(t, db.Put([]byte("after"), []byte("recovery")))
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(db.RecoveryReport().Truncated))
+	value, err := db.Get([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("recovery"), value)
+	assert.Equal(t, 101, len(db.ListKeys()))
+}
+
+func TestDB_Recovery_TornHeader(t *testing.T) {
+	for name, key := range map[string][]byte{"plain": nil, "encrypted": bytes.Repeat([]byte("k"), 32)} {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions
+			dir, _ := os.MkdirTemp("", "bitcask-go-recovery-torn-header")
+			opts.DirPath = dir
+			opts.FileSize = 4 * 1024
+			opts.EncryptionKey = key
+			db, err := Open(opts)
+			defer destroyDB(db)
+			assert.Nil(t, err)
+			for i := 0; i < 100; i++ {
+				assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+			}
+			activeFid := db.activeFile.FileId
+			assert.Nil(t, db.Close())
+
+			// 模拟新的活跃文件只写了一半的文件头时崩溃
+			header := data.EncodeFileHeader(data.NewFileHeader(time.Now()))
+			if key != nil {
+				header = append(header, []byte("RDBE")...)
+			}
+			fileName := data.GetDataFileName(dir, activeFid+1)
+			assert.Nil(t, os.WriteFile(fileName, header[:len(header)-2], 0644))
+
+			failOpts := opts
+			failOpts.RecoveryMode = RecoveryFailHard
+			_, err = Open(failOpts)
+			assert.ErrorIs(t, err, data.ErrPartialFileHeader)
+
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			report := db.RecoveryReport()
+			assert.Equal(t, 1, len(report.Truncated))
+			assert.Equal(t, activeFid+1, report.Truncated[0].Fid)
+			assert.Equal(t, int64(len(header)-2), report.Truncated[0].Size)
+
+			assert.Nil(t, db.Put([]byte("after"), []byte("recovery")))
+			assert.Nil(t, db.Close())
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			value, err := db.Get([]byte("after"))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("recovery"), value)
+			assert.Equal(t, 101, len(db.ListKeys()))
+		})
+	}
+}
+
+func TestDB_Recovery_SkipCorrupted(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recovery-skip")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	pos := corruptRecord(t, db, utils.GetTestKey(10))
+	assert.Nil(t, db.Close())
+
+	// 默认不读取有 hint 文件的归档文件，读取损坏的记录时才返回错误
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(10))
+	assert.ErrorContains(t, err, data.ErrInvalidCRC.Error())
+	assert.Nil(t, db.Close())
+
+	// 没有 hint 文件时归档文件中间的损坏默认直接返回错误
+	assert.Nil(t, removeFileHint(dir, pos.Fid))
+	_, err = Open(opts)
+	assert.ErrorIs(t, err, data.ErrInvalidCRC)
+
+	opts.RecoveryMode = RecoverySkipCorrupted
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	report := db.RecoveryReport()
+	assert.Equal(t, 1, len(report.Skipped))
+	assert.Equal(t, pos.Fid, report.Skipped[0].Fid)
+	assert.Equal(t, pos.Offset, report.Skipped[0].Offset)
+	assert.Equal(t, int64(pos.Size), report.Skipped[0].Size)
+
+	_, err = db.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(utils.GetTestKey(11))
+	assert.Nil(t, err)
+	assert.Equal(t, 999, len(db.ListKeys()))
+
+	// merge 时同样跳过损坏的数据
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	opts.RecoveryMode = RecoveryTruncateTail
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 999, len(db.ListKeys()))
+}
+
+func TestRepair(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-repair")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	// 损坏 merge 生成的数据文件，hint 文件中的位置需要重新生成
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 1000; i < 1100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	pos := corruptRecord(t, db, utils.GetTestKey(10))
+	assert.Nil(t, db.Close())
+
+	report, err := Repair(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{pos.Fid}, report.RewrittenFiles)
+	assert.Equal(t, 1, len(report.Lost))
+	assert.Equal(t, int64(pos.Size), report.LostBytes)
+	assert.True(t, report.HintRebuilt)
+
+	buf, err := os.ReadFile(filepath.Join(dir, repairReportFileName))
+	assert.Nil(t, err)
+	saved := &RepairReport{}
+	assert.Nil(t, json.Unmarshal(buf, saved))
+	assert.Equal(t, report.LostBytes, saved.LostBytes)
+	_, err = os.Stat(data.GetDataFileName(dir, pos.Fid) + corruptFileSuffix)
+	assert.Nil(t, err)
+	// 重写的数据文件的 hint 文件已经失效
+	_, err = os.Stat(data.GetFileHintName(dir, pos.Fid))
+	assert.True(t, os.IsNotExist(err))
+
+	// 修复之后没有损坏的数据
+	report, err = Repair(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(report.Lost))
+
+	opts.RecoveryMode = RecoveryFailHard
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for _, i := range []int{0, 11, 999, 1000, 1099} {
+		_, err = db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 1099, len(db.ListKeys()))
+}
+
+func TestRepair_BPlusTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-repair-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	pos := corruptRecord(t, db, utils.GetTestKey(10))
+	assert.Nil(t, db.Close())
+
+	// B+ 树索引中的位置无法重建，不能重写数据文件
+	fileName := data.GetDataFileName(dir, pos.Fid)
+	before, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	_, err = Repair(dir)
+	assert.ErrorIs(t, err, ErrRepairBPlusTreeIndex)
+	after, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+	_, err = os.Stat(fileName + corruptFileSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,253 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/gofrs/flock"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/fio"
+	"github.com/youzeliang/rdb/index"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	repairReportFileName = "repair-report.json"
+	repairDirName        = "repair"
+	corruptFileSuffix    = ".corrupt"
+)
+
+// RepairReport Repair 的结果，同时以 json 格式写到数据目录的 repair-report.json 文件中
+type RepairReport struct {
+	Dir            string         `json:"dir"`
+	RepairedAt     time.Time      `json:"repaired_at"`
+	RewrittenFiles []uint32       `json:"rewritten_files"` // 重写过的数据文件，原来的文件加上 .corrupt 后缀保留
+	Lost           []CorruptRange `json:"lost"`            // 丢弃的损坏数据
+	LostBytes      int64          `json:"lost_bytes"`
+	HintRebuilt    bool           `json:"hint_rebuilt"` // 是否重新生成了 hint 文件
+}
+
+// Repair 修复数据目录，重写包含损坏数据的数据文件，只保留其中可以正确解析的记录
+// 数据库不能处于打开状态，加密的数据目录使用 RepairWithOptions
+func Repair(dir string) (*RepairReport, error) {
+	configs := DefaultOptions
+	configs.DirPath = dir
+	return RepairWithOptions(configs)
+}
+
+// RepairWithOptions 使用指定的配置项修复数据目录
+func RepairWithOptions(configs Configs) (*RepairReport, error) {
+	if err := checkOptions(configs); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	dir := configs.DirPath
+	fileLock := flock.New(filepath.Join(dir, fileLockName))
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock database: %v", err)
+	}
+	if !hold {
+		return nil, ErrDatabaseIsUsing
+	}
+	defer func() {
+		_ = fileLock.Unlock()
+	}()
+
+	// B+ 树索引持久化了记录的位置，并且不会通过重放数据文件重建，所以不能重写数据文件
+	_, err = os.Stat(filepath.Join(dir, index.BPlusTreeIndexFileName))
+	hasBPTreeIndex := err == nil
+
+	provider := configs.keyProvider()
+	report := &RepairReport{Dir: dir, RepairedAt: time.Now()}
+	fileIds, err := getDataFileIds(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fid := range fileIds {
+		lost, err := repairDataFile(dir, uint32(fid), provider, hasBPTreeIndex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to repair data file %d: %w", fid, err)
+		}
+		if len(lost) == 0 {
+			continue
+		}
+		report.RewrittenFiles = append(report.RewrittenFiles, uint32(fid))
+		for _, corrupt := range lost {
+			report.Lost = append(report.Lost, corrupt)
+			report.LostBytes += corrupt.Size
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(dir, repairDirName)); err != nil {
+		return nil, err
+	}
+
+	// hint 文件中记录的位置可能已经变化，根据 merge 生成的数据文件重新生成
+	if _, err := os.Stat(filepath.Join(dir, data.MergeFinishedFileName)); err == nil {
+		if err := rebuildHintFile(dir, provider); err != nil {
+			return nil, fmt.Errorf("failed to rebuild hint file: %w", err)
+		}
+		report.HintRebuilt = true
+	}
+
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, repairReportFileName), buf, 0644); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// repairDataFile 数据文件中有损坏的数据时，将有效的记录写到新的文件中再替换原来的文件
+// hasBPTreeIndex 为 true 时发现损坏的数据直接返回 ErrRepairBPlusTreeIndex，不修改文件
+func repairDataFile(dir string, fid uint32, provider KeyProvider, hasBPTreeIndex bool) ([]CorruptRange, error) {
+	encrypt := encryptWith(provider)
+	dataFile, err := encrypt(data.OpenDataFile(dir, fid, fio.StandardFIO))
+	if err != nil {
+		return nil, err
+	}
+	defer dataFile.Close()
+
+	fileSize, err := dataFile.Size()
+	if err != nil {
+		return nil, err
+	}
+	corrupted, err := scanDataFile(dataFile, fileSize, nil)
+	if err != nil || len(corrupted) == 0 {
+		return nil, err
+	}
+	if hasBPTreeIndex {
+		return nil, ErrRepairBPlusTreeIndex
+	}
+
+	repairPath := filepath.Join(dir, repairDirName)
+	if err := os.MkdirAll(repairPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	fileName := data.GetDataFileName(repairPath, fid)
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	newFile, err := encrypt(data.OpenDataFile(repairPath, fid, fio.StandardFIO))
+	if err != nil {
+		return nil, err
+	}
+	defer newFile.Close()
+	_, err = scanDataFile(dataFile, fileSize, func(logRecord *data.LogRecord, _ int64, _ int64) error {
+		// 读出的 value 已经解压，重新压缩之后再写入
+		if logRecord.Compression != data.CompressionNone {
+			logRecord.Compression, logRecord.Value = data.CompressValue(logRecord.Compression, logRecord.Value)
+		}
+		encRecord, _ := data.EncodeLogRecord(logRecord)
+		return newFile.Write(encRecord)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := newFile.Sync(); err != nil {
+		return nil, err
+	}
+
+	// 原来的 hint 文件和修复之后的数据文件不一致
+	if err := removeFileHint(dir, fid); err != nil {
+		return nil, err
+	}
+	originalName := data.GetDataFileName(dir, fid)
+	if err := os.Rename(originalName, originalName+corruptFileSuffix); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(fileName, originalName); err != nil {
+		return nil, err
+	}
+	return corrupted, nil
+}
+
+// rebuildHintFile 重放 merge 生成的数据文件，重新生成 hint 文件
+func rebuildHintFile(dir string, provider KeyProvider) error {
+	encrypt := encryptWith(provider)
+	mergeFinishedFile, err := encrypt(data.OpenMergeFinishedFile(dir))
+	if err != nil {
+		return err
+	}
+	record, _, err := mergeFinishedFile.ReadLogRecord(0)
+	_ = mergeFinishedFile.Close()
+	if err != nil {
+		return err
+	}
+	nonMergeFileId, err := strconv.Atoi(string(record.Value))
+	if err != nil {
+		return err
+	}
+
+	type hintEntry struct {
+		key    []byte
+		family uint32
+		pos    *data.Position
+	}
+	entries := make(map[string]*hintEntry)
+	fileIds, err := getDataFileIds(dir)
+	if err != nil {
+		return err
+	}
+	for _, fid := range fileIds {
+		if fid >= nonMergeFileId {
+			break
+		}
+		dataFile, err := encrypt(data.OpenDataFile(dir, uint32(fid), fio.StandardFIO))
+		if err != nil {
+			return err
+		}
+		fileSize, err := dataFile.Size()
+		if err != nil {
+			_ = dataFile.Close()
+			return err
+		}
+		_, err = scanDataFile(dataFile, fileSize, func(logRecord *data.LogRecord, offset int64, size int64) error {
+			realKey, _ := parseLogRecordKey(logRecord.Key)
+			entryKey := string(binary.AppendUvarint(nil, uint64(logRecord.ColumnFamily))) + string(realKey)
+			switch logRecord.Type {
+			case data.LogRecordNormal:
+				pos := &data.Position{Fid: uint32(fid), Offset: offset, Size: uint32(size), Expire: logRecord.Expire}
+				if logRecord.Blob {
+					pos.Blob = data.DecodeBlobPointer(logRecord.Value)
+				}
+				entries[entryKey] = &hintEntry{key: realKey, family: logRecord.ColumnFamily, pos: pos}
+			case data.LogRecordDeleted:
+				delete(entries, entryKey)
+			}
+			return nil
+		})
+		_ = dataFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	hintFileName := filepath.Join(dir, data.HintFileName)
+	tmpFileName := hintFileName + ".tmp"
+	if err := os.Remove(tmpFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	hintFile, err := encrypt(data.OpenTmpFile(tmpFileName))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := hintFile.WriteHintRecord(entry.key, entry.family, entry.pos); err != nil {
+			_ = hintFile.Close()
+			return err
+		}
+	}
+	if err := hintFile.Sync(); err != nil {
+		_ = hintFile.Close()
+		return err
+	}
+	if err := hintFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, hintFileName)
+}
@@ -0,0 +1,157 @@
+package rdb
+
+import (
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/fio"
+	"github.com/youzeliang/rdb/index"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// OpenSecondary 以从库的方式打开其他进程正在写入的数据目录
+// 从库是只读的，通过 TryCatchUp 或者配置 CatchUpInterval 读取主库新写入的数据
+func OpenSecondary(configs Configs) (*DB, error) {
+	configs.ReadOnly = true
+	db, err := Open(configs)
+	if err != nil {
+		return nil, err
+	}
+	db.secondary = true
+
+	if configs.CatchUpInterval > 0 {
+		db.startCatchUp()
+	}
+	return db, nil
+}
+
+// TryCatchUp 读取主库在活跃文件中新追加的数据以及新创建的数据文件，并更新内存索引
+// 如果主库在此期间完成了 merge，则重新加载整个数据目录
+func (db *DB) TryCatchUp() error {
+	if !db.secondary {
+		return ErrNotSecondary
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	merged, err := db.mergeChanged()
+	if err != nil {
+		return err
+	}
+	if merged {
+		return db.reload()
+	}
+
+	// 主库可能创建了新的列族
+	if err := db.loadColumnFamilies(); err != nil {
+		return err
+	}
+
+	fileIds, err := getDataFileIds(db.config.DirPath)
+	if err != nil {
+		return err
+	}
+	for _, fid := range fileIds {
+		if db.activeFile != nil && uint32(fid) <= db.activeFile.FileId {
+			continue
+		}
+		// 出现了新的数据文件，说明旧的活跃文件已经写满，先把剩余的数据读完
+		if err := db.catchUpActiveFile(); err != nil {
+			return err
+		}
+		dataFile, err := db.encryptDataFile(data.OpenDataFile(db.config.DirPath, uint32(fid), fio.StandardFIO))
+		if err != nil {
+			return err
+		}
+		if db.activeFile != nil {
+			db.archivedFiles[db.activeFile.FileId] = db.activeFile
+		}
+		db.activeFile = dataFile
+	}
+	return db.catchUpActiveFile()
+}
+
+// startCatchUp 启动后台定时追赶主库的协程
+func (db *DB) startCatchUp() {
+	db.bgTasks.Add(1)
+	go func() {
+		defer db.bgTasks.Done()
+		ticker := time.NewTicker(db.config.CatchUpInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.closeCh:
+				return
+			case <-ticker.C:
+				// 失败时等待下一次重试，例如主库正在替换 merge 之后的文件
+				_ = db.TryCatchUp()
+			}
+		}
+	}()
+}
+
+// catchUpActiveFile 从上一次读到的位置继续读取活跃文件，调用前必须持有互斥锁
+func (db *DB) catchUpActiveFile() error {
+	if db.activeFile == nil {
+		return nil
+	}
+	offset, err := db.replayDataFile(db.activeFile, db.activeFile.WriteOff, true)
+	if err != nil {
+		return err
+	}
+	db.activeFile.WriteOff = offset
+	return nil
+}
+
+// mergeChanged 判断主库是否在上一次加载之后完成了 merge
+func (db *DB) mergeChanged() (bool, error) {
+	info, err := os.Stat(filepath.Join(db.config.DirPath, data.MergeFinishedFileName))
+	if os.IsNotExist(err) {
+		return !db.mergeMarker.IsZero(), nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !info.ModTime().Equal(db.mergeMarker), nil
+}
+
+// reload 丢弃当前的内存索引和数据文件，重新加载整个数据目录，调用前必须持有互斥锁
+func (db *DB) reload() error {
+	if db.activeFile != nil {
+		if err := db.closeDataFiles(); err != nil {
+			return err
+		}
+	}
+	db.activeFile = nil
+	db.archivedFiles = make(map[uint32]*data.DataFile)
+	db.reclaimSize = 0
+	db.fileReclaimSize = make(map[uint32]int64)
+	db.fileSeqRanges = make(map[uint32]seqRange)
+	db.blobLive = make(map[uint32]int64)
+	db.pendingTxns = make(map[uint64][]*data.TransactionRecord)
+	db.mergeMarker = time.Time{}
+	for _, cf := range db.familyByID {
+		_ = cf.index.Close()
+		cf.index = index.NewIndexer(cf.indexType, db.config.DirPath, db.config.SyncWrites)
+	}
+	db.index = db.defaultFamily.index
+
+	if err := db.loadDataFiles(); err != nil {
+		return err
+	}
+	if err := db.loadColumnFamilies(); err != nil {
+		return err
+	}
+	if err := db.loadIndexFromHintFile(); err != nil {
+		return err
+	}
+	if err := db.loadIndexFromDataFiles(); err != nil {
+		return err
+	}
+	db.pruneReclaimSize()
+	if db.config.MMapAtStartup {
+		return db.resetIoType()
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package rdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_OpenSecondary(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary")
+	opts.DirPath = dir
+	opts.FileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+
+	secondary, err := OpenSecondary(opts)
+	assert.Nil(t, err)
+	defer secondary.Close()
+	assert.Equal(t, 100, len(secondary.ListKeys()))
+	assert.Equal(t, ErrReadOnly, secondary.Put(utils.GetTestKey(1), []byte("a")))
+	assert.Equal(t, ErrNotSecondary, db.TryCatchUp())
+
+	// 主库继续写入，写满之后会切换新的数据文件
+	for i := 100; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	assert.Nil(t, wb.Put([]byte("batch-key"), []byte("batch-value")))
+	assert.Nil(t, wb.Commit())
+	users, err := db.CreateColumnFamily("users", DefaultColumnFamilyConfigs)
+	assert.Nil(t, err)
+	assert.Nil(t, users.Put(utils.GetTestKey(1), []byte("user")))
+
+	assert.Equal(t, 100, len(secondary.ListKeys()))
+	assert.Nil(t, secondary.TryCatchUp())
+	assert.Equal(t, 1951, len(secondary.ListKeys()))
+	assert.Equal(t, db.Stat().DataFileNum, secondary.Stat().DataFileNum)
+	_, err = secondary.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := secondary.Get([]byte("batch-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("batch-value"), val)
+	cf, err := secondary.ColumnFamily("users")
+	assert.Nil(t, err)
+	val, err = cf.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("user"), val)
+
+	// 没有新数据时追赶不会有任何变化
+	assert.Nil(t, secondary.TryCatchUp())
+	assert.Equal(t, 1951, len(secondary.ListKeys()))
+}
+
+func TestDB_OpenSecondary_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary-merge")
+	opts.DirPath = dir
+	opts.FileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("new")))
+	}
+
+	secondary, err := OpenSecondary(opts)
+	assert.Nil(t, err)
+	defer secondary.Close()
+
+	// 主库 merge 之后重启，merge 的结果替换旧的数据文件
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("after-merge"), []byte("ok")))
+
+	assert.Nil(t, secondary.TryCatchUp())
+	assert.Equal(t, 1001, len(secondary.ListKeys()))
+	assert.Equal(t, db.Stat().DataFileNum, secondary.Stat().DataFileNum)
+	val, err := secondary.Get(utils.GetTestKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+	val, err = secondary.Get([]byte("after-merge"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ok"), val)
+}
+
+func TestDB_OpenSecondary_CatchUpInterval(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary-interval")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("a")))
+
+	secondaryOpts := opts
+	secondaryOpts.CatchUpInterval = 10 * time.Millisecond
+	secondary, err := OpenSecondary(secondaryOpts)
+	assert.Nil(t, err)
+	defer secondary.Close()
+
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("b")))
+	assert.Eventually(t, func() bool {
+		val, err := secondary.Get(utils.GetTestKey(2))
+		return err == nil && string(val) == "b"
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,147 @@
+package rdb
+
+import (
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/index"
+	"sync"
+	"time"
+)
+
+// Snapshot 数据库某一时刻的只读快照
+// 快照持有创建时刻索引的副本，并引用当时所有的数据文件，
+// 因为数据文件只会追加写入，所以通过旧的索引位置总能读到创建快照时的数据
+type Snapshot struct {
+	db        *DB
+	index     index.Indexer             // 创建快照时的索引副本
+	dataFiles map[uint32]*data.DataFile // 创建快照时的数据文件
+	blobFiles []*data.BlobFile          // 创建快照时的 blob 文件
+	once      sync.Once
+}
+
+// NewSnapshot 创建一个当前时刻的只读快照，使用完成后需要调用 Release 释放
+func (db *DB) NewSnapshot() *Snapshot {
+	// 加读锁，保证 WriteBatch 的提交不会只有一部分被快照看到，拷贝索引期间不阻塞读取
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	snapshot := &Snapshot{
+		db:        db,
+		index:     db.index.Clone(),
+		dataFiles: make(map[uint32]*data.DataFile, len(db.archivedFiles)+1),
+	}
+	for fid, file := range db.archivedFiles {
+		snapshot.dataFiles[fid] = file
+	}
+	if db.activeFile != nil {
+		snapshot.dataFiles[db.activeFile.FileId] = db.activeFile
+	}
+
+	// 引用数据文件，防止被关闭
+	db.pinDataFiles(snapshot.dataFiles)
+	db.blobLock.RLock()
+	for _, blobFile := range db.blobFiles {
+		snapshot.blobFiles = append(snapshot.blobFiles, blobFile)
+	}
+	db.blobLock.RUnlock()
+	db.pinBlobFiles(snapshot.blobFiles)
+	return snapshot
+}
+
+// Get 根据 key 读取快照中的数据
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	logRecordPos := s.index.Get(key)
+	if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return s.getValueByPosition(logRecordPos)
+}
+
+// NewIterator 创建快照上的迭代器
+func (s *Snapshot) NewIterator(opts IteratorConfigs) *Iterator {
+	return &Iterator{
+		db:        s.db,
+		snapshot:  s,
+		indexIter: s.index.Iterator(opts.Reverse),
+		configs:   opts,
+	}
+}
+
+// Fold 遍历快照中所有的数据，并执行用户指定的操作，函数返回 false 时终止遍历
+func (s *Snapshot) Fold(fn func(key []byte, value []byte) bool) error {
+	iterator := s.index.Iterator(false)
+	defer iterator.Close()
+	now := time.Now().UnixNano()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
+		value, err := s.getValueByPosition(iterator.Value())
+		if err != nil {
+			return err
+		}
+		if !fn(iterator.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Release 释放快照，解除对数据文件的引用，多次调用是安全的
+func (s *Snapshot) Release() {
+	s.once.Do(func() {
+		db := s.db
+		db.mutex.Lock()
+		defer db.mutex.Unlock()
+		for _, file := range s.dataFiles {
+			db.unpinDataFile(file)
+		}
+		s.dataFiles = nil
+		db.unpinBlobFiles(s.blobFiles)
+		s.blobFiles = nil
+		_ = s.index.Close()
+	})
+}
+
+func (s *Snapshot) getValueByPosition(pos *data.Position) ([]byte, error) {
+	return s.db.readValueFromFile(s.dataFiles[pos.Fid], pos)
+}
+
+// pinDataFiles 引用数据文件，防止被关闭，调用前必须持有读锁或者互斥锁
+func (db *DB) pinDataFiles(files map[uint32]*data.DataFile) {
+	db.pinLock.Lock()
+	defer db.pinLock.Unlock()
+	for _, file := range files {
+		db.pinnedFiles[file]++
+	}
+}
+
+// retireDataFile 关闭不再使用的数据文件，如果仍被快照引用，则延迟到快照释放时关闭
+// 调用前必须持有互斥锁
+func (db *DB) retireDataFile(file *data.DataFile) error {
+	db.pinLock.Lock()
+	defer db.pinLock.Unlock()
+	if db.pinnedFiles[file] > 0 {
+		db.retiredFiles[file] = true
+		return nil
+	}
+	return file.Close()
+}
+
+// unpinDataFile 解除快照对数据文件的引用，调用前必须持有互斥锁
+func (db *DB) unpinDataFile(file *data.DataFile) {
+	db.pinLock.Lock()
+	defer db.pinLock.Unlock()
+	db.pinnedFiles[file]--
+	if db.pinnedFiles[file] > 0 {
+		return
+	}
+	delete(db.pinnedFiles, file)
+	if db.retiredFiles[file] {
+		delete(db.retiredFiles, file)
+		_ = file.Close()
+	}
+}
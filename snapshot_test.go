@@ -0,0 +1,140 @@
+package rdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestDB_NewSnapshot(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-1")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+
+	// 创建快照之后的修改对快照不可见
+	for i := 0; i < 50; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 50; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("new value"))
+		assert.Nil(t, err)
+	}
+	err = db.Put(utils.GetTestKey(200), []byte("new key"))
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		val, err := snapshot.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	_, err = snapshot.Get(utils.GetTestKey(200))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 实时的数据库读取到的是新的值
+	_, err = db.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get(utils.GetTestKey(60))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new value"), val)
+}
+
+func TestSnapshot_Iterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-2")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), []byte("changed")))
+	}
+	assert.Nil(t, wb.Commit())
+
+	iterator := snapshot.NewIterator(DefaultIteratorConfigs)
+	defer iterator.Close()
+	var count int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		val, err := iterator.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, iterator.Key(), val)
+		count++
+	}
+	assert.Equal(t, 10, count)
+
+	count = 0
+	err = snapshot.Fold(func(key []byte, value []byte) bool {
+		assert.Equal(t, key, value)
+		count++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, count)
+}
+
+func TestSnapshot_ConcurrentWrites(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-3")
+	opts.DirPath = dir
+	opts.FileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snapshot := db.NewSnapshot()
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			_ = db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		}
+	}()
+
+	err = snapshot.Fold(func(key []byte, value []byte) bool {
+		assert.Equal(t, key, value)
+		return true
+	})
+	assert.Nil(t, err)
+	wg.Wait()
+
+	// 数据库关闭之后，快照引用的数据文件直到释放时才会关闭
+	err = db.Close()
+	assert.Nil(t, err)
+	val, err := snapshot.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+	snapshot.Release()
+	assert.Equal(t, 0, len(db.pinnedFiles))
+	assert.Equal(t, 0, len(db.retiredFiles))
+}
@@ -0,0 +1,336 @@
+package rdb
+
+import (
+	"bytes"
+	"github.com/youzeliang/rdb/data"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Txn 乐观并发控制的读写事务
+// 读操作能看到事务自身暂存的写入，提交时会检查事务读取过的 key 是否被其他提交修改过，
+// 如果被修改过则提交失败，返回 ErrTxnConflict
+type Txn struct {
+	configs       WriteBatchConfigs
+	mu            *sync.Mutex
+	db            *DB
+	pendingWrites map[string]*data.LogRecord // 暂存用户写入的数据
+	readSet       map[string]*txnRead        // 事务读取过的 key，以及读取时的版本
+	finished      bool                       // 事务是否已经提交或者回滚
+}
+
+// txnRead 事务第一次读取 key 时看到的版本
+// merge、Compact 以及 blob 文件的重写会移动记录的位置，但是不会改变记录的序列号，所以位置不同时以序列号为准
+type txnRead struct {
+	pos        *data.Position // 读取时在索引中的位置，key 不存在时为 nil
+	seq        uint64         // 记录的序列号
+	generation uint64         // 读取时数据文件被替换的次数，没有变化时位置相同就是同一条记录
+}
+
+// Begin 开启一个读写事务
+func (db *DB) Begin() *Txn {
+	if db.config.IndexType == BPlusTree && !db.seqNoFileExists && !db.isInitial {
+		panic("cannot use transaction, seq no file not exists")
+	}
+
+	return &Txn{
+		configs:       DefaultWriteBatchConfigs,
+		mu:            new(sync.Mutex),
+		db:            db,
+		pendingWrites: make(map[string]*data.LogRecord),
+		readSet:       make(map[string]*txnRead),
+	}
+}
+
+// Get 读取数据，优先从事务暂存的写入中读取
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return nil, ErrTxnFinished
+	}
+
+	if record := txn.pendingWrites[string(key)]; record != nil {
+		if record.Type == data.LogRecordDeleted {
+			return nil, ErrKeyNotFound
+		}
+		return record.Value, nil
+	}
+
+	txn.db.mutex.RLock()
+	defer txn.db.mutex.RUnlock()
+
+	logRecordPos := txn.db.index.Get(key)
+	if err := txn.trackRead(key, logRecordPos); err != nil {
+		return nil, err
+	}
+	if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return txn.db.getValueByPosition(logRecordPos)
+}
+
+// Put 暂存写入的数据，提交时才会写到数据文件中
+func (txn *Txn) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return ErrTxnFinished
+	}
+
+	txn.pendingWrites[string(key)] = &data.LogRecord{
+		Key:   key,
+		Value: value,
+	}
+	return nil
+}
+
+// Delete 暂存删除操作，提交时才会生效
+func (txn *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return ErrTxnFinished
+	}
+
+	txn.pendingWrites[string(key)] = &data.LogRecord{
+		Key:  key,
+		Type: data.LogRecordDeleted,
+	}
+	return nil
+}
+
+// Commit 提交事务，读取过的 key 被其他提交修改过时返回 ErrTxnConflict
+func (txn *Txn) Commit() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	txn.finished = true
+
+	if uint(len(txn.pendingWrites)) > txn.configs.MaxBatchNum {
+		return ErrExceedMaxBatchNum
+	}
+
+	blobs, err := txn.db.separatePendingWrites(txn.pendingWrites)
+	if err != nil {
+		return err
+	}
+	return txn.db.write(txn.configs.SyncWrites || txn.db.config.SyncWrites, func() error {
+		// 校验读取过的数据是否被修改
+		for key, read := range txn.readSet {
+			modified, err := txn.modifiedSince(key, read)
+			if err != nil {
+				return err
+			}
+			if modified {
+				return ErrTxnConflict
+			}
+		}
+
+		if len(txn.pendingWrites) == 0 {
+			return nil
+		}
+		return txn.db.commitPendingWrites(txn.pendingWrites, blobs)
+	})
+}
+
+// Rollback 放弃事务中所有暂存的写入
+func (txn *Txn) Rollback() {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	txn.finished = true
+	txn.pendingWrites = nil
+	txn.readSet = nil
+}
+
+// trackRead 记录第一次读取 key 时的版本，用于提交时的冲突检测，调用前必须持有读锁
+func (txn *Txn) trackRead(key []byte, pos *data.Position) error {
+	if txn.finished {
+		return nil
+	}
+	if _, ok := txn.readSet[string(key)]; ok {
+		return nil
+	}
+	read := &txnRead{pos: pos, generation: atomic.LoadUint64(&txn.db.fileGeneration)}
+	if pos != nil {
+		logRecord, err := txn.db.readLogRecordByPosition(pos)
+		if err != nil {
+			return err
+		}
+		read.seq = logRecord.Seq
+	}
+	txn.readSet[string(key)] = read
+	return nil
+}
+
+func samePosition(a, b *data.Position) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Fid == b.Fid && a.Offset == b.Offset
+}
+
+// modifiedSince key 在第一次读取之后是否被其他提交修改过，调用前必须持有互斥锁
+func (txn *Txn) modifiedSince(key string, read *txnRead) (bool, error) {
+	pos := txn.db.lookupIndex(txn.db.index, []byte(key))
+	if pos == nil || read.pos == nil {
+		return pos != nil || read.pos != nil, nil
+	}
+	if samePosition(pos, read.pos) && read.generation == atomic.LoadUint64(&txn.db.fileGeneration) {
+		return false, nil
+	}
+	// 记录可能只是被移动了位置，比较序列号
+	logRecord, err := txn.db.readLogRecordByPosition(pos)
+	if err != nil {
+		return false, err
+	}
+	return logRecord.Seq != read.seq, nil
+}
+
+// TxnIterator 事务迭代器，将事务暂存的写入与数据库中的数据合并后遍历
+type TxnIterator struct {
+	txn         *Txn
+	dbIter      *Iterator
+	pending     []*data.LogRecord // 按遍历顺序排好序的暂存数据
+	overridden  map[string]bool   // 被暂存数据覆盖的 key
+	pendingIdx  int
+	fromPending bool // 当前位置的数据是否来自暂存数据
+	configs     IteratorConfigs
+}
+
+// Iterator 创建事务迭代器，迭代器创建之后事务中新的写入对其不可见
+func (txn *Txn) Iterator(opts IteratorConfigs) *TxnIterator {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	var pending []*data.LogRecord
+	overridden := make(map[string]bool)
+	for key, record := range txn.pendingWrites {
+		if bytes.HasPrefix(record.Key, opts.Prefix) {
+			pending = append(pending, record)
+			overridden[key] = true
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if opts.Reverse {
+			return bytes.Compare(pending[i].Key, pending[j].Key) > 0
+		}
+		return bytes.Compare(pending[i].Key, pending[j].Key) < 0
+	})
+
+	it := &TxnIterator{
+		txn:        txn,
+		dbIter:     txn.db.NewIterator(opts),
+		pending:    pending,
+		overridden: overridden,
+		configs:    opts,
+	}
+	it.settle()
+	return it
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (it *TxnIterator) Rewind() {
+	it.dbIter.Rewind()
+	it.pendingIdx = 0
+	it.settle()
+}
+
+// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+func (it *TxnIterator) Seek(key []byte) {
+	it.dbIter.Seek(key)
+	it.pendingIdx = sort.Search(len(it.pending), func(i int) bool {
+		if it.configs.Reverse {
+			return bytes.Compare(it.pending[i].Key, key) <= 0
+		}
+		return bytes.Compare(it.pending[i].Key, key) >= 0
+	})
+	it.settle()
+}
+
+// Next 跳转到下一个 key
+func (it *TxnIterator) Next() {
+	if it.fromPending {
+		it.pendingIdx++
+	} else {
+		it.dbIter.Next()
+	}
+	it.settle()
+}
+
+// Valid 是否有效，即是否已经遍历完了所有的 key
+func (it *TxnIterator) Valid() bool {
+	return it.pendingIdx < len(it.pending) || it.dbIter.Valid()
+}
+
+// Key 当前遍历位置的 Key 数据
+func (it *TxnIterator) Key() []byte {
+	if it.fromPending {
+		return it.pending[it.pendingIdx].Key
+	}
+	return it.dbIter.Key()
+}
+
+// Value 当前遍历位置的 Value 数据，读取数据库中的数据会参与提交时的冲突检测
+func (it *TxnIterator) Value() ([]byte, error) {
+	if it.fromPending {
+		return it.pending[it.pendingIdx].Value, nil
+	}
+
+	it.txn.mu.Lock()
+	it.txn.db.mutex.RLock()
+	err := it.txn.trackRead(it.dbIter.Key(), it.dbIter.position())
+	it.txn.db.mutex.RUnlock()
+	it.txn.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return it.dbIter.Value()
+}
+
+// Close 关闭迭代器，释放相应资源
+func (it *TxnIterator) Close() {
+	it.dbIter.Close()
+	it.pending = nil
+}
+
+// settle 跳过被暂存数据覆盖的 key 和暂存的删除操作，并确定当前位置的数据来源
+func (it *TxnIterator) settle() {
+	for it.pendingIdx < len(it.pending) && it.pending[it.pendingIdx].Type == data.LogRecordDeleted {
+		it.pendingIdx++
+	}
+	for it.dbIter.Valid() && it.overridden[string(it.dbIter.Key())] {
+		it.dbIter.Next()
+	}
+
+	if it.pendingIdx >= len(it.pending) {
+		it.fromPending = false
+		return
+	}
+	if !it.dbIter.Valid() {
+		it.fromPending = true
+		return
+	}
+	cmp := bytes.Compare(it.pending[it.pendingIdx].Key, it.dbIter.Key())
+	if it.configs.Reverse {
+		it.fromPending = cmp > 0
+	} else {
+		it.fromPending = cmp < 0
+	}
+}
@@ -0,0 +1,183 @@
+package rdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"testing"
+)
+
+func TestDB_Txn(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-1")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+
+	txn := db.Begin()
+	val, err := txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	// 事务中能读到自己的写入
+	assert.Nil(t, txn.Put(utils.GetTestKey(1), []byte("v2")))
+	assert.Nil(t, txn.Put(utils.GetTestKey(2), []byte("v2")))
+	val, err = txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	assert.Nil(t, txn.Delete(utils.GetTestKey(2)))
+	_, err = txn.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 提交之前对数据库不可见
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	assert.Nil(t, txn.Commit())
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	assert.Equal(t, ErrTxnFinished, txn.Commit())
+
+	// 重启之后数据仍然存在
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	val, err = db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	_, err = db2.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_Txn_Conflict(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-2")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("v1")))
+
+	txn1 := db.Begin()
+	txn2 := db.Begin()
+	_, err = txn1.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = txn2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	// 读取不存在的 key，被其他事务写入之后同样是冲突
+	_, err = txn2.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, txn1.Put(utils.GetTestKey(1), []byte("txn1")))
+	assert.Nil(t, txn2.Put(utils.GetTestKey(1), []byte("txn2")))
+	assert.Nil(t, txn1.Commit())
+	assert.Equal(t, ErrTxnConflict, txn2.Commit())
+
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("txn1"), val)
+
+	txn3 := db.Begin()
+	_, err = txn3.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("v2")))
+	assert.Nil(t, txn3.Put(utils.GetTestKey(3), []byte("v3")))
+	assert.Equal(t, ErrTxnConflict, txn3.Commit())
+
+	// 只写不读的事务不会冲突
+	txn4 := db.Begin()
+	assert.Nil(t, txn4.Put(utils.GetTestKey(1), []byte("txn4")))
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("other")))
+	assert.Nil(t, txn4.Commit())
+}
+
+func TestDB_Txn_ConflictAfterMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-merge")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	txn1 := db.Begin()
+	txn2 := db.Begin()
+	_, err = txn1.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = txn2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+
+	// merge 只移动了记录的位置，不是冲突
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, txn1.Put(utils.GetTestKey(1), []byte("txn1")))
+	assert.Nil(t, txn1.Commit())
+
+	// merge 之后被其他提交修改过仍然是冲突
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("other")))
+	assert.Nil(t, txn2.Put(utils.GetTestKey(2), []byte("txn2")))
+	assert.Equal(t, ErrTxnConflict, txn2.Commit())
+
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("txn1"), val)
+}
+
+func TestTxn_Iterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-3")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.Put([]byte("a"), []byte("db-a")))
+	assert.Nil(t, db.Put([]byte("c"), []byte("db-c")))
+	assert.Nil(t, db.Put([]byte("e"), []byte("db-e")))
+
+	txn := db.Begin()
+	assert.Nil(t, txn.Put([]byte("b"), []byte("txn-b")))
+	assert.Nil(t, txn.Put([]byte("c"), []byte("txn-c")))
+	assert.Nil(t, txn.Delete([]byte("e")))
+	assert.Nil(t, txn.Put([]byte("f"), []byte("txn-f")))
+
+	iterator := txn.Iterator(DefaultIteratorConfigs)
+	var keys, values []string
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		val, err := iterator.Value()
+		assert.Nil(t, err)
+		keys = append(keys, string(iterator.Key()))
+		values = append(values, string(val))
+	}
+	iterator.Close()
+	assert.Equal(t, []string{"a", "b", "c", "f"}, keys)
+	assert.Equal(t, []string{"db-a", "txn-b", "txn-c", "txn-f"}, values)
+
+	opts2 := DefaultIteratorConfigs
+	opts2.Reverse = true
+	iterator = txn.Iterator(opts2)
+	keys = nil
+	for iterator.Seek([]byte("d")); iterator.Valid(); iterator.Next() {
+		keys = append(keys, string(iterator.Key()))
+	}
+	iterator.Close()
+	assert.Equal(t, []string{"c", "b", "a"}, keys)
+
+	// 通过迭代器读取的数据同样参与冲突检测
+	assert.Nil(t, db.Put([]byte("a"), []byte("changed")))
+	assert.Equal(t, ErrTxnConflict, txn.Commit())
+}
@@ -0,0 +1,177 @@
+package rdb
+
+import (
+	"bytes"
+	"github.com/youzeliang/rdb/data"
+	"math"
+	"strconv"
+	"time"
+)
+
+// 以下操作都在持有数据库写锁的情况下完成读取、比较和写入，保证原子性
+// 更新已有 key 的值时会保留其原本的过期时间
+
+// CompareAndSwap 当 key 当前的值等于 oldValue 时将其更新为 newValue，返回是否更新成功
+// oldValue 为 nil 表示期望 key 不存在
+func (db *DB) CompareAndSwap(key, oldValue, newValue []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrKeyIsEmpty
+	}
+	if db.config.ReadOnly {
+		return false, ErrReadOnly
+	}
+
+	// 比较失败时写到 blob 文件中的 value 成为无效数据，由 BlobGC 回收
+	logRecord, err := db.separateValue(db.defaultFamily, key, newValue)
+	if err != nil {
+		return false, err
+	}
+	var swapped bool
+	err = db.write(db.config.SyncWrites, func() error {
+		current, expire, err := db.getForUpdate(key)
+		if err != nil || !valueMatches(current, oldValue) {
+			return err
+		}
+		logRecord.Expire = expire
+		if err := db.putRecordLocked(db.defaultFamily, key, logRecord); err != nil {
+			return err
+		}
+		swapped = true
+		return nil
+	})
+	return swapped, err
+}
+
+// PutIfAbsent 只有 key 不存在时才写入，返回是否写入成功
+func (db *DB) PutIfAbsent(key, value []byte) (bool, error) {
+	return db.CompareAndSwap(key, nil, value)
+}
+
+// DeleteIfEquals 当 key 当前的值等于 value 时将其删除，返回是否删除成功
+func (db *DB) DeleteIfEquals(key, value []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrKeyIsEmpty
+	}
+	if db.config.ReadOnly {
+		return false, ErrReadOnly
+	}
+
+	var deleted bool
+	err := db.write(db.config.SyncWrites, func() error {
+		current, _, err := db.getForUpdate(key)
+		if err != nil || current == nil || !bytes.Equal(current, value) {
+			return err
+		}
+		if err := db.deleteLocked(db.defaultFamily, key); err != nil {
+			return err
+		}
+		deleted = true
+		return nil
+	})
+	return deleted, err
+}
+
+// Update 以原子的方式读取 key 的值并写入 fn 返回的新值
+// key 不存在时 fn 的参数为 nil；fn 返回 nil 时删除 key；fn 返回错误时不做任何修改
+// 新值需要分离存储时会释放锁写 blob 文件，期间 key 被修改则重新调用 fn，所以 fn 可能被调用多次
+func (db *DB) Update(key []byte, fn func(old []byte) ([]byte, error)) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if db.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	var blobRecord *data.LogRecord // 已经写到 blob 文件中的新值
+	var basePos *data.Position     // 调用 fn 时 key 的位置
+	for {
+		var large []byte
+		err := db.write(db.config.SyncWrites, func() error {
+			logRecordPos := db.lookupIndex(db.index, key)
+			if logRecordPos != nil && logRecordPos.IsExpired(time.Now().UnixNano()) {
+				logRecordPos = nil
+			}
+			// 写 blob 文件期间 key 没有被修改，直接写入 fn 返回的新值
+			if blobRecord != nil && samePosition(logRecordPos, basePos) {
+				if logRecordPos != nil {
+					blobRecord.Expire = logRecordPos.Expire
+				}
+				return db.putRecordLocked(db.defaultFamily, key, blobRecord)
+			}
+
+			current, expire, err := db.getForUpdate(key)
+			if err != nil {
+				return err
+			}
+			newValue, err := fn(current)
+			if err != nil {
+				return err
+			}
+			if newValue == nil {
+				return db.deleteLocked(db.defaultFamily, key)
+			}
+			if db.shouldSeparate(newValue) {
+				large, basePos = newValue, logRecordPos
+				return nil
+			}
+			return db.putRecordLocked(db.defaultFamily, key, &data.LogRecord{Value: newValue, Expire: expire})
+		})
+		if err != nil || large == nil {
+			return err
+		}
+		if blobRecord, err = db.separateValue(db.defaultFamily, key, large); err != nil {
+			return err
+		}
+	}
+}
+
+// Increment 将 key 对应的整数加上 delta，并返回相加之后的值
+// 整数以十进制字符串的形式存储，key 不存在时视为 0
+func (db *DB) Increment(key []byte, delta int64) (int64, error) {
+	var result int64
+	err := db.Update(key, func(old []byte) ([]byte, error) {
+		var current int64
+		if old != nil {
+			val, err := strconv.ParseInt(string(old), 10, 64)
+			if err != nil {
+				return nil, ErrValueNotInteger
+			}
+			current = val
+		}
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return nil, ErrIntegerOverflow
+		}
+		result = current + delta
+		return []byte(strconv.FormatInt(result, 10)), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// getForUpdate 读取 key 包括还没有持久化的写入在内的最新的值及过期时间，key 不存在时返回的值为 nil
+// 调用前必须持有互斥锁
+func (db *DB) getForUpdate(key []byte) ([]byte, int64, error) {
+	logRecordPos := db.lookupIndex(db.index, key)
+	if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+		return nil, 0, nil
+	}
+	value, err := db.getValueByPosition(logRecordPos)
+	if err != nil {
+		return nil, 0, err
+	}
+	// 存在的 key 即使值为空，也要和不存在区分开
+	if value == nil {
+		value = []byte{}
+	}
+	return value, logRecordPos.Expire, nil
+}
+
+// valueMatches 比较当前的值是否和期望的值一致，expected 为 nil 表示期望 key 不存在
+func valueMatches(current, expected []byte) bool {
+	if expected == nil || current == nil {
+		return expected == nil && current == nil
+	}
+	return bytes.Equal(current, expected)
+}
@@ -0,0 +1,179 @@
+package rdb
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/utils"
+	"math"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDB_CompareAndSwap(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-cas")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// key 不存在
+	ok, err := db.CompareAndSwap(utils.GetTestKey(1), []byte("a"), []byte("b"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.CompareAndSwap(utils.GetTestKey(1), nil, []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = db.CompareAndSwap(utils.GetTestKey(1), []byte("x"), []byte("b"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.CompareAndSwap(utils.GetTestKey(1), []byte("a"), []byte("b"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), val)
+
+	// 空值和不存在是不同的
+	assert.Nil(t, db.Put(utils.GetTestKey(2), nil))
+	ok, err = db.PutIfAbsent(utils.GetTestKey(2), []byte("a"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.CompareAndSwap(utils.GetTestKey(2), []byte{}, []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = db.PutIfAbsent(utils.GetTestKey(3), []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = db.DeleteIfEquals(utils.GetTestKey(3), []byte("b"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.DeleteIfEquals(utils.GetTestKey(3), []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = db.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 更新之后保留过期时间
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(4), []byte("a"), time.Hour))
+	ok, err = db.CompareAndSwap(utils.GetTestKey(4), []byte("a"), []byte("b"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ttl, err := db.TTL(utils.GetTestKey(4))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0)
+}
+
+func TestDB_Update(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-update")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Update(utils.GetTestKey(1), func(old []byte) ([]byte, error) {
+		assert.Nil(t, old)
+		return []byte("a"), nil
+	})
+	assert.Nil(t, err)
+
+	err = db.Update(utils.GetTestKey(1), func(old []byte) ([]byte, error) {
+		return append(old, 'b'), nil
+	})
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ab"), val)
+
+	// 返回错误时不修改
+	errAbort := errors.New("abort")
+	err = db.Update(utils.GetTestKey(1), func(old []byte) ([]byte, error) {
+		return []byte("c"), errAbort
+	})
+	assert.Equal(t, errAbort, err)
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ab"), val)
+
+	// 返回 nil 时删除
+	err = db.Update(utils.GetTestKey(1), func(old []byte) ([]byte, error) {
+		return nil, nil
+	})
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_Increment(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-incr")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := db.Increment([]byte("counter"), 1)
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1000"), val)
+
+	res, err := db.Increment([]byte("counter"), -1001)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-1), res)
+
+	assert.Nil(t, db.Put([]byte("not-int"), []byte("abc")))
+	_, err = db.Increment([]byte("not-int"), 1)
+	assert.Equal(t, ErrValueNotInteger, err)
+
+	_, err = db.Increment([]byte("max"), math.MaxInt64)
+	assert.Nil(t, err)
+	_, err = db.Increment([]byte("max"), 1)
+	assert.Equal(t, ErrIntegerOverflow, err)
+}
+
+func TestDB_Update_BlobValue(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-update-blob")
+	opts.DirPath = dir
+	opts.BlobThreshold = 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(1), []byte("small"), time.Hour))
+	// 新值写到 blob 文件之后，key 没有被修改时 fn 只调用一次
+	var calls int
+	err = db.Update(utils.GetTestKey(1), func(old []byte) ([]byte, error) {
+		calls++
+		return append(old, make([]byte, 4096)...), nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, calls)
+	value, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, 5+4096, len(value))
+	ttl, err := db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Minute*59)
+}
@@ -0,0 +1,132 @@
+package rdb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gofrs/flock"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/fio"
+	"github.com/youzeliang/rdb/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Upgrade 将数据目录中没有文件头的旧版本数据文件重新编码为当前的格式
+// 当前格式的记录没有扩展字段时和旧版本的编码相同，重新编码之后记录的位置不变，所以索引和 hint 文件不需要修改
+// 没有文件头的加密文件需要密钥才能解析，返回 ErrEncryptionKeyRequired
+// 升级期间会持有文件锁，数据库不能处于打开状态
+func Upgrade(dir string) error {
+	fileLock := flock.New(filepath.Join(dir, fileLockName))
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return fmt.Errorf("failed to lock database: %v", err)
+	}
+	if !hold {
+		return ErrDatabaseIsUsing
+	}
+	defer func() {
+		_ = fileLock.Unlock()
+	}()
+
+	fileIds, err := getDataFileIds(dir)
+	if err != nil {
+		return err
+	}
+	for _, fid := range fileIds {
+		if err := upgradeDataFile(dir, uint32(fid)); err != nil {
+			return fmt.Errorf("failed to upgrade data file %d: %w", fid, err)
+		}
+	}
+	return nil
+}
+
+// upgradeDataFile 将旧版本数据文件中的记录重新编码，和当前格式的文件头一起写到临时文件之后再替换原来的文件
+func upgradeDataFile(dir string, fid uint32) error {
+	fileName := data.GetDataFileName(dir, fid)
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	dataFile, err := data.OpenDataFile(dir, fid, fio.StandardFIO)
+	// 文件头写了一半的是当前格式的文件，打开数据库时按照 RecoveryMode 处理
+	if errors.Is(err, data.ErrPartialFileHeader) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+	// 空文件在第一次写入时会写入文件头
+	if info.Size() == 0 || dataFile.Header() != nil {
+		return nil
+	}
+	if err := dataFile.SetEncryption(nil); err != nil {
+		return err
+	}
+
+	// 旧版本的文件没有记录创建时间，使用最后修改的时间
+	tmpFileName := fileName + ".upgrade"
+	tmpFile, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := writeUpgradedRecords(tmpFile, dataFile, fileName, info.ModTime()); err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFileName)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFileName, fileName); err != nil {
+		return err
+	}
+	return utils.SyncDir(dir)
+}
+
+// writeUpgradedRecords 写入当前格式的文件头以及重新编码之后的记录
+// 末尾无法解析的数据原样保留，打开数据库时由 RecoveryMode 决定如何处理
+func writeUpgradedRecords(tmpFile *os.File, dataFile *data.DataFile, fileName string, createdAt time.Time) error {
+	if _, err := tmpFile.Write(data.EncodeFileHeader(data.NewFileHeader(createdAt))); err != nil {
+		return err
+	}
+	var offset int64
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			break
+		}
+		// 读出的 value 已经解压，使用原来的算法重新压缩
+		if logRecord.Compression != data.CompressionNone {
+			_, logRecord.Value = data.CompressValue(logRecord.Compression, logRecord.Value)
+		}
+		encRecord, encSize := data.EncodeLogRecord(logRecord)
+		if encSize != size {
+			return fmt.Errorf("%w: record at offset %d has %d bytes, re-encoded %d bytes", ErrUpgradeRecordSize, offset, size, encSize)
+		}
+		if _, err := tmpFile.Write(encRecord); err != nil {
+			return err
+		}
+		offset += size
+	}
+	if err := copyFileTail(tmpFile, fileName, offset); err != nil {
+		return err
+	}
+	return tmpFile.Sync()
+}
+
+// copyFileTail 将旧版本数据文件从 offset 开始的数据原样写到 w 中，旧版本的文件没有文件头，offset 就是文件中的位置
+func copyFileTail(w io.Writer, fileName string, offset int64) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
+}
@@ -0,0 +1,128 @@
+package rdb
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"testing"
+)
+
+// stripFileHeaders 去掉数据文件的文件头，模拟旧版本写入的数据文件
+func stripFileHeaders(t *testing.T, dir string) {
+	fileIds, err := getDataFileIds(dir)
+	assert.Nil(t, err)
+	for _, fid := range fileIds {
+		fileName := data.GetDataFileName(dir, uint32(fid))
+		buf, err := os.ReadFile(fileName)
+		assert.Nil(t, err)
+		if data.HasFileHeader(buf) {
+			assert.Nil(t, os.WriteFile(fileName, buf[data.FileHeaderSize:], 0644))
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-upgrade")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("latest")))
+	assert.Equal(t, data.CurrentFormatVersion, db.activeFile.FormatVersion())
+	assert.Nil(t, db.Close())
+
+	// 旧版本的数据文件通过兼容的方式读取
+	stripFileHeaders(t, dir)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, data.LegacyFormatVersion, db.activeFile.FormatVersion())
+	value, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("latest"), value)
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("legacy")))
+
+	// 数据库打开时不能升级
+	assert.Equal(t, ErrDatabaseIsUsing, Upgrade(dir))
+	assert.Nil(t, db.Close())
+
+	assert.Nil(t, Upgrade(dir))
+	fileIds, err := getDataFileIds(dir)
+	assert.Nil(t, err)
+	for _, fid := range fileIds {
+		buf, err := os.ReadFile(data.GetDataFileName(dir, uint32(fid)))
+		assert.Nil(t, err)
+		assert.True(t, data.HasFileHeader(buf))
+	}
+	// 重复升级不会修改已经是当前格式的文件
+	assert.Nil(t, Upgrade(dir))
+
+	// 升级之后所有的数据文件都是当前的格式
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, data.CurrentFormatVersion, db.activeFile.FormatVersion())
+	for _, dataFile := range db.archivedFiles {
+		assert.Equal(t, data.CurrentFormatVersion, dataFile.FormatVersion())
+	}
+	value, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("latest"), value)
+	value, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("legacy"), value)
+	keys := db.ListKeys()
+	assert.Equal(t, 1000, len(keys))
+}
+
+func TestUpgrade_Compressed(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-upgrade-compressed")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	opts.Compression = FlateCompression
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("compressed"), 100)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+	}
+	assert.Nil(t, db.Close())
+
+	// 末尾写了一半的记录原样保留，打开时再截断
+	stripFileHeaders(t, dir)
+	fileIds, err := getDataFileIds(dir)
+	assert.Nil(t, err)
+	lastFile := data.GetDataFileName(dir, uint32(fileIds[len(fileIds)-1]))
+	file, err := os.OpenFile(lastFile, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{1, 2, 3})
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	before, err := os.Stat(lastFile)
+	assert.Nil(t, err)
+
+	assert.Nil(t, Upgrade(dir))
+	after, err := os.Stat(lastFile)
+	assert.Nil(t, err)
+	assert.Equal(t, before.Size()+data.FileHeaderSize, after.Size())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, data.CurrentFormatVersion, db.activeFile.FormatVersion())
+	for i := 0; i < 500; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
@@ -20,3 +20,10 @@ func TestAvailableDiskSize(t *testing.T) {
 	assert.Nil(t, err)
 	assert.True(t, size > 0)
 }
+
+func TestSyncDir(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-syncdir")
+	defer os.RemoveAll(dir)
+	assert.Nil(t, SyncDir(dir))
+	assert.NotNil(t, SyncDir(dir+"-not-exist"))
+}
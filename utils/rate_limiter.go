@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+// RateLimiter 限制一段时间内读写的字节数，不是并发安全的
+type RateLimiter struct {
+	bytesPerSec int64
+	start       time.Time
+	bytes       int64
+}
+
+// NewRateLimiter 创建每秒最多 bytesPerSec 字节的限速器，bytesPerSec 不大于 0 时返回 nil，表示不限速
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &RateLimiter{bytesPerSec: bytesPerSec, start: time.Now()}
+}
+
+// Wait 记录 n 字节的读写，超过速率时等待到允许的时间，ctx 取消时返回 ctx 的错误
+func (l *RateLimiter) Wait(ctx context.Context, n int64) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	l.bytes += n
+	expected := time.Duration(float64(l.bytes) / float64(l.bytesPerSec) * float64(time.Second))
+	delay := expected - time.Since(l.start)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Wait(t *testing.T) {
+	limiter := NewRateLimiter(100 * 1024)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, limiter.Wait(context.Background(), 5*1024))
+	}
+	// 50KB 在每秒 100KB 的速率下至少需要 0.5 秒
+	assert.True(t, time.Since(start) >= 450*time.Millisecond)
+}
+
+func TestRateLimiter_Cancel(t *testing.T) {
+	limiter := NewRateLimiter(1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, limiter.Wait(ctx, 1024*1024))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestRateLimiter_Unlimited(t *testing.T) {
+	var limiter *RateLimiter = NewRateLimiter(0)
+	assert.Nil(t, limiter)
+	assert.Nil(t, limiter.Wait(context.Background(), 1<<30))
+}
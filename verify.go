@@ -0,0 +1,381 @@
+package rdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/index"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 每检查多少条索引检查一次 ctx 是否已经取消
+const verifyCheckInterval = 1024
+
+// VerifyReport Verify 的检查结果
+type VerifyReport struct {
+	StartedAt     time.Time     `json:"started_at"`
+	Duration      time.Duration `json:"duration"`
+	Files         []FileReport  `json:"files"`          // 每个数据文件以及 hint 文件的检查结果
+	IndexEntries  int           `json:"index_entries"`  // 检查过的索引数量
+	IndexErrors   []IndexError  `json:"index_errors"`   // 没有指向有效记录的索引
+	OrphanedFiles []string      `json:"orphaned_files"` // 数据目录中不属于数据库的文件
+}
+
+// FileReport 单个文件的检查结果
+type FileReport struct {
+	Name      string         `json:"name"`
+	Records   int            `json:"records"` // 校验通过的记录数量
+	Size      int64          `json:"size"`    // 检查的数据大小，不包括文件头
+	Corrupted []CorruptRange `json:"corrupted"`
+	Err       string         `json:"error,omitempty"` // 读取文件失败的原因
+}
+
+// IndexError 没有指向有效记录的索引
+type IndexError struct {
+	ColumnFamily string `json:"column_family"`
+	Key          []byte `json:"key"`
+	Fid          uint32 `json:"fid"`
+	Offset       int64  `json:"offset"`
+	Reason       string `json:"reason"`
+}
+
+// OK 是否没有发现任何问题
+func (r *VerifyReport) OK() bool {
+	for _, file := range r.Files {
+		if len(file.Corrupted) > 0 || file.Err != "" {
+			return false
+		}
+	}
+	return len(r.IndexErrors) == 0 && len(r.OrphanedFiles) == 0
+}
+
+// verifyView 检查时使用的数据库视图，和快照一样引用当时的索引副本以及所有的数据文件
+type verifyView struct {
+	families   []*ColumnFamily
+	indexes    map[uint32]index.Indexer
+	dataFiles  map[uint32]*data.DataFile
+	dataSizes  map[uint32]int64
+	blobFiles  map[uint32]*data.BlobFile
+	maxDataFid uint32
+	maxBlobFid uint32
+}
+
+// Verify 在线检查数据库的完整性：校验所有数据文件以及 hint 文件中每一条记录的 crc，每个数据文件的 hint 文件还需要完整地覆盖数据文件，
+// 检查索引中的每一个位置都指向对应的有效记录，并找出数据目录中不属于数据库的文件
+// 检查基于调用时刻的视图进行，不会阻塞读写，ctx 取消时返回已经完成的部分结果以及 ctx 的错误
+func (db *DB) Verify(ctx context.Context) (*VerifyReport, error) {
+	report := &VerifyReport{StartedAt: time.Now()}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt)
+	}()
+
+	view, err := db.newVerifyView()
+	if err != nil {
+		return nil, err
+	}
+	defer db.releaseVerifyView(view)
+
+	fids := make([]int, 0, len(view.dataFiles))
+	for fid := range view.dataFiles {
+		fids = append(fids, int(fid))
+	}
+	sort.Ints(fids)
+	for _, fid := range fids {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		dataFile := view.dataFiles[uint32(fid)]
+		report.Files = append(report.Files, verifyDataFile(dataFile, filepath.Base(data.GetDataFileName(db.config.DirPath, dataFile.FileId)), view.dataSizes[dataFile.FileId]))
+		if hintReport, ok := db.verifyFileHint(dataFile.FileId, view.dataSizes[dataFile.FileId]); ok {
+			report.Files = append(report.Files, hintReport)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+	if hintReport, ok := db.verifyHintFile(); ok {
+		report.Files = append(report.Files, hintReport)
+	}
+
+	if err := db.verifyIndexes(ctx, view, report); err != nil {
+		return report, err
+	}
+
+	orphaned, err := db.findOrphanedFiles(view)
+	if err != nil {
+		return report, err
+	}
+	report.OrphanedFiles = orphaned
+	return report, nil
+}
+
+// newVerifyView 创建检查使用的视图，引用所有的数据文件和 blob 文件，防止检查期间被关闭
+func (db *DB) newVerifyView() (*verifyView, error) {
+	// 和快照一样只加读锁，拷贝索引期间不阻塞读取
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	view := &verifyView{
+		indexes:   make(map[uint32]index.Indexer, len(db.familyByID)),
+		dataFiles: make(map[uint32]*data.DataFile, len(db.archivedFiles)+1),
+		dataSizes: make(map[uint32]int64, len(db.archivedFiles)+1),
+		blobFiles: make(map[uint32]*data.BlobFile),
+	}
+	for id, cf := range db.familyByID {
+		view.families = append(view.families, cf)
+		view.indexes[id] = cf.index.Clone()
+	}
+	for fid, file := range db.archivedFiles {
+		view.dataFiles[fid] = file
+	}
+	if db.activeFile != nil {
+		view.dataFiles[db.activeFile.FileId] = db.activeFile
+	}
+	for fid, file := range view.dataFiles {
+		size := file.WriteOff
+		// 归档文件的 WriteOff 只在写入时维护，以实际的大小为准
+		if file != db.activeFile {
+			var err error
+			if size, err = file.Size(); err != nil {
+				return nil, err
+			}
+		}
+		view.dataSizes[fid] = size
+		if fid > view.maxDataFid {
+			view.maxDataFid = fid
+		}
+	}
+	db.pinDataFiles(view.dataFiles)
+
+	db.blobLock.RLock()
+	var blobFiles []*data.BlobFile
+	for fid, blobFile := range db.blobFiles {
+		view.blobFiles[fid] = blobFile
+		blobFiles = append(blobFiles, blobFile)
+		if fid > view.maxBlobFid {
+			view.maxBlobFid = fid
+		}
+	}
+	db.blobLock.RUnlock()
+	db.pinBlobFiles(blobFiles)
+	return view, nil
+}
+
+func (db *DB) releaseVerifyView(view *verifyView) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for _, file := range view.dataFiles {
+		db.unpinDataFile(file)
+	}
+	var blobFiles []*data.BlobFile
+	for _, blobFile := range view.blobFiles {
+		blobFiles = append(blobFiles, blobFile)
+	}
+	db.unpinBlobFiles(blobFiles)
+	for _, idx := range view.indexes {
+		_ = idx.Close()
+	}
+}
+
+// verifyDataFile 校验数据文件中 size 之前的每一条记录
+func verifyDataFile(dataFile *data.DataFile, name string, size int64) FileReport {
+	fileReport := FileReport{Name: name, Size: size}
+	corrupted, err := scanDataFile(dataFile, size, func(*data.LogRecord, int64, int64) error {
+		fileReport.Records++
+		return nil
+	})
+	fileReport.Corrupted = corrupted
+	if err != nil {
+		fileReport.Err = err.Error()
+	}
+	return fileReport
+}
+
+// verifyHintFile 校验 hint 文件，文件不存在时返回 false
+func (db *DB) verifyHintFile() (FileReport, bool) {
+	if _, err := os.Stat(filepath.Join(db.config.DirPath, data.HintFileName)); err != nil {
+		return FileReport{}, false
+	}
+	hintFile, err := db.encryptDataFile(data.OpenHintFile(db.config.DirPath))
+	if err != nil {
+		return FileReport{Name: data.HintFileName, Err: err.Error()}, true
+	}
+	defer hintFile.Close()
+	size, err := hintFile.Size()
+	if err != nil {
+		return FileReport{Name: data.HintFileName, Err: err.Error()}, true
+	}
+	return verifyDataFile(hintFile, data.HintFileName, size), true
+}
+
+// verifyFileHint 检查数据文件的 hint 文件是否连续地覆盖了数据文件中的全部记录，文件不存在时返回 false
+func (db *DB) verifyFileHint(fid uint32, size int64) (FileReport, bool) {
+	fileName := data.GetFileHintName(db.config.DirPath, fid)
+	// hint 文件在持有锁时被替换或者删除，打开之后检查期间不受影响
+	db.mutex.RLock()
+	if _, err := os.Stat(fileName); err != nil {
+		db.mutex.RUnlock()
+		return FileReport{}, false
+	}
+	hintFile, err := db.encryptDataFile(data.OpenFileHint(db.config.DirPath, fid))
+	db.mutex.RUnlock()
+	fileReport := FileReport{Name: filepath.Base(fileName)}
+	if err != nil {
+		fileReport.Err = err.Error()
+		return fileReport, true
+	}
+	defer hintFile.Close()
+	if fileReport.Size, err = hintFile.Size(); err != nil {
+		fileReport.Err = err.Error()
+		return fileReport, true
+	}
+	hints, err := checkFileHint(hintFile, fid, size)
+	fileReport.Records = len(hints)
+	if err != nil {
+		fileReport.Err = err.Error()
+	}
+	return fileReport, true
+}
+
+// verifyIndexes 检查所有列族的索引是否都指向有效的记录
+func (db *DB) verifyIndexes(ctx context.Context, view *verifyView, report *VerifyReport) error {
+	for _, cf := range view.families {
+		iterator := view.indexes[cf.id].Iterator(false)
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			if report.IndexEntries%verifyCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					iterator.Close()
+					return err
+				}
+			}
+			report.IndexEntries++
+			pos := iterator.Value()
+			if reason := verifyPosition(view, cf.id, iterator.Key(), pos); reason != "" {
+				report.IndexErrors = append(report.IndexErrors, IndexError{
+					ColumnFamily: cf.name,
+					Key:          append([]byte(nil), iterator.Key()...),
+					Fid:          pos.Fid,
+					Offset:       pos.Offset,
+					Reason:       reason,
+				})
+			}
+		}
+		iterator.Close()
+	}
+	return nil
+}
+
+// verifyPosition 检查索引位置是否指向 key 对应的有效记录，返回不一致的原因
+func verifyPosition(view *verifyView, family uint32, key []byte, pos *data.Position) string {
+	dataFile, ok := view.dataFiles[pos.Fid]
+	if !ok {
+		return "data file not found"
+	}
+	if pos.Offset+int64(pos.Size) > view.dataSizes[pos.Fid] {
+		return "position is beyond the end of the data file"
+	}
+	logRecord, size, err := dataFile.ReadLogRecord(pos.Offset)
+	if err != nil {
+		return err.Error()
+	}
+	realKey, _ := parseLogRecordKey(logRecord.Key)
+	switch {
+	case size != int64(pos.Size):
+		return fmt.Sprintf("record size %d does not match the index size %d", size, pos.Size)
+	case !bytes.Equal(realKey, key):
+		return "record key does not match"
+	case logRecord.ColumnFamily != family:
+		return "record column family does not match"
+	case logRecord.Type != data.LogRecordNormal:
+		return "record is not a live value"
+	case logRecord.Expire != pos.Expire:
+		return "record expire time does not match"
+	case logRecord.Blob != (pos.Blob != nil):
+		return "blob pointer does not match"
+	}
+	if pos.Blob == nil {
+		return ""
+	}
+
+	pointer := data.DecodeBlobPointer(logRecord.Value)
+	if *pointer != *pos.Blob {
+		return "blob pointer does not match"
+	}
+	blobFile, ok := view.blobFiles[pointer.Fid]
+	if !ok {
+		return "blob file not found"
+	}
+	header, err := blobFile.ReadBlobHeader(pointer.Offset)
+	if err != nil {
+		return err.Error()
+	}
+	if !bytes.Equal(header.Key, key) || header.ValueSize != pointer.Size {
+		return "blob entry does not match"
+	}
+	return ""
+}
+
+// findOrphanedFiles 找出数据目录中不属于数据库的文件，检查开始之后新创建的数据文件不算在内
+func (db *DB) findOrphanedFiles(view *verifyView) ([]string, error) {
+	entries, err := os.ReadDir(db.config.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{
+		fileLockName:                 true,
+		data.HintFileName:            true,
+		data.MergeFinishedFileName:   true,
+		data.SeqNoFileName:           true,
+		data.ColumnFamilyFileName:    true,
+		data.CursorFileName:          true,
+		repairReportFileName:         true,
+		index.BPlusTreeIndexFileName: true,
+	}
+
+	var orphaned []string
+	for _, entry := range entries {
+		name := entry.Name()
+		// 正在替换的游标和列族文件
+		if known[name] || known[strings.TrimSuffix(name, ".tmp")] && !entry.IsDir() {
+			continue
+		}
+		if !entry.IsDir() && strings.HasSuffix(name, data.DataFileNameSuffix) {
+			fid, err := strconv.Atoi(strings.TrimSuffix(name, data.DataFileNameSuffix))
+			if err == nil {
+				if _, ok := view.dataFiles[uint32(fid)]; ok || uint32(fid) > view.maxDataFid {
+					continue
+				}
+			}
+		}
+		// 后台正在写入的 hint 文件，写完之后会被替换或者删除
+		if !entry.IsDir() && strings.HasSuffix(name, data.FileHintSuffix+".tmp") {
+			continue
+		}
+		// 数据文件的 hint 文件
+		if !entry.IsDir() && strings.HasSuffix(name, data.FileHintSuffix) {
+			fid, err := strconv.Atoi(strings.TrimSuffix(name, data.FileHintSuffix))
+			if err == nil {
+				if _, ok := view.dataFiles[uint32(fid)]; ok || uint32(fid) > view.maxDataFid {
+					continue
+				}
+			}
+		}
+		if !entry.IsDir() && strings.HasSuffix(name, data.BlobFileNameSuffix) {
+			fid, err := strconv.Atoi(strings.TrimSuffix(name, data.BlobFileNameSuffix))
+			if err == nil {
+				if _, ok := view.blobFiles[uint32(fid)]; ok || uint32(fid) > view.maxBlobFid {
+					continue
+				}
+			}
+		}
+		orphaned = append(orphaned, name)
+	}
+	return orphaned, nil
+}
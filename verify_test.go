@@ -0,0 +1,153 @@
+package rdb
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/data"
+	"github.com/youzeliang/rdb/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDB_Verify(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-verify")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+
+	report, err := db.Verify(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 900, report.IndexEntries)
+	assert.True(t, len(report.Files) > 1)
+	var records int
+	for _, file := range report.Files {
+		if strings.HasSuffix(file.Name, data.DataFileNameSuffix) {
+			records += file.Records
+		}
+	}
+	assert.Equal(t, 1100, records)
+
+	// 损坏一条记录，同时放一个不属于数据库的文件
+	pos := corruptRecord(t, db, utils.GetTestKey(500))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "stray.txt"), []byte("stray"), 0644))
+
+	report, err = db.Verify(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	var corrupted int
+	for _, file := range report.Files {
+		corrupted += len(file.Corrupted)
+	}
+	assert.Equal(t, 1, corrupted)
+	assert.Equal(t, 1, len(report.IndexErrors))
+	assert.Equal(t, utils.GetTestKey(500), report.IndexErrors[0].Key)
+	assert.Equal(t, pos.Fid, report.IndexErrors[0].Fid)
+	assert.Equal(t, pos.Offset, report.IndexErrors[0].Offset)
+	assert.Equal(t, []string{"stray.txt"}, report.OrphanedFiles)
+
+	// 检查期间数据库可以继续读写
+	assert.Nil(t, db.Put([]byte("after"), []byte("verify")))
+	value, err := db.Get([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("verify"), value)
+}
+
+func TestDB_Verify_HintFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-verify-hint")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+
+	report, err := db.Verify(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	var hint *FileReport
+	for i := range report.Files {
+		if report.Files[i].Name == "hint-index" {
+			hint = &report.Files[i]
+		}
+	}
+	assert.NotNil(t, hint)
+	assert.Equal(t, 500, hint.Records)
+}
+
+func TestDB_Verify_FileHint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-verify-file-hint")
+	opts.DirPath = dir
+	opts.FileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+	}
+	db.fileHints.wg.Wait()
+
+	report, err := db.Verify(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	hintName := filepath.Base(data.GetFileHintName(dir, 0))
+	var hint *FileReport
+	for i := range report.Files {
+		if report.Files[i].Name == hintName {
+			hint = &report.Files[i]
+		}
+	}
+	assert.NotNil(t, hint)
+	assert.True(t, hint.Records > 0)
+
+	// 截断之后的 hint 文件不能完整地覆盖数据文件
+	info, err := os.Stat(data.GetFileHintName(dir, 0))
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(data.GetFileHintName(dir, 0), info.Size()/2))
+	report, err = db.Verify(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	hint = nil
+	for i := range report.Files {
+		if report.Files[i].Name == hintName {
+			hint = &report.Files[i]
+		}
+	}
+	assert.NotNil(t, hint)
+	assert.NotEmpty(t, hint.Err)
+}
+
+func TestDB_Verify_Canceled(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-verify-cancel")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(24)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := db.Verify(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.NotNil(t, report)
+}
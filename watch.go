@@ -0,0 +1,207 @@
+package rdb
+
+import (
+	"bytes"
+	"github.com/youzeliang/rdb/data"
+	"io"
+	"sync"
+	"time"
+)
+
+type EventOp = int8
+
+const (
+	// EventPut 写入数据
+	EventPut EventOp = iota + 1
+
+	// EventDelete 删除数据，包括过期数据的清理
+	EventDelete
+)
+
+// Event 一次已经提交的修改
+type Event struct {
+	Seq          uint64  // 修改的全局序列号，单调递增
+	Op           EventOp // 修改的类型
+	ColumnFamily string  // 所属列族的名称
+	Key          []byte
+	Value        []byte // 删除操作的 value 为空，存储在 blob 文件中的 value 也为空，通过 ValueReader 读取
+	BlobValue    bool   // value 是否存储在 blob 文件中
+	Expire       int64  // 过期时间，为 0 表示永不过期
+	Timestamp    int64  // 提交的时间，UnixNano，从数据文件中读取的修改没有提交时间，为 0
+
+	db   *DB
+	blob *data.BlobPointer
+}
+
+// ValueReader 返回读取 value 的 Reader，存储在 blob 文件中的 value 在调用时才从文件中读取
+// 发送事件时不读取 blob，不会阻塞写入；blob 已经被 BlobGC 回收时返回错误
+func (e *Event) ValueReader() (io.ReadCloser, error) {
+	if e.blob == nil {
+		return io.NopCloser(bytes.NewReader(e.Value)), nil
+	}
+	e.db.mutex.RLock()
+	defer e.db.mutex.RUnlock()
+	return e.db.openBlobReader(e.blob)
+}
+
+// Watcher 订阅列族中指定前缀的 key 的修改
+// 每一次提交的修改作为一组事件发送，WriteBatch 和事务中的修改会在同一组中
+type Watcher struct {
+	db      *DB
+	family  uint32
+	prefix  []byte
+	configs WatchConfigs
+	ch      chan []*Event
+	dropped uint64 // 因为缓冲区已满被丢弃的事件组数量
+	err     error
+	once    sync.Once
+}
+
+// Watch 订阅默认列族中指定前缀的 key 的修改，prefix 为空时订阅所有的 key
+func (db *DB) Watch(prefix []byte, opts WatchConfigs) *Watcher {
+	return db.watch(db.defaultFamily, prefix, opts)
+}
+
+// Watch 订阅列族中指定前缀的 key 的修改
+func (cf *ColumnFamily) Watch(prefix []byte, opts WatchConfigs) *Watcher {
+	return cf.db.watch(cf, prefix, opts)
+}
+
+func (db *DB) watch(cf *ColumnFamily, prefix []byte, opts WatchConfigs) *Watcher {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultWatchConfigs.BufferSize
+	}
+	w := &Watcher{
+		db:      db,
+		family:  cf.id,
+		prefix:  prefix,
+		configs: opts,
+		ch:      make(chan []*Event, opts.BufferSize),
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.watchers[w] = struct{}{}
+	return w
+}
+
+// Events 接收事件的 channel，订阅关闭之后 channel 会被关闭
+func (w *Watcher) Events() <-chan []*Event {
+	return w.ch
+}
+
+// Err 返回订阅被关闭的原因，缓冲区已满而被关闭时返回 ErrWatchOverflow
+func (w *Watcher) Err() error {
+	w.db.mutex.RLock()
+	defer w.db.mutex.RUnlock()
+	return w.err
+}
+
+// Dropped 返回因为缓冲区已满而被丢弃的事件组数量
+func (w *Watcher) Dropped() uint64 {
+	w.db.mutex.RLock()
+	defer w.db.mutex.RUnlock()
+	return w.dropped
+}
+
+// Close 取消订阅，多次调用是安全的
+func (w *Watcher) Close() {
+	w.db.mutex.Lock()
+	defer w.db.mutex.Unlock()
+	w.closeLocked(nil)
+}
+
+// closeLocked 调用前必须持有互斥锁
+func (w *Watcher) closeLocked(err error) {
+	w.once.Do(func() {
+		delete(w.db.watchers, w)
+		w.err = err
+		close(w.ch)
+	})
+}
+
+// send 发送一组事件，不会阻塞写入，调用前必须持有互斥锁
+func (w *Watcher) send(events []*Event) {
+	for {
+		select {
+		case w.ch <- events:
+			return
+		default:
+		}
+
+		if w.configs.OverflowPolicy != WatchOverflowDropOldest {
+			w.closeLocked(ErrWatchOverflow)
+			return
+		}
+		select {
+		case <-w.ch:
+			w.dropped++
+		default:
+		}
+	}
+}
+
+// publish 将一次提交中的修改发送给所有订阅者，records 中的 key 不带事务序列号
+// 调用前必须持有互斥锁
+func (db *DB) publish(records []*data.LogRecord) {
+	if len(db.watchers) == 0 {
+		return
+	}
+	// 需要持久化的写入在持久化之后再发送，排在它们后面的写入也要等待，保证事件的顺序
+	if db.writeNeedSync || len(db.pendingEvents) > 0 {
+		db.pendingEvents = append(db.pendingEvents, &pendingEvents{ticket: db.appendTicket, needSync: db.writeNeedSync, records: records})
+		return
+	}
+	db.deliver(records)
+}
+
+// deliver 将修改构造成事件发送给订阅者，调用前必须持有互斥锁
+func (db *DB) deliver(records []*data.LogRecord) {
+	now := time.Now().UnixNano()
+	events := make([]*Event, len(records))
+	for i, record := range records {
+		events[i] = db.newEvent(record, now)
+	}
+
+	for w := range db.watchers {
+		var matched []*Event
+		for i, record := range records {
+			if record.ColumnFamily == w.family && bytes.HasPrefix(record.Key, w.prefix) {
+				matched = append(matched, events[i])
+			}
+		}
+		if len(matched) > 0 {
+			w.send(matched)
+		}
+	}
+}
+
+// newEvent 根据修改记录构造事件，records 中的 key 不带事务序列号
+func (db *DB) newEvent(record *data.LogRecord, timestamp int64) *Event {
+	event := &Event{
+		Seq:       record.Seq,
+		Op:        EventPut,
+		Key:       append([]byte(nil), record.Key...),
+		Expire:    record.Expire,
+		Timestamp: timestamp,
+	}
+	if cf, ok := db.familyByID[record.ColumnFamily]; ok {
+		event.ColumnFamily = cf.name
+	}
+	if record.Type == data.LogRecordDeleted {
+		event.Op = EventDelete
+	} else if record.Blob {
+		event.BlobValue = true
+		event.db, event.blob = db, data.DecodeBlobPointer(record.Value)
+	} else {
+		event.Value = append([]byte{}, record.Value...)
+	}
+	return event
+}
+
+// closeWatchers 关闭所有的订阅，调用前必须持有互斥锁
+func (db *DB) closeWatchers() {
+	for w := range db.watchers {
+		w.closeLocked(nil)
+	}
+}
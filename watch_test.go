@@ -0,0 +1,183 @@
+package rdb
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/youzeliang/rdb/utils"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_Watch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	watcher := db.Watch([]byte("user:"), DefaultWatchConfigs)
+	defer watcher.Close()
+	all := db.Watch(nil, DefaultWatchConfigs)
+	defer all.Close()
+
+	assert.Nil(t, db.Put([]byte("user:1"), []byte("a")))
+	assert.Nil(t, db.Put([]byte("order:1"), []byte("b")))
+	assert.Nil(t, db.Delete([]byte("user:1")))
+	// 删除不存在的 key 不会产生事件
+	assert.Nil(t, db.Delete([]byte("user:2")))
+
+	events := <-watcher.Events()
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EventPut, events[0].Op)
+	assert.Equal(t, []byte("user:1"), events[0].Key)
+	assert.Equal(t, []byte("a"), events[0].Value)
+	assert.True(t, events[0].Timestamp > 0)
+	putSeq := events[0].Seq
+
+	events = <-watcher.Events()
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EventDelete, events[0].Op)
+	assert.Equal(t, []byte("user:1"), events[0].Key)
+	assert.Nil(t, events[0].Value)
+	assert.True(t, events[0].Seq > putSeq)
+	assert.Equal(t, 0, len(watcher.Events()))
+	assert.Equal(t, 3, len(all.Events()))
+
+	// 批量写入的修改作为一组事件发送
+	wb := db.NewWriteBatch(DefaultWriteBatchConfigs)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, wb.Put([]byte("user:"+string(utils.GetTestKey(i))), []byte("v")))
+	}
+	assert.Nil(t, wb.Put([]byte("order:2"), []byte("v")))
+	assert.Nil(t, wb.Commit())
+	events = <-watcher.Events()
+	assert.Equal(t, 10, len(events))
+
+	txn := db.Begin()
+	assert.Nil(t, txn.Put([]byte("user:txn"), []byte("v")))
+	assert.Nil(t, txn.Delete([]byte("user:"+string(utils.GetTestKey(1)))))
+	assert.Nil(t, txn.Commit())
+	events = <-watcher.Events()
+	assert.Equal(t, 2, len(events))
+
+	// 列族的修改只会发送给订阅该列族的订阅者
+	cf, err := db.CreateColumnFamily("users", DefaultColumnFamilyConfigs)
+	assert.Nil(t, err)
+	cfWatcher := cf.Watch(nil, DefaultWatchConfigs)
+	assert.Nil(t, cf.Put([]byte("user:1"), []byte("cf")))
+	events = <-cfWatcher.Events()
+	assert.Equal(t, []byte("cf"), events[0].Value)
+	assert.Equal(t, 0, len(watcher.Events()))
+
+	// 关闭数据库时关闭所有的订阅
+	assert.Nil(t, db.Close())
+	_, ok := <-cfWatcher.Events()
+	assert.False(t, ok)
+	assert.Nil(t, cfWatcher.Err())
+}
+
+func TestDB_Watch_Overflow(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-overflow")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	closing := db.Watch(nil, WatchConfigs{BufferSize: 2, OverflowPolicy: WatchOverflowClose})
+	dropping := db.Watch(nil, WatchConfigs{BufferSize: 2, OverflowPolicy: WatchOverflowDropOldest})
+	defer dropping.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(10)))
+	}
+
+	// 缓冲区满了之后订阅被关闭，已经缓冲的事件仍然可以读取
+	var received int
+	for range closing.Events() {
+		received++
+	}
+	assert.Equal(t, 2, received)
+	assert.Equal(t, ErrWatchOverflow, closing.Err())
+	closing.Close()
+
+	// 丢弃最旧的事件，保留最新的事件
+	assert.Equal(t, uint64(3), dropping.Dropped())
+	events := <-dropping.Events()
+	assert.Equal(t, utils.GetTestKey(3), events[0].Key)
+	events = <-dropping.Events()
+	assert.Equal(t, utils.GetTestKey(4), events[0].Key)
+}
+
+func TestDB_Watch_Expired(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-expired")
+	opts.DirPath = dir
+	opts.ExpirySweepInterval = 10 * time.Millisecond
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	watcher := db.Watch(nil, DefaultWatchConfigs)
+	defer watcher.Close()
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(1), []byte("v"), 20*time.Millisecond))
+	events := <-watcher.Events()
+	assert.Equal(t, EventPut, events[0].Op)
+	assert.True(t, events[0].Expire > 0)
+
+	select {
+	case events = <-watcher.Events():
+		assert.Equal(t, EventDelete, events[0].Op)
+		assert.Equal(t, utils.GetTestKey(1), events[0].Key)
+	case <-time.After(time.Second):
+		t.Fatal("expected a delete event for the expired key")
+	}
+}
+
+func TestDB_Watch_BlobValue(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-blob")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	watcher := db.Watch(nil, DefaultWatchConfigs)
+	defer watcher.Close()
+	large := bytes.Repeat([]byte("rdb-large-value"), 20000)
+	assert.Nil(t, db.PutReader(utils.GetTestKey(1), bytes.NewReader(large), int64(len(large))))
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("small")))
+
+	// blob 中的 value 在订阅者读取时才从文件中读出
+	events := <-watcher.Events()
+	assert.True(t, events[0].BlobValue)
+	assert.Nil(t, events[0].Value)
+	reader, err := events[0].ValueReader()
+	assert.Nil(t, err)
+	value, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, large, value)
+
+	events = <-watcher.Events()
+	assert.False(t, events[0].BlobValue)
+	reader, err = events[0].ValueReader()
+	assert.Nil(t, err)
+	value, err = io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("small"), value)
+
+	changes, err := db.ReadChangesSince(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(changes))
+	assert.True(t, changes[0].BlobValue)
+	reader, err = changes[0].ValueReader()
+	assert.Nil(t, err)
+	value, err = io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, large, value)
+}